@@ -0,0 +1,58 @@
+package auth
+
+/*
+ * 连接握手阶段的鉴权
+ *
+ * client: Option 之后发送 Credentials 生成的 token
+ * server: Authenticator 校验 token, 得到调用方身份 Principal
+ * */
+
+import (
+	"errors"
+)
+
+const (
+	SchemeBearer = "bearer"
+	SchemeHMAC   = "hmac-sha256"
+)
+
+var (
+	ErrInvalidToken = errors.New("auth: invalid token")
+	ErrExpiredToken = errors.New("auth: token expired")
+	ErrUnknownKey   = errors.New("auth: unknown key")
+)
+
+// Principal 鉴权通过后的调用方身份
+type Principal struct {
+	Name  string
+	Attrs map[string]string
+}
+
+func (p *Principal) Attr(key string) string {
+	if p == nil || p.Attrs == nil {
+		return ""
+	}
+	return p.Attrs[key]
+}
+
+// Credentials 客户端凭证
+type Credentials interface {
+	Scheme() string
+	Token() (string, error)
+}
+
+// Authenticator 服务端鉴权
+type Authenticator interface {
+	Authenticate(scheme, token string) (*Principal, error)
+}
+
+// Chain 按scheme分发给对应的Authenticator
+type Chain map[string]Authenticator
+
+func (c Chain) Authenticate(scheme, token string) (*Principal, error) {
+	a, ok := c[scheme]
+	if !ok {
+		return nil, errors.New("auth: unsupported scheme " + scheme)
+	}
+	return a.Authenticate(scheme, token)
+}
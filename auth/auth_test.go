@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	ta := NewTokenAuthenticator()
+	ta.AddToken("s3cret", &Principal{Name: "alice", Attrs: map[string]string{"role": "admin"}})
+
+	c := TokenCredentials("s3cret")
+	token, _ := c.Token()
+	p, err := ta.Authenticate(c.Scheme(), token)
+	if err != nil || p.Name != "alice" || p.Attr("role") != "admin" {
+		t.Fatalf("expect alice, got %+v err:%v", p, err)
+	}
+
+	_, err = ta.Authenticate(SchemeBearer, "wrong")
+	if err != ErrInvalidToken {
+		t.Fatalf("expect ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	ha := NewHMACAuthenticator(time.Minute)
+	ha.AddKey("k1", []byte("secret"), nil)
+
+	c := &HMACCredentials{KeyId: "k1", Secret: []byte("secret")}
+	token, _ := c.Token()
+	p, err := ha.Authenticate(c.Scheme(), token)
+	if err != nil || p.Name != "k1" {
+		t.Fatalf("expect k1, got %+v err:%v", p, err)
+	}
+
+	bad := &HMACCredentials{KeyId: "k1", Secret: []byte("other")}
+	token, _ = bad.Token()
+	if _, err = ha.Authenticate(SchemeHMAC, token); err != ErrInvalidToken {
+		t.Fatalf("expect ErrInvalidToken, got %v", err)
+	}
+
+	msg := "k1:" + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	if _, err = ha.Authenticate(SchemeHMAC, msg+":"+sign([]byte("secret"), msg)); err != ErrExpiredToken {
+		t.Fatalf("expect ErrExpiredToken, got %v", err)
+	}
+
+	chain := Chain{SchemeHMAC: ha}
+	if _, err = chain.Authenticate(SchemeBearer, "x"); err == nil {
+		t.Fatal("expect unsupported scheme")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	pl, err := ParsePolicy([]byte(`{
+		"default": "deny",
+		"rules": [
+			{"name": "no-admin-ops", "effect": "deny", "service": "Admin", "method": "*", "attrs": {"role": "guest"}},
+			{"name": "admins", "effect": "allow", "service": "*", "attrs": {"role": "admin"}},
+			{"name": "readers", "effect": "allow", "service": "Foo", "method": "Get*", "principals": ["svc-*"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := &Principal{Name: "alice", Attrs: map[string]string{"role": "admin"}}
+	guest := &Principal{Name: "bob", Attrs: map[string]string{"role": "guest"}}
+	reader := &Principal{Name: "svc-report"}
+
+	cases := []struct {
+		p       *Principal
+		service string
+		method  string
+		allow   bool
+	}{
+		{admin, "Admin", "Shutdown", true},
+		{guest, "Admin", "Shutdown", false},
+		{reader, "Foo", "GetUser", true},
+		{reader, "Foo", "SetUser", false},
+		{nil, "Foo", "GetUser", false},
+	}
+	for _, c := range cases {
+		err := pl.Authorize(c.p, c.service, c.method)
+		if (err == nil) != c.allow {
+			t.Fatalf("%+v %s.%s expect allow:%v got err:%v", c.p, c.service, c.method, c.allow, err)
+		}
+	}
+
+	if _, err = ParsePolicy([]byte(`{"rules":[{"effect":"maybe"}]}`)); err == nil {
+		t.Fatal("expect invalid effect")
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lrpc-auth")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy.json")
+	_ = ioutil.WriteFile(file, []byte(`{"default":"deny"}`), 0644)
+
+	pa, err := LoadPolicyFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pa.Authorize(nil, "Foo", "Sum"); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatal("expect denied, got", err)
+	}
+
+	_ = ioutil.WriteFile(file, []byte(`{"default":"allow"}`), 0644)
+	if err = pa.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err = pa.Authorize(nil, "Foo", "Sum"); err != nil {
+		t.Fatal("expect allowed after reload, got", err)
+	}
+
+	_ = ioutil.WriteFile(file, []byte(`{`), 0644)
+	if err = pa.Reload(); err == nil {
+		t.Fatal("expect parse error")
+	}
+	if err = pa.Authorize(nil, "Foo", "Sum"); err != nil {
+		t.Fatal("expect old policy kept, got", err)
+	}
+}
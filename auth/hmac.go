@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHMACSkew = 5 * time.Minute
+)
+
+// HMACCredentials token格式 keyId:timestamp:hex(hmac-sha256(secret, keyId:timestamp))
+type HMACCredentials struct {
+	KeyId  string
+	Secret []byte
+}
+
+func (h *HMACCredentials) Scheme() string {
+	return SchemeHMAC
+}
+
+func (h *HMACCredentials) Token() (string, error) {
+	msg := h.KeyId + ":" + strconv.FormatInt(time.Now().Unix(), 10)
+	return msg + ":" + sign(h.Secret, msg), nil
+}
+
+func sign(secret []byte, msg string) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type hmacKey struct {
+	secret    []byte
+	principal *Principal
+}
+
+type HMACAuthenticator struct {
+	skew time.Duration
+	mu   sync.RWMutex
+	keys map[string]*hmacKey
+}
+
+func NewHMACAuthenticator(skew time.Duration) *HMACAuthenticator {
+	if skew <= 0 {
+		skew = DefaultHMACSkew
+	}
+	return &HMACAuthenticator{
+		skew: skew,
+		keys: make(map[string]*hmacKey),
+	}
+}
+
+// AddKey p为nil时以keyId作为Principal.Name
+func (ha *HMACAuthenticator) AddKey(keyId string, secret []byte, p *Principal) {
+	if p == nil {
+		p = &Principal{Name: keyId}
+	}
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	ha.keys[keyId] = &hmacKey{secret: secret, principal: p}
+}
+
+func (ha *HMACAuthenticator) RemoveKey(keyId string) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	delete(ha.keys, keyId)
+}
+
+func (ha *HMACAuthenticator) Authenticate(scheme, token string) (*Principal, error) {
+	if scheme != SchemeHMAC {
+		return nil, ErrInvalidToken
+	}
+
+	ss := strings.Split(token, ":")
+	if len(ss) != 3 {
+		return nil, ErrInvalidToken
+	}
+	keyId, ts, sig := ss[0], ss[1], ss[2]
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	d := time.Since(time.Unix(unix, 0))
+	if d > ha.skew || d < -ha.skew {
+		return nil, ErrExpiredToken
+	}
+
+	ha.mu.RLock()
+	k := ha.keys[keyId]
+	ha.mu.RUnlock()
+	if k == nil {
+		return nil, ErrUnknownKey
+	}
+
+	expect := sign(k.secret, keyId+":"+ts)
+	if !hmac.Equal([]byte(expect), []byte(sig)) {
+		return nil, ErrInvalidToken
+	}
+	return k.principal, nil
+}
@@ -0,0 +1,271 @@
+package auth
+
+/*
+ * 按 service/method 授权
+ *
+ * 规则按顺序匹配, 命中第一条即生效, 全部未命中时使用 Default
+ * Service/Method/Principals 支持 path.Match 通配, 未鉴权的调用方 Name 为空
+ * */
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/zulong210220/lrpc/log"
+)
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+var (
+	ErrPermissionDenied = errors.New("auth: permission denied")
+)
+
+// Authorizer 服务端授权
+type Authorizer interface {
+	Authorize(p *Principal, service, method string) error
+}
+
+type Rule struct {
+	Name       string            `json:"name"`
+	Effect     string            `json:"effect"`
+	Service    string            `json:"service"`
+	Method     string            `json:"method"`
+	Principals []string          `json:"principals"`
+	Attrs      map[string]string `json:"attrs"`
+}
+
+type Policy struct {
+	Default string  `json:"default"`
+	Rules   []*Rule `json:"rules"`
+}
+
+// DenyError 带上命中的规则, 便于审计
+type DenyError struct {
+	Rule string
+}
+
+func (e *DenyError) Error() string {
+	if e.Rule == "" {
+		return ErrPermissionDenied.Error()
+	}
+	return ErrPermissionDenied.Error() + " by rule " + e.Rule
+}
+
+func (e *DenyError) Unwrap() error {
+	return ErrPermissionDenied
+}
+
+func match(pattern, s string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
+
+func (r *Rule) Match(p *Principal, service, method string) bool {
+	if !match(r.Service, service) || !match(r.Method, method) {
+		return false
+	}
+
+	name := ""
+	if p != nil {
+		name = p.Name
+	}
+	if len(r.Principals) > 0 {
+		found := false
+		for _, pn := range r.Principals {
+			if match(pn, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for k, v := range r.Attrs {
+		if p == nil {
+			return false
+		}
+		av, ok := p.Attrs[k]
+		if !ok || !match(v, av) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pl *Policy) Authorize(p *Principal, service, method string) error {
+	for _, r := range pl.Rules {
+		if !r.Match(p, service, method) {
+			continue
+		}
+		if r.Effect == EffectAllow {
+			return nil
+		}
+		return &DenyError{Rule: r.Name}
+	}
+
+	if pl.Default == EffectAllow {
+		return nil
+	}
+	return &DenyError{}
+}
+
+func (pl *Policy) Validate() error {
+	switch pl.Default {
+	case "", EffectAllow, EffectDeny:
+	default:
+		return errors.New("auth: invalid default effect " + pl.Default)
+	}
+	for _, r := range pl.Rules {
+		if r.Effect != EffectAllow && r.Effect != EffectDeny {
+			return errors.New("auth: invalid effect " + r.Effect + " in rule " + r.Name)
+		}
+		for _, pt := range []string{r.Service, r.Method} {
+			if _, err := path.Match(pt, ""); err != nil {
+				return errors.New("auth: invalid pattern " + pt + " in rule " + r.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func ParsePolicy(data []byte) (*Policy, error) {
+	pl := &Policy{}
+	err := jsoniter.Unmarshal(data, pl)
+	if err != nil {
+		return nil, err
+	}
+	err = pl.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+// PolicyAuthorizer 从配置文件加载策略, 支持运行时重新加载
+type PolicyAuthorizer struct {
+	file    string
+	policy  atomic.Value // *Policy
+	mu      sync.Mutex
+	modTime time.Time
+	stop    chan struct{}
+}
+
+func NewPolicyAuthorizer(pl *Policy) *PolicyAuthorizer {
+	pa := &PolicyAuthorizer{}
+	if pl == nil {
+		pl = &Policy{Default: EffectDeny}
+	}
+	pa.policy.Store(pl)
+	return pa
+}
+
+// LoadPolicyFile 加载失败直接返回错误, 不会使用默认策略启动
+func LoadPolicyFile(file string) (*PolicyAuthorizer, error) {
+	pa := &PolicyAuthorizer{file: file}
+	err := pa.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return pa, nil
+}
+
+func (pa *PolicyAuthorizer) Policy() *Policy {
+	return pa.policy.Load().(*Policy)
+}
+
+func (pa *PolicyAuthorizer) SetPolicy(pl *Policy) {
+	pa.policy.Store(pl)
+}
+
+// Reload 重新读取配置文件, 解析失败时保留旧策略
+func (pa *PolicyAuthorizer) Reload() error {
+	fun := "PolicyAuthorizer.Reload"
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+
+	if pa.file == "" {
+		return errors.New("auth: no policy file")
+	}
+
+	fi, err := os.Stat(pa.file)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(pa.file)
+	if err != nil {
+		return err
+	}
+
+	pl, err := ParsePolicy(data)
+	if err != nil {
+		log.Errorf("", "%s parse %s failed err:%v", fun, pa.file, err)
+		return err
+	}
+
+	pa.policy.Store(pl)
+	pa.modTime = fi.ModTime()
+	log.Infof("", "%s loaded %s rules:%d", fun, pa.file, len(pl.Rules))
+	return nil
+}
+
+// Watch 定期检查配置文件修改时间, 变化后重新加载
+func (pa *PolicyAuthorizer) Watch(dur time.Duration) {
+	pa.mu.Lock()
+	if pa.stop != nil {
+		pa.mu.Unlock()
+		return
+	}
+	pa.stop = make(chan struct{})
+	stop := pa.stop
+	pa.mu.Unlock()
+
+	go func() {
+		t := time.NewTicker(dur)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				fi, err := os.Stat(pa.file)
+				if err != nil {
+					continue
+				}
+				pa.mu.Lock()
+				changed := !fi.ModTime().Equal(pa.modTime)
+				pa.mu.Unlock()
+				if changed {
+					_ = pa.Reload()
+				}
+			}
+		}
+	}()
+}
+
+func (pa *PolicyAuthorizer) StopWatch() {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if pa.stop != nil {
+		close(pa.stop)
+		pa.stop = nil
+	}
+}
+
+func (pa *PolicyAuthorizer) Authorize(p *Principal, service, method string) error {
+	return pa.Policy().Authorize(p, service, method)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"sync"
+)
+
+// TokenCredentials 静态 bearer token
+type TokenCredentials string
+
+func (t TokenCredentials) Scheme() string {
+	return SchemeBearer
+}
+
+func (t TokenCredentials) Token() (string, error) {
+	return string(t), nil
+}
+
+type TokenAuthenticator struct {
+	mu     sync.RWMutex
+	tokens map[string]*Principal
+}
+
+func NewTokenAuthenticator() *TokenAuthenticator {
+	return &TokenAuthenticator{
+		tokens: make(map[string]*Principal),
+	}
+}
+
+func (ta *TokenAuthenticator) AddToken(token string, p *Principal) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	ta.tokens[token] = p
+}
+
+func (ta *TokenAuthenticator) RemoveToken(token string) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	delete(ta.tokens, token)
+}
+
+func (ta *TokenAuthenticator) Authenticate(scheme, token string) (*Principal, error) {
+	if scheme != SchemeBearer || token == "" {
+		return nil, ErrInvalidToken
+	}
+
+	ta.mu.RLock()
+	defer ta.mu.RUnlock()
+
+	// 逐个常量时间比较, 避免时序侧信道
+	var found *Principal
+	for t, p := range ta.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = p
+		}
+	}
+	if found == nil {
+		return nil, ErrInvalidToken
+	}
+	return found, nil
+}
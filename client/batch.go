@@ -0,0 +1,160 @@
+package client
+
+import (
+	gctx "context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/tracing"
+)
+
+// Batch 收集多次调用, 通过一帧发送, 服务端并行处理后一次返回, 不能并发使用
+type Batch struct {
+	c     *Client
+	calls []*Call
+}
+
+func (c *Client) Batch() *Batch {
+	return &Batch{c: c}
+}
+
+// Add 结果在 Do 返回后通过 Call.Error 和 reply 取得
+func (b *Batch) Add(sm string, args, reply lcode.IMessage) *Call {
+	ca := &Call{
+		Seq:           uint64(len(b.calls)),
+		ServiceMethod: sm,
+		Args:          args,
+		Reply:         reply,
+	}
+	b.calls = append(b.calls, ca)
+	return ca
+}
+
+func (b *Batch) Len() int {
+	return len(b.calls)
+}
+
+// Do ctx 的期限同时作为服务端的整体期限, 没有期限时使用服务端的处理超时
+// 返回错误表示整个批量失败, 每条的 Error 也会被设置; 否则各条的结果相互独立
+func (b *Batch) Do(ctx *context.Context) (err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, ca := range b.calls {
+			if ca.Error == nil {
+				ca.Error = err
+			}
+		}
+	}()
+
+	c := b.c
+	if c == nil {
+		return ErrShutdown
+	}
+	if len(b.calls) == 0 {
+		return nil
+	}
+
+	span := tracing.StartClientSpan(ctx, rpc.BatchServiceMethod)
+	span.SetAttr("peer", c.m.endpoint)
+	span.SetAttr("batch.size", strconv.Itoa(len(b.calls)))
+	defer func() {
+		if err != nil {
+			span.SetStatus(lcode.ErrorCode(err).String(), lcode.ErrorDesc(err))
+		}
+		span.End()
+	}()
+
+	meta := context.Metadata(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := time.Until(deadline).Milliseconds()
+		if ms <= 0 {
+			return lcode.NewError(lcode.CodeDeadlineExceeded, "rpc client: batch deadline exceeded")
+		}
+		m := make(map[string]string, len(meta)+1)
+		for k, v := range meta {
+			m[k] = v
+		}
+		m[rpc.MetaBatchTimeout] = strconv.FormatInt(ms, 10)
+		meta = m
+	}
+
+	ca := &Call{
+		ServiceMethod: rpc.BatchServiceMethod,
+		TraceId:       context.GetTraceId(ctx),
+		Traceparent:   span.Context().Traceparent(),
+		Meta:          meta,
+		Done:          make(chan *Call, 1),
+		entries:       b.calls,
+	}
+	span.SetAttr("lrpc.trace_id", ca.TraceId)
+	c.send(ca)
+
+	select {
+	case <-ctx.Done():
+		sent, removed := c.abandon(ca)
+		if sent && !removed {
+			// 响应已经在处理
+			<-ca.Done
+			return ca.Error
+		}
+		code := lcode.CodeCanceled
+		if ctx.Err() == gctx.DeadlineExceeded {
+			code = lcode.CodeDeadlineExceeded
+		}
+		err = lcode.Errorf(code, "rpc client: batch failed err:%v", ctx.Err())
+		if removed {
+			c.m.inflight.Dec()
+			c.m.observe(ca.ServiceMethod, ca.start, err)
+		}
+		return err
+	case <-ca.Done:
+		return ca.Error
+	}
+}
+
+// writeBatch 每条的参数分别编码后打包
+func (c *Client) writeBatch(h *lcode.Header, entries []*Call) error {
+	msgs := make([]*lcode.Message, len(entries))
+	for i, ca := range entries {
+		msgs[i] = &lcode.Message{
+			H: &lcode.Header{ServiceMethod: ca.ServiceMethod, Seq: uint64(i)},
+			B: c.Encode(ca.Args),
+		}
+	}
+	payload, err := lcode.PackBatch(msgs)
+	if err != nil {
+		return err
+	}
+	return c.writeEncoded(h, payload)
+}
+
+// decodeBatch 在接收 goroutine 中调用, 把各条结果写回对应的 Call
+func (c *Client) decodeBatch(entries []*Call, body []byte) error {
+	msgs, err := lcode.UnpackBatch(body)
+	if err != nil {
+		return err
+	}
+	if len(msgs) != len(entries) {
+		return fmt.Errorf("rpc client: batch reply has %d entries, expect %d", len(msgs), len(entries))
+	}
+	for _, m := range msgs {
+		if m.H.Seq >= uint64(len(entries)) {
+			continue
+		}
+		ca := entries[m.H.Seq]
+		ca.Error = lcode.HeaderError(m.H)
+		if ca.Error == nil && ca.Reply != nil {
+			err = c.Decode(m.B, ca.Reply)
+			if err != nil {
+				ca.Error = fmt.Errorf("rpc client: batch entry %d reading body err:%v", m.H.Seq, err)
+			}
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
@@ -26,16 +27,24 @@ import (
 	"github.com/zulong210220/lrpc/lcode"
 	"github.com/zulong210220/lrpc/log"
 	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/tracing"
+	"github.com/zulong210220/lrpc/transport"
 )
 
 type Call struct {
 	Seq           uint64
 	ServiceMethod string
 	TraceId       string
+	Traceparent   string // 为空时服务端开始新的 trace
+	Meta          map[string]string
 	Args          lcode.IMessage
 	Reply         lcode.IMessage
 	Error         error
 	Done          chan *Call
+
+	start     time.Time
+	entries   []*Call // 批量调用的各条, Seq 为序号
+	abandoned bool    // 调用方已放弃, 由 c.mu 保护
 }
 
 func (c *Call) done() {
@@ -43,22 +52,59 @@ func (c *Call) done() {
 }
 
 type Client struct {
-	cc      net.Conn
-	opt     *rpc.Option
-	sending sync.Mutex
-	header  lcode.Header
-	mu      sync.Mutex
-	seq     uint64
-	pending map[uint64]*Call
-	closing int32 // 关闭 就表示不可用
+	cc       net.Conn
+	opt      *rpc.Option
+	sending  sync.Mutex
+	header   lcode.Header
+	mu       sync.Mutex
+	seq      uint64
+	pending  map[uint64]*Call
+	streams  map[uint64]*Stream // 与 pending 共用 seq
+	handlers *rpc.Server        // 回调服务, 处理服务端的反向调用
+	closing  int32              // 关闭 就表示不可用
+	m        *endpointMetrics
+
+	// 自动重连, 见 reconnect.go
+	policy   *rpc.ReconnectPolicy
+	redial   func() (net.Conn, *rpc.Option, error)
+	state    int32         // State
+	stateCh  chan struct{} // 状态变化时关闭并替换
+	queue    []*Call       // 重连期间排队的调用
+	done     chan struct{} // Close 或放弃重连时关闭
+	doneOnce sync.Once
+
+	// 合并相同的并发调用, 见 coalesce.go
+	cmu        sync.Mutex
+	coalescers map[string]*coalescer
 }
 
 var (
 	_ io.Closer = (*Client)(nil)
 
 	ErrShutdown = errors.New("connection is shutdown")
+
+	errAbandoned = errors.New("call abandoned")
 )
 
+// NotSentError 请求一定没有写入连接, 调用方可以安全地重试
+type NotSentError struct {
+	Err error
+}
+
+func (e *NotSentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NotSentError) Unwrap() error {
+	return e.Err
+}
+
+// IsNotSent ErrShutdown 也表示请求没有发出
+func IsNotSent(err error) bool {
+	var e *NotSentError
+	return err == ErrShutdown || errors.As(err, &e)
+}
+
 const (
 	StatusClosing = 1
 )
@@ -90,12 +136,15 @@ func (c *Client) Close() error {
 		return nil
 	}
 
-	if atomic.LoadInt32(&c.closing) == StatusClosing {
+	if !atomic.CompareAndSwapInt32(&c.closing, 0, StatusClosing) {
 		return ErrShutdown
 	}
 
-	atomic.StoreInt32(&c.closing, StatusClosing)
-	return c.cc.Close()
+	c.shutdown(ErrShutdown)
+	c.mu.Lock()
+	cc := c.cc
+	c.mu.Unlock()
+	return cc.Close()
 }
 
 func (c *Client) IsAvailable() bool {
@@ -103,20 +152,65 @@ func (c *Client) IsAvailable() bool {
 	return atomic.LoadInt32(&c.closing) != StatusClosing
 }
 
+// Pending 等待响应的调用和未结束的流的数量
+func (c *Client) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending) + len(c.streams)
+}
+
 func (c *Client) registerCall(ca *Call) (uint64, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if ca.abandoned {
+		return 0, errAbandoned
+	}
 	if !c.IsAvailable() {
 		return 0, ErrShutdown
 	}
+	if st := c.State(); st != StateReady {
+		return 0, &NotSentError{Err: lcode.Errorf(lcode.CodeUnavailable, "rpc client: connection %s", st)}
+	}
 
 	ca.Seq = c.seq
+	ca.start = time.Now()
 	c.pending[ca.Seq] = ca
 	c.seq++
+	c.m.inflight.Inc()
 	return ca.Seq, nil
 }
 
+// finish 已从pending移除的调用结束, 记录指标后通知调用方
+func (c *Client) finish(ca *Call) {
+	c.m.inflight.Dec()
+	c.m.observe(ca.ServiceMethod, ca.start, ca.Error)
+	ca.done()
+}
+
+// abandon 调用方放弃 ca, 还没有发出的不再发出
+// sent 为 false 表示没有发出; removed 为 true 表示已从 pending 移除, 为 false 时响应已经在处理
+func (c *Client) abandon(ca *Call) (sent, removed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ca.abandoned = true
+	for i, q := range c.queue {
+		if q == ca {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return false, false
+		}
+	}
+	if ca.Seq == 0 {
+		return false, false
+	}
+	if c.pending[ca.Seq] != ca {
+		return true, false
+	}
+	delete(c.pending, ca.Seq)
+	return true, true
+}
+
 func (c *Client) removeCall(seq uint64) *Call {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -134,18 +228,29 @@ func (c *Client) terminateCalls(err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	atomic.StoreInt32(&c.closing, StatusClosing)
+	c.m.conns.Dec()
+	if c.redial == nil || !c.IsAvailable() {
+		atomic.StoreInt32(&c.closing, StatusClosing)
+		c.setStateLocked(StateShutdown)
+	} else {
+		c.setStateLocked(StateTransientFailure)
+	}
 
-	for _, ca := range c.pending {
+	for seq, ca := range c.pending {
+		delete(c.pending, seq)
 		ca.Error = err
-		ca.done()
+		c.finish(ca)
+	}
+	for seq, st := range c.streams {
+		delete(c.streams, seq)
+		st.end(lcode.Errorf(lcode.CodeUnavailable, "rpc client: connection closed err:%v", err))
 	}
 }
 
 func (c *Client) Read(msg *lcode.Message) error {
 	fun := "Client.Read"
 	var data = make([]byte, 4)
-	n, err := c.cc.Read(data)
+	n, err := io.ReadFull(c.cc, data)
 	if err != nil {
 		log.Errorf("CR", "%s connection total n:%d failed err:%v", fun, n, err)
 		if err == io.EOF {
@@ -169,7 +274,7 @@ func (c *Client) Read(msg *lcode.Message) error {
 		defer limitedPool.Put(bb)
 	}
 
-	n, err = c.cc.Read(data)
+	n, err = io.ReadFull(c.cc, data)
 	if err != nil {
 		log.Errorf("JCR", "%s connection data n:%d failed err:%v", fun, n, err)
 		if err == io.EOF {
@@ -177,7 +282,11 @@ func (c *Client) Read(msg *lcode.Message) error {
 			return err
 		}
 	}
+	if err == nil {
+		c.m.bytesIn.Add(uint64(4 + total))
+	}
 
+	msg.Version = c.opt.Version
 	err = msg.Unpack(data)
 	return err
 }
@@ -211,69 +320,146 @@ func (c *Client) receive() {
 		}
 
 		h := msg.H
+		if h.Is(lcode.FlagPing | lcode.FlagPong) {
+			c.handleControl(h)
+			continue
+		}
+		if h.Is(lcode.FlagStream) {
+			c.handleStream(h, msg.B)
+			continue
+		}
+		if h.Is(lcode.FlagReverse) {
+			// 回调中可能再调用服务端, 不能阻塞接收
+			go c.serveReverse(h, append([]byte(nil), msg.B...))
+			continue
+		}
 		ca := c.removeCall(h.Seq)
 
 		switch {
 		case ca == nil:
-		case h.Error != "":
-			ca.Error = errors.New(h.Error)
-			ca.done()
+		case h.Error != "" || h.Code != lcode.CodeOK:
+			ca.Error = lcode.HeaderError(h)
+			c.finish(ca)
+		case h.Is(lcode.FlagBatch):
+			ca.Error = c.decodeBatch(ca.entries, msg.B)
+			c.finish(ca)
 		default:
 			//err = c.cc.ReadBody(ca.Reply)
 			err = c.Decode(msg.B, ca.Reply)
 			if err != nil {
 				ca.Error = fmt.Errorf("%s reading body err:%v", fun, err)
 			}
-			ca.done()
+			c.finish(ca)
 		}
 	}
 
 	c.terminateCalls(err)
+	if c.reconnect() {
+		go c.receive()
+	}
+}
+
+// handleControl 服务端保活探测, 回pong
+func (c *Client) handleControl(h *lcode.Header) {
+	fun := "Client.handleControl"
+	if !h.Is(lcode.FlagPing) {
+		return
+	}
+
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	err := c.Write(&lcode.Header{Seq: h.Seq, Flag: lcode.FlagPong}, nil)
+	if err != nil {
+		log.Errorf("", "%s write pong failed err:%v", fun, err)
+	}
 }
 
 func NewClient(conn net.Conn, opt *rpc.Option) (*Client, error) {
-	fun := "NewClient"
-	f := lcode.NewCodecFuncMap[opt.CodecType]
+	return newClient(connect, conn, opt)
+}
+
+// connectFunc 在已建立的连接上完成协议升级和握手, 协商的编解码写回opt
+// 重连时使用同一个函数
+type connectFunc func(conn net.Conn, opt *rpc.Option) (net.Conn, error)
+
+func newClient(cf connectFunc, conn net.Conn, opt *rpc.Option) (*Client, error) {
+	o := *opt
+	// 服务端不回复时握手不会一直阻塞
+	if o.ConnectTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(o.ConnectTimeout))
+	}
+	cc, err := cf(conn, &o)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return newClientCodec(cc, &o), nil
+}
 
-	if f == false {
+func connect(conn net.Conn, opt *rpc.Option) (net.Conn, error) {
+	fun := "NewClient"
+	// CodecType 为空时使用服务端监听的默认编解码
+	if opt.CodecType != "" && !lcode.NewCodecFuncMap[opt.CodecType] {
 		err := fmt.Errorf("%s invalid codec type %s", fun, opt.CodecType)
 		log.Errorf("", "%s rpc client codec err:%v", fun, err)
 		return nil, err
 	}
 
-	//err := json.NewEncoder(conn).Encode(opt)
-	var err error
-	dataBuf := bytes.NewBuffer([]byte{})
-	err = jsoniter.NewEncoder(dataBuf).Encode(opt)
+	err := handshake(conn, opt)
 	if err != nil {
-		log.Errorf("", "%s rpc client options failed err:%v", fun, err)
+		log.Errorf("", "%s rpc client handshake failed err:%v", fun, err)
+		_ = conn.Close()
 		return nil, err
 	}
-	pkg := dataBuf.Bytes()
+	return conn, nil
+}
 
-	dataBuf = bytes.NewBuffer([]byte{})
-	n := uint16(len(pkg))
-	err = binary.Write(dataBuf, binary.BigEndian, n)
-	if err != nil {
-		log.Errorf("", " binary.Write len Option failed err:%v", err)
-		return nil, err
+// handshake 发送 Option 和凭证, 等待服务端确认, 确认的编解码和握手版本写回opt
+// 不支持 HandshakeVersion 的旧服务端不会确认, 见 rpc/handshake.go
+func handshake(conn net.Conn, opt *rpc.Option) error {
+	negotiated := opt
+	o := *opt
+	o.Version = rpc.HandshakeVersion
+	var ar *rpc.AuthRequest
+	if opt.Credentials != nil {
+		token, err := opt.Credentials.Token()
+		if err != nil {
+			return err
+		}
+		ar = &rpc.AuthRequest{Token: token}
+		o.AuthScheme = opt.Credentials.Scheme()
 	}
 
-	_, err = conn.Write(dataBuf.Bytes())
+	err := rpc.WriteHandshake(conn, &o)
 	if err != nil {
-		log.Errorf("", "%s rpc client options failed write n:%d err:%v", fun, n, err)
-		_ = conn.Close()
-		return nil, err
+		return err
+	}
+
+	if ar != nil {
+		err = rpc.WriteHandshake(conn, ar)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = conn.Write(pkg)
+	reply := &rpc.HandshakeReply{}
+	err = rpc.ReadHandshake(conn, reply)
 	if err != nil {
-		log.Errorf("", "%s rpc client options failed write n:%d err:%v", fun, n, err)
-		_ = conn.Close()
-		return nil, err
+		return fmt.Errorf("read handshake reply failed, server may not support handshake version %d: %v", rpc.HandshakeVersion, err)
+	}
+	if reply.Err() != nil {
+		return reply.Err()
 	}
 
-	return newClientCodec(conn, opt), nil
+	if reply.CodecType == "" {
+		reply.CodecType = rpc.DefaultOption.CodecType
+	}
+	if !lcode.NewCodecFuncMap[reply.CodecType] {
+		return fmt.Errorf("handshake invalid codec type %s", reply.CodecType)
+	}
+	negotiated.CodecType = reply.CodecType
+	negotiated.Version = o.Version
+	return nil
 }
 
 func newClientCodec(cc net.Conn, opt *rpc.Option) *Client {
@@ -282,7 +468,13 @@ func newClientCodec(cc net.Conn, opt *rpc.Option) *Client {
 		cc:      cc,
 		opt:     opt,
 		pending: make(map[uint64]*Call),
+		streams: make(map[uint64]*Stream),
+		m:       newEndpointMetrics(remoteEndpoint(cc)),
+		state:   int32(StateReady),
+		stateCh: make(chan struct{}),
+		done:    make(chan struct{}),
 	}
+	c.m.conns.Inc()
 
 	go c.receive()
 	return c
@@ -301,15 +493,44 @@ func parseOptions(opts ...*rpc.Option) (*rpc.Option, error) {
 	opt := opts[0]
 	opt.MagicNumber = rpc.DefaultOption.MagicNumber
 
-	if opt.CodecType == "" {
-		opt.CodecType = rpc.DefaultOption.CodecType
-	}
-
 	return opt, nil
 }
 
 func Dial(network, addr string, opts ...*rpc.Option) (c *Client, err error) {
-	return dialTimeout(NewClient, network, addr, opts...)
+	return dial(NewClient, connect, network, addr, opts...)
+}
+
+// dial opt.Reconnect 不为空时, 连接断开后用 cf 重新建立
+func dial(f newClientFunc, cf connectFunc, network, addr string, opts ...*rpc.Option) (*Client, error) {
+	c, err := dialTimeout(f, network, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	opt, _ := parseOptions(opts...)
+	if opt.Reconnect != nil {
+		c.enableReconnect(opt.Reconnect, func() (net.Conn, *rpc.Option, error) {
+			return dialConn(cf, network, addr, opt)
+		})
+	}
+	return c, nil
+}
+
+// dialConn 同 dialTimeout, 只建立连接不创建客户端
+func dialConn(cf connectFunc, network, addr string, opt *rpc.Option) (net.Conn, *rpc.Option, error) {
+	var (
+		cc net.Conn
+		o  = *opt
+	)
+	_, err := dialTimeout(func(conn net.Conn, _ *rpc.Option) (*Client, error) {
+		var err error
+		cc, err = cf(conn, &o)
+		return nil, err
+	}, network, addr, opt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cc, &o, nil
 }
 
 func (c *Client) Encode(body interface{}) []byte {
@@ -325,11 +546,12 @@ func (c *Client) Encode(body interface{}) []byte {
 	case lcode.GobType:
 		buffer = GetBuffer()
 		err = gob.NewEncoder(buffer).Encode(body)
-		bs = buffer.Bytes()
+		// buffer 归还后会被其它连接复用, 需要复制
+		bs = append([]byte(nil), buffer.Bytes()...)
 	case lcode.JsonType:
 		buffer = GetBuffer()
 		err = jsoniter.NewEncoder(buffer).Encode(body)
-		bs = buffer.Bytes()
+		bs = append([]byte(nil), buffer.Bytes()...)
 	case lcode.ProtoType:
 		bs, err = proto.Marshal(body.(lcode.IMessage))
 	case lcode.GoProtoType:
@@ -346,7 +568,17 @@ func (c *Client) Encode(body interface{}) []byte {
 	return bs
 }
 
-func (c *Client) Write(h *lcode.Header, body interface{}) (err error) {
+func (c *Client) Write(h *lcode.Header, body interface{}) error {
+	// 控制帧没有body
+	var bs []byte
+	if body != nil {
+		bs = c.Encode(body)
+	}
+	return c.writeEncoded(h, bs)
+}
+
+// writeEncoded bs 为已编码的 body
+func (c *Client) writeEncoded(h *lcode.Header, bs []byte) (err error) {
 	fun := "Conn.Write"
 	defer func() {
 		if err != nil {
@@ -354,12 +586,11 @@ func (c *Client) Write(h *lcode.Header, body interface{}) (err error) {
 		}
 	}()
 
-	bs := c.Encode(body)
-
 	var n int
 	msg := &lcode.Message{}
 	msg.H = h
 	msg.B = bs
+	msg.Version = c.opt.Version
 
 	bs, err = msg.Pack()
 	if err != nil {
@@ -373,8 +604,9 @@ func (c *Client) Write(h *lcode.Header, body interface{}) (err error) {
 		return
 	}
 
+	// 写入连接后再归还
+	defer PutBuffer(dataBuf)
 	tbs := dataBuf.Bytes()
-	PutBuffer(dataBuf)
 
 	n, err = c.cc.Write(tbs)
 	if err != nil {
@@ -385,7 +617,9 @@ func (c *Client) Write(h *lcode.Header, body interface{}) (err error) {
 	n, err = c.cc.Write(bs)
 	if err != nil {
 		log.Errorf("CW", "%s rpc codec: json error write : %d buffer :%v", fun, n, err)
+		return
 	}
+	c.m.bytesOut.Add(uint64(len(tbs) + len(bs)))
 
 	return
 }
@@ -398,11 +632,17 @@ func (c *Client) send(ca *Call) {
 		return
 	}
 	fun := "Client.send"
+	if c.enqueue(ca) {
+		return
+	}
 	// 并发发送需要加锁
 	c.sending.Lock()
 	defer c.sending.Unlock()
 
 	seq, err := c.registerCall(ca)
+	if err == errAbandoned {
+		return
+	}
 	if err != nil {
 		log.Errorf("", "%s client registerCall failed err:%v", fun, err)
 		ca.Error = err
@@ -414,14 +654,22 @@ func (c *Client) send(ca *Call) {
 	c.header.Seq = seq
 	c.header.Error = ""
 	c.header.TraceId = ca.TraceId
+	c.header.Traceparent = ca.Traceparent
+	c.header.Meta = ca.Meta
+	c.header.Flag = 0
 
-	err = c.Write(&c.header, ca.Args)
+	if ca.entries != nil {
+		c.header.Flag = lcode.FlagBatch
+		err = c.writeBatch(&c.header, ca.entries)
+	} else {
+		err = c.Write(&c.header, ca.Args)
+	}
 	//fmt.Println("aaa", c.header, ca.Args, err)
 	if err != nil {
 		ca := c.removeCall(seq)
 		if ca != nil {
 			ca.Error = err
-			ca.done()
+			c.finish(ca)
 		}
 	}
 }
@@ -446,20 +694,86 @@ func (c *Client) Do(traceId, sm string, args, reply lcode.IMessage, done chan *C
 }
 
 func (c *Client) Call(ctx *context.Context, sm string, args, reply lcode.IMessage) error {
+	if c == nil {
+		return ErrShutdown
+	}
+	if g := c.coalescer(sm); g != nil {
+		return c.callCoalesced(g, ctx, sm, args, reply)
+	}
+	return c.call(ctx, sm, args, reply)
+}
+
+func (c *Client) call(ctx *context.Context, sm string, args, reply lcode.IMessage) (err error) {
+	span := tracing.StartClientSpan(ctx, sm)
+	span.SetAttr("peer", c.m.endpoint)
+	defer func() {
+		if err != nil {
+			span.SetStatus(lcode.ErrorCode(err).String(), lcode.ErrorDesc(err))
+		}
+		span.End()
+	}()
+
 	// send to server
-	ca := c.Do(context.GetTraceId(ctx), sm, args, reply, make(chan *Call, 1))
+	ca := &Call{
+		ServiceMethod: sm,
+		TraceId:       context.GetTraceId(ctx),
+		Traceparent:   span.Context().Traceparent(),
+		Meta:          context.Metadata(ctx),
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+	}
+	span.SetAttr("lrpc.trace_id", ca.TraceId)
+	c.send(ca)
 
 	// wait receive done
 	// 可能存在server不响应的情况
 	select {
 	case <-ctx.Done():
-		c.removeCall(ca.Seq)
-		return fmt.Errorf("rpc client : call failed err:%s", ctx.Err().Error())
+		err = fmt.Errorf("rpc client : call failed err:%s", ctx.Err().Error())
+		if _, removed := c.abandon(ca); removed {
+			c.m.inflight.Dec()
+			c.m.observe(sm, ca.start, err)
+		}
+		return err
 	case cd := <-ca.Done:
 		return cd.Error
 	}
 }
 
+// Notify 单向调用, 不占用 pending, 服务端处理后不响应
+// 返回的错误只表示写入连接是否成功, 服务端的处理结果不可知
+func (c *Client) Notify(ctx *context.Context, sm string, args lcode.IMessage) (err error) {
+	if c == nil || !c.IsAvailable() {
+		return ErrShutdown
+	}
+
+	span := tracing.StartClientSpan(ctx, sm)
+	span.SetAttr("peer", c.m.endpoint)
+	span.SetAttr("oneway", "true")
+	defer func() {
+		c.m.observeOneway(sm, err)
+		if err != nil {
+			span.SetStatus(lcode.ErrorCode(err).String(), lcode.ErrorDesc(err))
+		}
+		span.End()
+	}()
+
+	if ctx.Err() != nil {
+		return lcode.Errorf(lcode.CodeCanceled, "rpc client: notify canceled err:%v", ctx.Err())
+	}
+
+	h := &lcode.Header{
+		ServiceMethod: sm,
+		TraceId:       context.GetTraceId(ctx),
+		Traceparent:   span.Context().Traceparent(),
+		Meta:          context.Metadata(ctx),
+		Flag:          lcode.FlagOneway,
+	}
+	span.SetAttr("lrpc.trace_id", h.TraceId)
+	return c.writeFrame(h, args)
+}
+
 type clientResult struct {
 	client *Client
 	err    error
@@ -475,7 +789,7 @@ func dialTimeout(f newClientFunc, network, addr string, opts ...*rpc.Option) (c
 		return nil, err
 	}
 
-	conn, err := net.DialTimeout(network, addr, opt.ConnectTimeout)
+	conn, err := transport.Dial(network, addr, opt.ConnectTimeout)
 	if err != nil {
 		log.Errorf("", "%s DialTimeout failed network:%s addr:%s err:%v", fun, network, addr, err)
 		return nil, err
@@ -511,13 +825,17 @@ func dialTimeout(f newClientFunc, network, addr string, opts ...*rpc.Option) (c
 
 // ----
 func NewHTTPClient(conn net.Conn, opt *rpc.Option) (*Client, error) {
+	return newClient(connectHTTP, conn, opt)
+}
+
+func connectHTTP(conn net.Conn, opt *rpc.Option) (net.Conn, error) {
 	_, _ = io.WriteString(conn, fmt.Sprintf("%s %s HTTP/1.0\n\n", consts.MethodConnect, consts.DefaultRpcPath))
 	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{
 		Method: "CONNECT",
 	})
 
 	if err == nil && resp.Status == consts.Connected {
-		return NewClient(conn, opt)
+		return connect(conn, opt)
 	}
 
 	if err == nil {
@@ -527,9 +845,91 @@ func NewHTTPClient(conn net.Conn, opt *rpc.Option) (*Client, error) {
 }
 
 func DialHTTP(network, addr string, opts ...*rpc.Option) (*Client, error) {
-	return dialTimeout(NewHTTPClient, network, addr, opts...)
+	return dial(NewHTTPClient, connectHTTP, network, addr, opts...)
+}
+
+func NewTLSClient(conn net.Conn, opt *rpc.Option) (*Client, error) {
+	return newClient(connectTLS, conn, opt)
+}
+
+func connectTLS(conn net.Conn, opt *rpc.Option) (net.Conn, error) {
+	tc := tls.Client(conn, opt.TLSConfig)
+	err := tc.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	return connect(tc, opt)
+}
+
+// DialTLS opt.TLSConfig 未设置 ServerName 时使用addr中的host
+func DialTLS(network, addr string, opts ...*rpc.Option) (*Client, error) {
+	o, err := tlsOption(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return dial(NewTLSClient, connectTLS, network, addr, o)
+}
+
+func tlsOption(addr string, opts ...*rpc.Option) (*rpc.Option, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{}
+	if opt.TLSConfig != nil {
+		cfg = opt.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		cfg.ServerName = host
+	}
+
+	o := *opt
+	o.TLSConfig = cfg
+	return &o, nil
+}
+
+// NewWSClient 完成 websocket 握手后与 tcp 连接相同, 服务端需要挂载 rpc.Server.WebSocket
+func NewWSClient(conn net.Conn, opt *rpc.Option) (*Client, error) {
+	return newClient(connectWS, conn, opt)
+}
+
+func connectWS(conn net.Conn, opt *rpc.Option) (net.Conn, error) {
+	wc, err := transport.NewWSClientConn(conn, conn.RemoteAddr().String(), consts.DefaultWebSocketPath, rpc.WSProtocolBinary)
+	if err != nil {
+		return nil, err
+	}
+	return connect(wc, opt)
+}
+
+func DialWS(network, addr string, opts ...*rpc.Option) (*Client, error) {
+	return dial(NewWSClient, connectWS, network, addr, opts...)
+}
+
+func NewWSSClient(conn net.Conn, opt *rpc.Option) (*Client, error) {
+	return newClient(connectWSS, conn, opt)
+}
+
+func connectWSS(conn net.Conn, opt *rpc.Option) (net.Conn, error) {
+	tc := tls.Client(conn, opt.TLSConfig)
+	err := tc.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	return connectWS(tc, opt)
+}
+
+// DialWSS 同 DialTLS, 在 tls 上建立 websocket
+func DialWSS(network, addr string, opts ...*rpc.Option) (*Client, error) {
+	o, err := tlsOption(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return dial(NewWSSClient, connectWSS, network, addr, o)
 }
 
+// XDial rpcAddr 格式为 protocol@addr, http/tls/ws/wss 以外的协议 (tcp, unix, mem ...) 都由 Dial 处理
 func XDial(rpcAddr string, opts ...*rpc.Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -538,12 +938,24 @@ func XDial(rpcAddr string, opts ...*rpc.Option) (*Client, error) {
 
 	protocol, addr := parts[0], parts[1]
 
+	var (
+		c   *Client
+		err error
+	)
 	switch protocol {
 	case consts.ProtocolHTTP:
-		return DialHTTP("tcp", addr, opts...)
+		c, err = DialHTTP("tcp", addr, opts...)
+	case consts.ProtocolTLS:
+		c, err = DialTLS("tcp", addr, opts...)
+	case consts.ProtocolWS:
+		c, err = DialWS("tcp", addr, opts...)
+	case consts.ProtocolWSS:
+		c, err = DialWSS("tcp", addr, opts...)
 	default:
-		return Dial(protocol, addr, opts...)
+		c, err = Dial(protocol, addr, opts...)
 	}
-
-	return nil, errors.New("invalid protocol")
+	if err != nil {
+		mDialErrs.With(rpcAddr).Inc()
+	}
+	return c, err
 }
@@ -8,14 +8,24 @@ package client
  * */
 
 import (
+	gctx "context"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
 	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
 )
 
 func TestTimeout(t *testing.T) {
@@ -50,7 +60,34 @@ func TestTimeout(t *testing.T) {
 	})
 }
 
+func TestHandshakeLegacyServer(t *testing.T) {
+	lcode.Init()
+
+	ln, _ := transport.ListenMem("legacy-server")
+	defer ln.Close()
+	// 旧服务端读完 Option 后直接等待请求, 不回复 HandshakeReply
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = rpc.ReadHandshake(conn, &rpc.Option{})
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+
+	start := time.Now()
+	_, err := XDial("mem@legacy-server", &rpc.Option{CodecType: lcode.JsonType, ConnectTimeout: 200 * time.Millisecond})
+	if err == nil {
+		t.Fatal("expect dial to legacy server failed")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expect failure after connect timeout, took %s", d)
+	}
+}
+
 func TestXDial(t *testing.T) {
+	lcode.Init()
 	if runtime.GOOS == "linux" {
 		ch := make(chan struct{})
 		addr := "/tmp/lrpc.sock"
@@ -71,4 +108,480 @@ func TestXDial(t *testing.T) {
 	}
 }
 
+func TestMemTransport(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	ln, err := s.Listen("mem@foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.Accept(ln)
+
+	c, err := XDial("mem@foo")
+	if err != nil {
+		t.Fatal("failed to dial mem transport", err)
+	}
+	defer func() { _ = c.Close() }()
+
+	ctx := context.NewContext(gctx.Background())
+	context.SetTraceId(ctx, "mem")
+	var reply models.Reply
+	err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 3, Num2: 4}, &reply)
+	if err != nil || reply.Num != 7 {
+		t.Fatalf("expect 7, got %d err:%v", reply.Num, err)
+	}
+}
+
+func waitFor(d time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+type Counter struct {
+	n    int64
+	seen chan int
+}
+
+func (c *Counter) Add(args models.Args, reply *models.Reply) error {
+	reply.Num = int(atomic.AddInt64(&c.n, int64(args.Num1)))
+	c.seen <- args.Num1
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	counter := &Counter{seen: make(chan int, 8)}
+	_ = s.Register(counter)
+	ln, _ := transport.ListenMem("notify")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	c, err := XDial("mem@notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.NewContext(gctx.Background())
+
+	for i := 1; i <= 3; i++ {
+		err = c.Notify(ctx, "Counter.Add", &models.Args{Num1: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-counter.seen:
+		case <-time.After(time.Second):
+			t.Fatal("expect notification handled")
+		}
+	}
+	var r models.Reply
+	err = c.Call(ctx, "Counter.Add", &models.Args{Num1: 4}, &r)
+	if err != nil || r.Num != 10 {
+		t.Fatalf("expect 10, got %d err:%v", r.Num, err)
+	}
+	<-counter.seen
+
+	// 单向调用单独计数, 不占用 pending
+	var m rpc.MethodInfo
+	for _, svc := range s.DebugInfo().Services {
+		if svc.Name == "Counter" {
+			m = svc.Methods[0]
+		}
+	}
+	if m.Calls != 4 || m.Oneway != 3 {
+		t.Fatalf("expect 4 calls 3 oneway, got %d %d", m.Calls, m.Oneway)
+	}
+	c.mu.Lock()
+	pending := len(c.pending)
+	c.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("expect no pending calls, got %d", pending)
+	}
+
+	// 写入失败时返回错误
+	_ = c.Close()
+	if err = c.Notify(ctx, "Counter.Add", &models.Args{Num1: 1}); err == nil {
+		t.Fatal("expect notify on closed client failed")
+	}
+}
+
+type Sleeper struct{}
+
+// Sleep 等待 Num1 毫秒
+func (s *Sleeper) Sleep(args models.Args, reply *models.Reply) error {
+	time.Sleep(time.Duration(args.Num1) * time.Millisecond)
+	reply.Num = args.Num1
+	return nil
+}
+
+func TestPool(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	_ = s.Register(&Sleeper{})
+	ln, _ := transport.ListenMem("pool")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	p, err := NewPool("mem@pool", nil, &PoolConfig{
+		MinConns:      1,
+		MaxConns:      3,
+		IdleTimeout:   300 * time.Millisecond,
+		CheckInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = p.Close() }()
+	ctx := context.NewContext(gctx.Background())
+	if n := p.Len(); n != 1 {
+		t.Fatalf("expect 1 conn, got %d", n)
+	}
+
+	// 连接都在忙时扩容, 不超过 MaxConns
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var r models.Reply
+			if err := p.Call(ctx, "Sleeper.Sleep", &models.Args{Num1: 100}, &r); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			_ = p.Call(ctx, "Sleeper.Sleep", &models.Args{Num1: 100}, &r)
+		}()
+	}
+	wg.Wait()
+	if n := p.Len(); n < 2 || n > 3 {
+		t.Fatalf("expect pool grown to 2..3 conns, got %d", n)
+	}
+
+	// 空闲连接回收到 MinConns
+	if !waitFor(time.Second, func() bool { return p.Len() == 1 }) {
+		t.Fatalf("expect idle conns evicted, got %d", p.Len())
+	}
+
+	// 断开的连接在后台补上
+	old, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = old.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := p.Len(); n != 1 {
+		t.Fatalf("expect broken conn replaced, got %d", n)
+	}
+	c, err := p.Get()
+	if err != nil || c == old || !c.IsAvailable() {
+		t.Fatalf("expect new available conn, err:%v", err)
+	}
+	var r models.Reply
+	if err = p.Call(ctx, "Sleeper.Sleep", &models.Args{Num1: 1}, &r); err != nil || r.Num != 1 {
+		t.Fatalf("expect 1, got %d err:%v", r.Num, err)
+	}
+
+	// 服务端不可用时连续失败几次后不再补足
+	_ = s.Shutdown()
+	fails := func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.fails
+	}
+	if !waitFor(time.Second, func() bool { return fails() >= poolMaxDialFailures }) {
+		t.Fatalf("expect %d dial failures, got %d", poolMaxDialFailures, fails())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := fails(); n != poolMaxDialFailures {
+		t.Fatalf("expect refill stopped after %d failures, got %d", poolMaxDialFailures, n)
+	}
+
+	_ = p.Close()
+	if err = p.Call(ctx, "Sleeper.Sleep", &models.Args{Num1: 1}, &r); err != ErrShutdown {
+		t.Fatalf("expect shutdown, got %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	_ = s.Register(&Sleeper{})
+	ln, _ := transport.ListenMem("reconnect")
+	go s.Accept(ln)
+
+	policy := &rpc.ReconnectPolicy{BaseDelay: 20 * time.Millisecond, MaxDelay: 50 * time.Millisecond, QueueSize: 4}
+	c, err := XDial("mem@reconnect", &rpc.Option{Reconnect: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	ctx := context.NewContext(gctx.Background())
+	if st := c.State(); st != StateReady {
+		t.Fatalf("expect ready, got %s", st)
+	}
+
+	// 服务端断开后自动重连
+	for _, conn := range s.Conns() {
+		conn.Close()
+	}
+	tctx, cancel := gctx.WithTimeout(gctx.Background(), 2*time.Second)
+	defer cancel()
+	wctx := context.NewContext(tctx)
+	if !c.WaitForStateChange(wctx, StateReady) {
+		t.Fatal("expect state change after disconnect")
+	}
+	var r models.Reply
+	if err = c.Call(ctx, "Sleeper.Sleep", &models.Args{Num1: 1}, &r); err != nil || r.Num != 1 {
+		t.Fatalf("expect call after reconnect ok, got %d err:%v", r.Num, err)
+	}
+	if st := c.State(); st != StateReady || !c.IsAvailable() {
+		t.Fatalf("expect ready, got %s", st)
+	}
+
+	// 服务端不可用时排队, 恢复后发送
+	s.Shutdown()
+	for c.State() == StateReady {
+		time.Sleep(5 * time.Millisecond)
+	}
+	done := make(chan error, 1)
+	go func() {
+		var r models.Reply
+		done <- c.Call(ctx, "Sleeper.Sleep", &models.Args{Num1: 2}, &r)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if st := c.State(); st == StateReady || st == StateShutdown {
+		t.Fatalf("expect reconnecting, got %s", st)
+	}
+	// 排队时超时的调用不再发送
+	actx, acancel := gctx.WithTimeout(gctx.Background(), 30*time.Millisecond)
+	defer acancel()
+	abandoned := &models.Reply{}
+	if err = c.Call(context.NewContext(actx), "Sleeper.Sleep", &models.Args{Num1: 3}, abandoned); err == nil {
+		t.Fatal("expect queued call timeout")
+	}
+
+	s = rpc.NewServer()
+	_ = s.Register(&Sleeper{})
+	ln, _ = transport.ListenMem("reconnect")
+	go s.Accept(ln)
+	defer s.Shutdown()
+	if err = <-done; err != nil {
+		t.Fatalf("expect queued call ok, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if abandoned.Num != 0 {
+		t.Fatalf("expect abandoned call not sent, got %d", abandoned.Num)
+	}
+
+	// 不排队时直接失败, 超过次数后关闭
+	fast, err := XDial("mem@reconnect", &rpc.Option{Reconnect: &rpc.ReconnectPolicy{
+		BaseDelay:   10 * time.Millisecond,
+		MaxAttempts: 2,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 确认服务端已登记该连接
+	if err = fast.Call(ctx, "Sleeper.Sleep", &models.Args{Num1: 1}, &r); err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown()
+	for fast.State() == StateReady {
+		time.Sleep(5 * time.Millisecond)
+	}
+	err = fast.Call(ctx, "Sleeper.Sleep", &models.Args{Num1: 1}, &r)
+	if err == nil || !IsNotSent(err) {
+		t.Fatalf("expect not sent while reconnecting, got %v", err)
+	}
+	for fast.State() != StateShutdown {
+		if !fast.WaitForStateChange(wctx, fast.State()) {
+			t.Fatalf("expect shutdown, got %s", fast.State())
+		}
+	}
+	if fast.IsAvailable() {
+		t.Fatal("expect unavailable after giving up")
+	}
+
+	_ = c.Close()
+	if st := c.State(); st != StateShutdown {
+		t.Fatalf("expect shutdown after close, got %s", st)
+	}
+	if err = c.Call(ctx, "Sleeper.Sleep", &models.Args{Num1: 1}, &r); err != ErrShutdown {
+		t.Fatalf("expect shutdown, got %v", err)
+	}
+}
+
+func TestFuture(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	_ = s.Register(&Sleeper{})
+	ln, _ := transport.ListenMem("future")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	c, err := XDial("mem@future")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	ctx := context.NewContext(gctx.Background())
+
+	// 并发发出, 全部等待
+	var (
+		fs      []*Future
+		replies []*models.Reply
+		thens   int32
+	)
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		r := &models.Reply{}
+		replies = append(replies, r)
+		fs = append(fs, c.Go(ctx, "Sleeper.Sleep", &models.Args{Num1: 50 * i}, r).Then(func(reply lcode.IMessage, err error) {
+			if err == nil && reply.(*models.Reply).Num > 0 {
+				atomic.AddInt32(&thens, 1)
+			}
+		}))
+	}
+	if err = WaitAll(ctx, fs...); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Fatalf("expect calls in parallel, took %s", d)
+	}
+	for i, r := range replies {
+		if r.Num != 50*(i+1) {
+			t.Fatalf("reply %d expect %d, got %d", i, 50*(i+1), r.Num)
+		}
+	}
+	if n := atomic.LoadInt32(&thens); n != 3 {
+		t.Fatalf("expect 3 callbacks, got %d", n)
+	}
+
+	// 已结束时 Then 立即执行
+	called := false
+	fs[0].Then(func(lcode.IMessage, error) { called = true })
+	if !called {
+		t.Fatal("expect callback on finished future")
+	}
+
+	// 最先结束的
+	slow := c.Go(ctx, "Sleeper.Sleep", &models.Args{Num1: 300}, &models.Reply{})
+	fast := c.Go(ctx, "Sleeper.Sleep", &models.Args{Num1: 10}, &models.Reply{})
+	i, err := WaitAny(ctx, slow, fast)
+	if i != 1 || err != nil {
+		t.Fatalf("expect fast first, got %d err:%v", i, err)
+	}
+
+	// 等待超时不影响调用
+	tctx, cancel := gctx.WithTimeout(gctx.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = slow.Wait(context.NewContext(tctx))
+	if lcode.ErrorCode(err) != lcode.CodeDeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	if err = slow.Wait(ctx); err != nil || slow.Reply().(*models.Reply).Num != 300 {
+		t.Fatalf("expect slow call done, err:%v", err)
+	}
+
+	// Cancel 中止调用
+	f := c.Go(ctx, "Sleeper.Sleep", &models.Args{Num1: 1000}, &models.Reply{})
+	f.Cancel()
+	if err = f.Wait(ctx); err == nil {
+		t.Fatal("expect canceled call failed")
+	}
+}
+
+type Cache struct {
+	n int64
+}
+
+// Get 等待 100 毫秒, 返回 Num1 + Num2
+func (c *Cache) Get(args models.Args, reply *models.Reply) error {
+	atomic.AddInt64(&c.n, 1)
+	time.Sleep(100 * time.Millisecond)
+	reply.Num = args.Num1 + args.Num2
+	return nil
+}
+
+func TestCoalesce(t *testing.T) {
+	lcode.Init()
+
+	cache := &Cache{}
+	s := rpc.NewServer()
+	_ = s.Register(cache)
+	ln, _ := transport.ListenMem("coalesce")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	c, err := XDial("mem@coalesce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	ctx := context.NewContext(gctx.Background())
+
+	goAll := func(args ...*models.Args) []*Future {
+		var fs []*Future
+		for _, a := range args {
+			fs = append(fs, c.Go(ctx, "Cache.Get", a, &models.Reply{}))
+		}
+		if err := WaitAll(ctx, fs...); err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+	expect := func(n int64) {
+		if got := atomic.SwapInt64(&cache.n, 0); got != n {
+			t.Fatalf("expect %d server calls, got %d", n, got)
+		}
+	}
+
+	// 相同参数只发送一次, 每个调用得到独立的响应
+	c.Coalesce("Cache.Get", nil)
+	fs := goAll(&models.Args{Num1: 3, Num2: 4}, &models.Args{Num1: 3, Num2: 4}, &models.Args{Num1: 3, Num2: 4})
+	expect(1)
+	for _, f := range fs {
+		if f.Reply().(*models.Reply).Num != 7 {
+			t.Fatalf("expect 7, got %d", f.Reply().(*models.Reply).Num)
+		}
+	}
+	if fs[0].Reply() == fs[1].Reply() {
+		t.Fatal("expect separate replies")
+	}
+
+	// 参数不同时不合并
+	goAll(&models.Args{Num1: 1}, &models.Args{Num1: 2})
+	expect(2)
+
+	// 自定义 key
+	c.Coalesce("Cache.Get", func(args lcode.IMessage) string {
+		return strconv.Itoa(args.(*models.Args).Num1)
+	})
+	fs = goAll(&models.Args{Num1: 1, Num2: 1}, &models.Args{Num1: 1, Num2: 2})
+	expect(1)
+	if fs[0].Reply().(*models.Reply).Num != fs[1].Reply().(*models.Reply).Num {
+		t.Fatal("expect same reply for same key")
+	}
+
+	// 关闭后各自发送
+	c.StopCoalesce("Cache.Get")
+	goAll(&models.Args{Num1: 3, Num2: 4}, &models.Args{Num1: 3, Num2: 4})
+	expect(2)
+}
+
 /* vim: set tabstop=4 set shiftwidth=4 */
@@ -0,0 +1,113 @@
+package client
+
+/*
+ * 合并相同的并发调用, 按方法开启
+ *   同一方法 key 相同的调用在第一个调用结束前到达时, 不再发送请求, 等待第一个调用的结果
+ *   key 默认为编码后的参数; 每个调用得到响应的独立副本(按连接的编解码复制)
+ *   第一个调用因自身 ctx 结束而失败时, 其余调用各自重新发送
+ * */
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+)
+
+// CoalesceKeyFunc 返回空字符串时不合并
+type CoalesceKeyFunc func(args lcode.IMessage) string
+
+type flight struct {
+	done     chan struct{}
+	dups     int
+	body     []byte // 编码后的响应, 没有合并的调用时为空
+	err      error
+	canceled bool // 第一个调用的 ctx 已结束
+}
+
+type coalescer struct {
+	key     CoalesceKeyFunc
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// Coalesce 开启 sm 的合并, key 为 nil 时使用编码后的参数
+func (c *Client) Coalesce(sm string, key CoalesceKeyFunc) {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	if c.coalescers == nil {
+		c.coalescers = make(map[string]*coalescer)
+	}
+	c.coalescers[sm] = &coalescer{key: key, flights: make(map[string]*flight)}
+}
+
+// StopCoalesce 关闭 sm 的合并, 进行中的调用不受影响
+func (c *Client) StopCoalesce(sm string) {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	delete(c.coalescers, sm)
+}
+
+func (c *Client) coalescer(sm string) *coalescer {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	return c.coalescers[sm]
+}
+
+func (c *Client) callCoalesced(g *coalescer, ctx *context.Context, sm string, args, reply lcode.IMessage) error {
+	var key string
+	if g.key != nil {
+		key = g.key(args)
+	} else {
+		key = string(c.Encode(args))
+	}
+	if key == "" {
+		return c.call(ctx, sm, args, reply)
+	}
+
+	g.mu.Lock()
+	if fl := g.flights[key]; fl != nil {
+		fl.dups++
+		g.mu.Unlock()
+		mCoalesced.With(c.m.endpoint, sm).Inc()
+
+		select {
+		case <-fl.done:
+		case <-ctx.Done():
+			return fmt.Errorf("rpc client : call failed err:%s", ctx.Err().Error())
+		}
+		if fl.canceled && ctx.Err() == nil {
+			return c.callCoalesced(g, ctx, sm, args, reply)
+		}
+		if fl.err != nil {
+			return fl.err
+		}
+		if reply == nil {
+			return nil
+		}
+		err := c.Decode(fl.body, reply)
+		if err != nil {
+			return lcode.Errorf(lcode.CodeInvalidRequest, "rpc client: copy coalesced reply failed err:%v", err)
+		}
+		return nil
+	}
+	fl := &flight{done: make(chan struct{})}
+	g.flights[key] = fl
+	g.mu.Unlock()
+
+	err := c.call(ctx, sm, args, reply)
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	dups := fl.dups
+	g.mu.Unlock()
+
+	fl.err = err
+	fl.canceled = ctx.Err() != nil
+	if dups > 0 && err == nil && reply != nil {
+		fl.body = c.Encode(reply)
+	}
+	close(fl.done)
+	return err
+}
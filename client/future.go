@@ -0,0 +1,156 @@
+package client
+
+/*
+ * 异步调用
+ *   f := c.Go(ctx, "Foo.Sum", args, reply)
+ *   f.Then(func(reply lcode.IMessage, err error) { ... })
+ *   err := client.WaitAll(ctx, f1, f2)
+ * 调用使用 Go 时传入的 ctx, ctx 结束或 Cancel 时调用中止; Wait 的 ctx 只限制等待
+ * */
+
+import (
+	gctx "context"
+	"reflect"
+	"sync"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+)
+
+// Future 异步调用的结果, 可以在多个 goroutine 中等待
+type Future struct {
+	reply  lcode.IMessage
+	done   chan struct{}
+	cancel gctx.CancelFunc
+
+	mu        sync.Mutex
+	err       error
+	finished  bool
+	callbacks []func(reply lcode.IMessage, err error)
+}
+
+// NewFuture 在新的 goroutine 中执行 fn, fn 使用传入的 ctx 并把结果写入 reply
+func NewFuture(ctx *context.Context, reply lcode.IMessage, fn func(ctx *context.Context) error) *Future {
+	// 先确定 trace id, 异步调用与调用方使用同一个
+	_ = context.GetTraceId(ctx)
+	cctx, cancel := gctx.WithCancel(ctx)
+	f := &Future{
+		reply:  reply,
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	go func() {
+		err := fn(context.NewContext(cctx))
+		cancel()
+		f.complete(err)
+	}()
+	return f
+}
+
+// Go 异步的 Call
+func (c *Client) Go(ctx *context.Context, sm string, args, reply lcode.IMessage) *Future {
+	return NewFuture(ctx, reply, func(ctx *context.Context) error {
+		return c.Call(ctx, sm, args, reply)
+	})
+}
+
+func (f *Future) complete(err error) {
+	f.mu.Lock()
+	f.err = err
+	f.finished = true
+	cbs := f.callbacks
+	f.callbacks = nil
+	f.mu.Unlock()
+
+	close(f.done)
+	for _, cb := range cbs {
+		cb(f.reply, err)
+	}
+}
+
+// Done 调用结束后关闭
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err 调用结束前返回 nil
+func (f *Future) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *Future) Reply() lcode.IMessage {
+	return f.reply
+}
+
+// Cancel 中止调用, 已结束时无影响
+func (f *Future) Cancel() {
+	f.cancel()
+}
+
+// Wait ctx 结束时返回 Canceled 或 DeadlineExceeded, 调用不受影响
+func (f *Future) Wait(ctx *context.Context) error {
+	select {
+	case <-f.done:
+		return f.Err()
+	case <-ctx.Done():
+		return waitError(ctx)
+	}
+}
+
+// Then 调用结束后在结束调用的 goroutine 中按顺序执行, 已结束时立即执行
+func (f *Future) Then(cb func(reply lcode.IMessage, err error)) *Future {
+	f.mu.Lock()
+	if !f.finished {
+		f.callbacks = append(f.callbacks, cb)
+		f.mu.Unlock()
+		return f
+	}
+	err := f.err
+	f.mu.Unlock()
+
+	cb(f.reply, err)
+	return f
+}
+
+func waitError(ctx *context.Context) error {
+	if ctx.Err() == gctx.DeadlineExceeded {
+		return lcode.NewError(lcode.CodeDeadlineExceeded, "rpc client: wait timeout")
+	}
+	return lcode.NewError(lcode.CodeCanceled, "rpc client: wait canceled")
+}
+
+// WaitAll 等待全部结束, 返回第一个失败的错误; ctx 结束时提前返回
+func WaitAll(ctx *context.Context, fs ...*Future) error {
+	var first error
+	for _, f := range fs {
+		err := f.Wait(ctx)
+		if err != nil && first == nil {
+			first = err
+		}
+		if ctx.Err() != nil {
+			return first
+		}
+	}
+	return first
+}
+
+// WaitAny 返回最先结束的下标和错误, ctx 结束时下标为 -1
+func WaitAny(ctx *context.Context, fs ...*Future) (int, error) {
+	if len(fs) == 0 {
+		return -1, lcode.NewError(lcode.CodeInvalidRequest, "rpc client: no future to wait")
+	}
+
+	// 最后一个 case 是 ctx.Done
+	cases := make([]reflect.SelectCase, 0, len(fs)+1)
+	for _, f := range fs {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.Done())})
+	}
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+	i, _, _ := reflect.Select(cases)
+	if i == len(fs) {
+		return -1, waitError(ctx)
+	}
+	return i, fs[i].Err()
+}
@@ -0,0 +1,79 @@
+package client
+
+/*
+ * 客户端指标, 按服务端 endpoint 区分, XClient 的每个连接也记录在这里
+ * */
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/metrics"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+// Metrics 所有客户端共用, 通过 Metrics.ServeHTTP 暴露
+var Metrics = metrics.NewRegistry()
+
+var (
+	mRequests   = metrics.NewCounterVec("lrpc_client_requests_total", "Total number of completed calls, by endpoint and method.", "endpoint", "method")
+	mErrors     = metrics.NewCounterVec("lrpc_client_errors_total", "Total number of failed calls, by endpoint, method and code.", "endpoint", "method", "code")
+	mLatency    = metrics.NewHistogramVec("lrpc_client_request_duration_seconds", "Call latency in seconds.", nil, "endpoint", "method")
+	mInflight   = metrics.NewGaugeVec("lrpc_client_in_flight_requests", "Number of calls waiting for a reply.", "endpoint")
+	mOneway     = metrics.NewCounterVec("lrpc_client_oneway_requests_total", "Total number of one-way calls written, by endpoint and method.", "endpoint", "method")
+	mCoalesced  = metrics.NewCounterVec("lrpc_client_coalesced_requests_total", "Total number of calls served by an identical in-flight call, by endpoint and method.", "endpoint", "method")
+	mConns      = metrics.NewGaugeVec("lrpc_client_connections", "Number of open connections.", "endpoint")
+	mDialErrs   = metrics.NewCounterVec("lrpc_client_dial_errors_total", "Total number of failed dials.", "endpoint")
+	mReconnects = metrics.NewCounterVec("lrpc_client_reconnects_total", "Total number of successful reconnects.", "endpoint")
+	mBytesIn    = metrics.NewCounterVec("lrpc_client_received_bytes_total", "Total bytes of frames received.", "endpoint")
+	mBytesOut   = metrics.NewCounterVec("lrpc_client_sent_bytes_total", "Total bytes of frames sent.", "endpoint")
+)
+
+func init() {
+	Metrics.MustRegister(mRequests, mErrors, mLatency, mInflight, mOneway, mCoalesced, mConns, mDialErrs, mReconnects, mBytesIn, mBytesOut)
+}
+
+type endpointMetrics struct {
+	endpoint string
+	inflight *metrics.Gauge
+	conns    *metrics.Gauge
+	bytesIn  *metrics.Counter
+	bytesOut *metrics.Counter
+}
+
+func newEndpointMetrics(endpoint string) *endpointMetrics {
+	return &endpointMetrics{
+		endpoint: endpoint,
+		inflight: mInflight.With(endpoint),
+		conns:    mConns.With(endpoint),
+		bytesIn:  mBytesIn.With(endpoint),
+		bytesOut: mBytesOut.With(endpoint),
+	}
+}
+
+func (m *endpointMetrics) observe(method string, start time.Time, err error) {
+	mRequests.With(m.endpoint, method).Inc()
+	mLatency.With(m.endpoint, method).ObserveDuration(time.Since(start))
+	if err != nil {
+		mErrors.With(m.endpoint, method, lcode.ErrorCode(err).String()).Inc()
+	}
+}
+
+// observeOneway 单向调用没有响应, 只记录写入结果
+func (m *endpointMetrics) observeOneway(method string, err error) {
+	mOneway.With(m.endpoint, method).Inc()
+	if err != nil {
+		mErrors.With(m.endpoint, method, lcode.ErrorCode(err).String()).Inc()
+	}
+}
+
+// remoteEndpoint 与服务端注册的 endpoint 格式一致
+func remoteEndpoint(conn net.Conn) string {
+	ep := transport.Endpoint(conn.RemoteAddr())
+	if strings.Contains(ep, "@") {
+		return ep
+	}
+	return transport.NetworkTCP + "@" + ep
+}
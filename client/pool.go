@@ -0,0 +1,308 @@
+package client
+
+/*
+ * 单个服务地址的连接池
+ *   调用时选择 pending 最少的连接, 都在忙且未到上限时在后台新建连接
+ *   后台定期移除断开的连接, 回收超过 MinConns 的空闲连接, 并补足 MinConns
+ *   连续 poolMaxDialFailures 次建立失败后不再在后台补足, 直到 Get 建立成功
+ * */
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/rpc"
+)
+
+const poolMaxDialFailures = 3
+
+// PoolConfig 零值使用 DefaultPoolConfig 中对应的值
+type PoolConfig struct {
+	MinConns      int           // 保持的最少连接数
+	MaxConns      int           // 最多连接数
+	IdleTimeout   time.Duration // 超过 MinConns 的连接空闲该时间后关闭
+	CheckInterval time.Duration // 后台检查的间隔
+}
+
+var DefaultPoolConfig = PoolConfig{
+	MinConns:      1,
+	MaxConns:      4,
+	IdleTimeout:   time.Minute,
+	CheckInterval: time.Second,
+}
+
+func (cfg PoolConfig) withDefault() PoolConfig {
+	if cfg.MinConns <= 0 {
+		cfg.MinConns = DefaultPoolConfig.MinConns
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = DefaultPoolConfig.MaxConns
+	}
+	if cfg.MaxConns < cfg.MinConns {
+		cfg.MaxConns = cfg.MinConns
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultPoolConfig.IdleTimeout
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = DefaultPoolConfig.CheckInterval
+	}
+	return cfg
+}
+
+type poolConn struct {
+	c        *Client
+	lastUsed int64 // unix nano
+}
+
+func (pc *poolConn) touch() {
+	atomic.StoreInt64(&pc.lastUsed, time.Now().UnixNano())
+}
+
+type Pool struct {
+	rpcAddr string
+	opt     *rpc.Option
+	cfg     PoolConfig
+
+	mu      sync.Mutex
+	dialMu  sync.Mutex // 没有可用连接时串行建立
+	conns   []*poolConn
+	dialing int
+	fails   int // 连续建立失败的次数
+	closed  bool
+	done    chan struct{}
+}
+
+// NewPool 同步建立 MinConns 个连接, 全部失败时返回错误
+func NewPool(rpcAddr string, opt *rpc.Option, cfg *PoolConfig) (*Pool, error) {
+	p := &Pool{
+		rpcAddr: rpcAddr,
+		opt:     opt,
+		done:    make(chan struct{}),
+	}
+	if cfg != nil {
+		p.cfg = cfg.withDefault()
+	} else {
+		p.cfg = DefaultPoolConfig
+	}
+
+	var err error
+	for i := 0; i < p.cfg.MinConns; i++ {
+		var c *Client
+		c, err = p.dial()
+		if err != nil {
+			continue
+		}
+		p.conns = append(p.conns, &poolConn{c: c, lastUsed: time.Now().UnixNano()})
+	}
+	if len(p.conns) == 0 {
+		return nil, err
+	}
+
+	go p.maintain()
+	return p, nil
+}
+
+func (p *Pool) dial() (*Client, error) {
+	return XDial(p.rpcAddr, p.opt)
+}
+
+// Get 返回 pending 最少的可用连接, 没有可用连接时同步建立
+func (p *Pool) Get() (*Client, error) {
+	c, err := p.least()
+	if c != nil || err != nil {
+		return c, err
+	}
+
+	// 同时只建立一个, 其它调用等待后复用
+	p.dialMu.Lock()
+	defer p.dialMu.Unlock()
+	c, err = p.least()
+	if c != nil || err != nil {
+		return c, err
+	}
+
+	c, err = p.dial()
+	p.dialed(err)
+	if err != nil {
+		return nil, err
+	}
+	pc := &poolConn{c: c}
+	pc.touch()
+	if !p.add(pc) {
+		_ = c.Close()
+		return nil, ErrShutdown
+	}
+	return c, nil
+}
+
+// least 没有可用连接时返回 nil
+func (p *Pool) least() (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrShutdown
+	}
+	p.pruneLocked()
+
+	// 优先选择已就绪的连接, 重连中的连接会排队或直接失败
+	var (
+		best      *poolConn
+		least     int
+		bestReady bool
+	)
+	for _, pc := range p.conns {
+		n := pc.c.Pending()
+		ready := pc.c.State() == StateReady
+		if best == nil || (ready && !bestReady) || (ready == bestReady && n < least) {
+			best, least, bestReady = pc, n, ready
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	// 所有连接都有未完成的调用, 在后台扩容
+	if least > 0 && len(p.conns)+p.dialing < p.cfg.MaxConns {
+		p.dialing++
+		go p.grow()
+	}
+	best.touch()
+	return best.c, nil
+}
+
+// Call 同 Client.Call, 使用池中的连接
+func (p *Pool) Call(ctx *context.Context, sm string, args, reply lcode.IMessage) error {
+	c, err := p.Get()
+	if err != nil {
+		return err
+	}
+	return c.Call(ctx, sm, args, reply)
+}
+
+// Len 当前的连接数, 包括已断开但还未移除的
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrShutdown
+	}
+	p.closed = true
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+
+	close(p.done)
+	for _, pc := range conns {
+		_ = pc.c.Close()
+	}
+	return nil
+}
+
+// add 连接池已关闭时返回 false
+func (p *Pool) add(pc *poolConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns = append(p.conns, pc)
+	return true
+}
+
+func (p *Pool) grow() {
+	fun := "Pool.grow"
+	c, err := p.dial()
+
+	p.mu.Lock()
+	p.dialing--
+	p.mu.Unlock()
+	p.dialed(err)
+
+	if err != nil {
+		log.Errorf("", "%s rpcAddr:%s dial failed err:%v", fun, p.rpcAddr, err)
+		return
+	}
+	pc := &poolConn{c: c}
+	pc.touch()
+	if !p.add(pc) {
+		_ = c.Close()
+	}
+}
+
+func (p *Pool) dialed(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.fails++
+		return
+	}
+	p.fails = 0
+}
+
+// pruneLocked 移除已断开的连接
+func (p *Pool) pruneLocked() {
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		if pc.c.IsAvailable() {
+			conns = append(conns, pc)
+			continue
+		}
+		_ = pc.c.Close()
+	}
+	p.conns = conns
+}
+
+// maintain 回收空闲连接, 补足 MinConns
+func (p *Pool) maintain() {
+	ticker := time.NewTicker(p.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now().UnixNano()
+		var idle []*poolConn
+		p.mu.Lock()
+		p.pruneLocked()
+		conns := p.conns[:0]
+		for _, pc := range p.conns {
+			if len(p.conns)-len(idle) > p.cfg.MinConns && pc.c.Pending() == 0 &&
+				now-atomic.LoadInt64(&pc.lastUsed) > int64(p.cfg.IdleTimeout) {
+				idle = append(idle, pc)
+				continue
+			}
+			conns = append(conns, pc)
+		}
+		p.conns = conns
+		missing := p.cfg.MinConns - len(p.conns) - p.dialing
+		if p.fails >= poolMaxDialFailures {
+			missing = 0
+		}
+		if missing > 0 {
+			p.dialing += missing
+		}
+		p.mu.Unlock()
+
+		for _, pc := range idle {
+			_ = pc.c.Close()
+		}
+		// 断开的连接在后台补上
+		for i := 0; i < missing; i++ {
+			go p.grow()
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package client
+
+/*
+ * 自动重连, rpc.Option.Reconnect 不为空时启用
+ *   连接断开后按指数退避加随机抖动重新建立连接并握手, 已发出的调用以连接错误结束
+ *   重连期间的调用最多排队 QueueSize 个, 连接就绪后按顺序发送; 队列已满时直接失败
+ *   状态变化通过 State 和 WaitForStateChange 观察
+ * */
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/rpc"
+)
+
+type State int32
+
+const (
+	StateConnecting State = iota
+	StateReady
+	StateTransientFailure
+	StateShutdown
+)
+
+var stateNames = [...]string{
+	StateConnecting:       "connecting",
+	StateReady:            "ready",
+	StateTransientFailure: "transient_failure",
+	StateShutdown:         "shutdown",
+}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+func (c *Client) State() State {
+	return State(atomic.LoadInt32(&c.state))
+}
+
+// WaitForStateChange 等待状态离开 s, ctx 结束时返回 false
+func (c *Client) WaitForStateChange(ctx *context.Context, s State) bool {
+	for {
+		c.mu.Lock()
+		if c.State() != s {
+			c.mu.Unlock()
+			return true
+		}
+		ch := c.stateCh
+		c.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// setStateLocked 调用方持有 c.mu, shutdown 之后不再变化
+func (c *Client) setStateLocked(s State) {
+	old := c.State()
+	if old == s || old == StateShutdown {
+		return
+	}
+	atomic.StoreInt32(&c.state, int32(s))
+	close(c.stateCh)
+	c.stateCh = make(chan struct{})
+}
+
+func (c *Client) enableReconnect(p *rpc.ReconnectPolicy, redial func() (net.Conn, *rpc.Option, error)) {
+	policy := *p
+	d := rpc.DefaultReconnectPolicy
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = d.BaseDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = d.MaxDelay
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = d.Multiplier
+	}
+	if policy.Jitter <= 0 || policy.Jitter > 1 {
+		policy.Jitter = d.Jitter
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = &policy
+	c.redial = redial
+}
+
+// backoff 连续失败 n 次后的等待
+func (c *Client) backoff(n int) time.Duration {
+	p := c.policy
+	d := float64(p.BaseDelay) * math.Pow(p.Multiplier, float64(n-1))
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// enqueue 重连期间排队, 返回 true 表示调用已排队或已失败
+func (c *Client) enqueue(ca *Call) bool {
+	c.mu.Lock()
+	st := c.State()
+	if c.policy == nil || st == StateReady || st == StateShutdown {
+		c.mu.Unlock()
+		return false
+	}
+	if len(c.queue) < c.policy.QueueSize {
+		c.queue = append(c.queue, ca)
+		c.mu.Unlock()
+		return true
+	}
+	c.mu.Unlock()
+
+	ca.Error = &NotSentError{Err: lcode.Errorf(lcode.CodeUnavailable, "rpc client: connection %s", st)}
+	ca.done()
+	return true
+}
+
+// reconnect 在接收 goroutine 中调用, 返回 true 表示已换上新连接
+func (c *Client) reconnect() bool {
+	fun := "Client.reconnect"
+	c.mu.Lock()
+	redial := c.redial
+	c.mu.Unlock()
+	if redial == nil {
+		return false
+	}
+
+	for n := 1; ; n++ {
+		c.mu.Lock()
+		if !c.IsAvailable() {
+			c.mu.Unlock()
+			return false
+		}
+		c.setStateLocked(StateConnecting)
+		c.mu.Unlock()
+
+		cc, opt, err := redial()
+		if err == nil {
+			return c.resume(cc, opt)
+		}
+		log.Errorf("", "%s endpoint:%s attempt:%d failed err:%v", fun, c.m.endpoint, n, err)
+
+		c.mu.Lock()
+		c.setStateLocked(StateTransientFailure)
+		c.mu.Unlock()
+		if c.policy.MaxAttempts > 0 && n >= c.policy.MaxAttempts {
+			c.shutdown(lcode.Errorf(lcode.CodeUnavailable, "rpc client: reconnect failed after %d attempts err:%v", n, err))
+			return false
+		}
+
+		select {
+		case <-time.After(c.backoff(n)):
+		case <-c.done:
+			return false
+		}
+	}
+}
+
+// resume 换上新连接, 发送排队的调用
+func (c *Client) resume(cc net.Conn, opt *rpc.Option) bool {
+	c.sending.Lock()
+	c.mu.Lock()
+	if !c.IsAvailable() {
+		c.mu.Unlock()
+		c.sending.Unlock()
+		_ = cc.Close()
+		return false
+	}
+	c.cc = cc
+	c.opt = opt
+	c.m.conns.Inc()
+	mReconnects.With(c.m.endpoint).Inc()
+	c.setStateLocked(StateReady)
+	queue := c.queue
+	c.queue = nil
+	c.mu.Unlock()
+	c.sending.Unlock()
+
+	log.Infof("", "Client.resume endpoint:%s reconnected", c.m.endpoint)
+	go func() {
+		for _, ca := range queue {
+			c.send(ca)
+		}
+	}()
+	return true
+}
+
+// shutdown 不再重连, 排队的调用以 err 结束
+func (c *Client) shutdown(err error) {
+	c.mu.Lock()
+	atomic.StoreInt32(&c.closing, StatusClosing)
+	c.setStateLocked(StateShutdown)
+	queue := c.queue
+	c.queue = nil
+	c.mu.Unlock()
+
+	c.doneOnce.Do(func() { close(c.done) })
+	for _, ca := range queue {
+		ca.Error = err
+		ca.done()
+	}
+}
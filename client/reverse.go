@@ -0,0 +1,59 @@
+package client
+
+import (
+	"time"
+
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/rpc"
+)
+
+// Register 注册回调服务, 服务端通过 rpc.Conn.Call 调用, 方法签名与服务端相同
+func (c *Client) Register(rcvr interface{}) error {
+	c.mu.Lock()
+	if c.handlers == nil {
+		c.handlers = rpc.NewServer()
+	}
+	handlers := c.handlers
+	c.mu.Unlock()
+	return handlers.Register(rcvr)
+}
+
+// serveReverse 处理服务端的反向调用, 超时使用 Option.HandleTimeout
+func (c *Client) serveReverse(h *lcode.Header, body []byte) {
+	fun := "Client.serveReverse"
+	c.mu.Lock()
+	handlers := c.handlers
+	c.mu.Unlock()
+
+	resp := &lcode.Header{Seq: h.Seq, TraceId: h.TraceId, Flag: lcode.FlagReverse}
+	var reply interface{}
+	if handlers == nil {
+		resp.Code = lcode.CodeNotFound
+		resp.Error = "rpc client: no callback service registered"
+	} else {
+		timeout := c.opt.HandleTimeout
+		if timeout == 0 {
+			timeout = 3 * time.Second
+		}
+		info := &rpc.CallInfo{
+			Header:    h,
+			Peer:      c.m.endpoint,
+			Transport: rpc.TransportReverse,
+		}
+		var err error
+		reply, err = handlers.ServeCall(info, func(argv interface{}) error {
+			return c.Decode(body, argv)
+		}, timeout)
+		if err != nil {
+			log.Errorf(h.TraceId, "%s serviceMethod:%s failed err:%v", fun, h.ServiceMethod, err)
+			resp.Code = h.Code
+			resp.Error = h.Error
+		}
+	}
+
+	err := c.writeFrame(resp, reply)
+	if err != nil {
+		log.Errorf(h.TraceId, "%s write response failed err:%v", fun, err)
+	}
+}
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/tracing"
+)
+
+var ErrSendClosed = errors.New("rpc client: send on closed stream")
+
+// Stream 客户端的流, 协议见 rpc.Stream
+// Send 和 Recv 可以在不同的 goroutine 中调用
+type Stream struct {
+	c       *Client
+	seq     uint64
+	method  string
+	traceId string
+	start   time.Time
+	span    *tracing.Span
+
+	recv   chan []byte
+	win    *rpc.StreamWindow
+	credit rpc.StreamCredit
+
+	sendMu     sync.Mutex
+	sendClosed bool
+
+	done     chan struct{} // 收到服务端 EOS, 或被中止
+	doneOnce sync.Once
+	err      error // 最终状态, nil 表示正常结束
+}
+
+// NewStream 打开一个流, ctx 提供 trace 和元数据, ctx 结束时中止流
+func (c *Client) NewStream(ctx *context.Context, sm string) (*Stream, error) {
+	if c == nil {
+		return nil, ErrShutdown
+	}
+
+	span := tracing.StartClientSpan(ctx, sm)
+	span.SetAttr("peer", c.m.endpoint)
+	st := &Stream{
+		c:       c,
+		method:  sm,
+		traceId: context.GetTraceId(ctx),
+		start:   time.Now(),
+		span:    span,
+		recv:    make(chan []byte, rpc.DefaultStreamWindow),
+		win:     rpc.NewStreamWindow(rpc.DefaultStreamWindow),
+		done:    make(chan struct{}),
+	}
+	span.SetAttr("lrpc.trace_id", st.traceId)
+
+	c.mu.Lock()
+	if !c.IsAvailable() {
+		c.mu.Unlock()
+		span.SetStatus(lcode.CodeUnavailable.String(), ErrShutdown.Error())
+		span.End()
+		return nil, ErrShutdown
+	}
+	if state := c.State(); state != StateReady {
+		c.mu.Unlock()
+		err := lcode.Errorf(lcode.CodeUnavailable, "rpc client: connection %s", state)
+		span.SetStatus(lcode.CodeUnavailable.String(), err.Error())
+		span.End()
+		return nil, err
+	}
+	st.seq = c.seq
+	c.seq++
+	c.streams[st.seq] = st
+	c.mu.Unlock()
+	c.m.inflight.Inc()
+
+	err := c.writeFrame(&lcode.Header{
+		ServiceMethod: sm,
+		Seq:           st.seq,
+		TraceId:       st.traceId,
+		Traceparent:   span.Context().Traceparent(),
+		Meta:          context.Metadata(ctx),
+		Flag:          lcode.FlagStream,
+	}, nil)
+	if err != nil {
+		st.finish(err)
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			st.cancel(lcode.Errorf(lcode.CodeCanceled, "rpc client: stream canceled err:%v", ctx.Err()))
+		case <-st.done:
+		}
+	}()
+	return st, nil
+}
+
+func (c *Client) writeFrame(h *lcode.Header, body interface{}) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	return c.Write(h, body)
+}
+
+// handleStream 在接收 goroutine 中调用
+func (c *Client) handleStream(h *lcode.Header, body []byte) {
+	c.mu.Lock()
+	st := c.streams[h.Seq]
+	c.mu.Unlock()
+
+	switch {
+	case st == nil:
+	case h.Is(lcode.FlagReset):
+		st.finish(lcode.NewError(lcode.CodeCanceled, "rpc client: stream reset by server"))
+	case h.Is(lcode.FlagWindow):
+		st.win.Add(rpc.StreamWindowIncrement(h))
+	case h.Is(lcode.FlagEOS):
+		st.finish(lcode.HeaderError(h))
+	default:
+		select {
+		case st.recv <- append([]byte(nil), body...):
+		default:
+			log.Warningf(st.traceId, "Client.handleStream seq:%d window exceeded", h.Seq)
+			st.cancel(lcode.NewError(lcode.CodeResourceExhausted, "rpc client: stream window exceeded"))
+		}
+	}
+}
+
+func (st *Stream) header(f lcode.Flag) *lcode.Header {
+	return &lcode.Header{Seq: st.seq, TraceId: st.traceId, Flag: lcode.FlagStream | f}
+}
+
+// Send 窗口用完时阻塞直到服务端消费
+func (st *Stream) Send(msg lcode.IMessage) error {
+	st.sendMu.Lock()
+	closed := st.sendClosed
+	st.sendMu.Unlock()
+	if closed {
+		return ErrSendClosed
+	}
+
+	err := st.win.Acquire(st.done)
+	if err != nil {
+		return st.doneErr()
+	}
+	return st.c.writeFrame(st.header(0), msg)
+}
+
+// CloseSend 半关闭, 之后仍可以 Recv
+func (st *Stream) CloseSend() error {
+	st.sendMu.Lock()
+	defer st.sendMu.Unlock()
+	if st.sendClosed {
+		return nil
+	}
+	st.sendClosed = true
+
+	select {
+	case <-st.done:
+		return nil
+	default:
+	}
+	return st.c.writeFrame(st.header(lcode.FlagEOS), nil)
+}
+
+// Recv 服务端正常结束且消息读完后返回 io.EOF, 否则返回服务端的错误
+func (st *Stream) Recv(msg lcode.IMessage) error {
+	select {
+	case b := <-st.recv:
+		return st.decode(b, msg)
+	default:
+	}
+
+	select {
+	case b := <-st.recv:
+		return st.decode(b, msg)
+	case <-st.done:
+		select {
+		case b := <-st.recv:
+			return st.decode(b, msg)
+		default:
+			return st.doneErr()
+		}
+	}
+}
+
+func (st *Stream) decode(b []byte, msg lcode.IMessage) error {
+	if n := st.credit.Consume(); n > 0 {
+		h := st.header(lcode.FlagWindow)
+		h.Meta = rpc.StreamWindowMeta(n)
+		_ = st.c.writeFrame(h, nil)
+	}
+	return st.c.Decode(b, msg)
+}
+
+// Close 中止流, 正常结束的流不需要调用
+func (st *Stream) Close() error {
+	st.cancel(lcode.NewError(lcode.CodeCanceled, "rpc client: stream canceled"))
+	return nil
+}
+
+// Err 流结束后的最终状态, 未结束或正常结束时为 nil
+func (st *Stream) Err() error {
+	select {
+	case <-st.done:
+		return st.err
+	default:
+		return nil
+	}
+}
+
+func (st *Stream) doneErr() error {
+	if st.err == nil {
+		return io.EOF
+	}
+	return st.err
+}
+
+// cancel 通知服务端后结束
+func (st *Stream) cancel(err error) {
+	select {
+	case <-st.done:
+		return
+	default:
+	}
+	_ = st.c.writeFrame(st.header(lcode.FlagReset), nil)
+	st.finish(err)
+}
+
+func (st *Stream) finish(err error) {
+	c := st.c
+	c.mu.Lock()
+	delete(c.streams, st.seq)
+	c.mu.Unlock()
+	st.end(err)
+}
+
+// end 调用方需要已经从 streams 中移除
+func (st *Stream) end(err error) {
+	st.doneOnce.Do(func() {
+		st.err = err
+		close(st.done)
+
+		c := st.c
+		c.m.inflight.Dec()
+		c.m.observe(st.method, st.start, err)
+		if err != nil {
+			st.span.SetStatus(lcode.ErrorCode(err).String(), lcode.ErrorDesc(err))
+		}
+		st.span.End()
+	})
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/rpc"
+)
+
+// Upload 上传 r 的内容, 服务端方法使用 rpc.ReceiveObject
+// 从服务端已保存的位置续传, size 为 -1 时读到 io.EOF 为止
+// 返回服务端最后确认的长度, 失败后再次调用即可续传
+func (c *Client) Upload(ctx *context.Context, sm, name string, r io.ReaderAt, size int64) (int64, error) {
+	fun := "Client.Upload"
+	st, err := c.NewStream(ctx, sm)
+	if err != nil {
+		return 0, err
+	}
+
+	err = st.Send(&rpc.TransferHeader{Name: name, Size: size})
+	if err != nil {
+		_ = st.Close()
+		return 0, err
+	}
+	ack := &rpc.TransferAck{}
+	err = st.Recv(ack)
+	if err != nil {
+		_ = st.Close()
+		return 0, err
+	}
+	acked := ack.Offset
+
+	// 单独读取确认, 避免双方都阻塞在发送上
+	done := make(chan error, 1)
+	go func() {
+		for {
+			a := &rpc.TransferAck{}
+			err := st.Recv(a)
+			if err != nil {
+				done <- err
+				return
+			}
+			atomic.StoreInt64(&acked, a.Offset)
+		}
+	}()
+
+	err = sendChunks(st, r, ack.Offset, size)
+	if err != nil {
+		log.Errorf(st.traceId, "%s sendChunks failed name:%s err:%v", fun, name, err)
+		_ = st.Close()
+		<-done
+		// 服务端先结束时以服务端的错误为准
+		if serr := st.Err(); serr != nil && lcode.ErrorCode(serr) != lcode.CodeCanceled {
+			err = serr
+		}
+		return atomic.LoadInt64(&acked), err
+	}
+
+	_ = st.CloseSend()
+	err = <-done
+	if err == io.EOF {
+		err = nil
+	}
+	return atomic.LoadInt64(&acked), err
+}
+
+func sendChunks(st *Stream, r io.ReaderAt, offset, size int64) error {
+	// 客户端同步编码, 缓冲区可以复用
+	buf := make([]byte, rpc.DefaultChunkSize)
+	for size < 0 || offset < size {
+		n := len(buf)
+		if size >= 0 && size-offset < int64(n) {
+			n = int(size - offset)
+		}
+		m, err := r.ReadAt(buf[:n], offset)
+		if m > 0 {
+			serr := st.Send(rpc.NewChunk(offset, buf[:m]))
+			if serr != nil {
+				return serr
+			}
+			offset += int64(m)
+		}
+		if err == io.EOF {
+			if size >= 0 && offset < size {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Download 从 offset 开始下载, 校验后写入 w, 服务端方法使用 rpc.SendObject
+// 返回写入 w 的长度, 失败后以 offset+n 再次调用即可续传
+func (c *Client) Download(ctx *context.Context, sm, name string, offset int64, w io.Writer) (int64, error) {
+	fun := "Client.Download"
+	st, err := c.NewStream(ctx, sm)
+	if err != nil {
+		return 0, err
+	}
+
+	err = st.Send(&rpc.TransferHeader{Name: name, Offset: offset})
+	if err != nil {
+		_ = st.Close()
+		return 0, err
+	}
+	_ = st.CloseSend()
+
+	ack := &rpc.TransferAck{}
+	err = st.Recv(ack)
+	if err != nil {
+		_ = st.Close()
+		return 0, err
+	}
+
+	var n int64
+	for {
+		chunk := &rpc.Chunk{}
+		err = st.Recv(chunk)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = chunk.Verify(offset + n)
+		}
+		if err == nil {
+			_, err = w.Write(chunk.Data)
+		}
+		if err != nil {
+			log.Errorf(st.traceId, "%s failed name:%s offset:%d err:%v", fun, name, offset+n, err)
+			_ = st.Close()
+			return n, err
+		}
+		n += int64(len(chunk.Data))
+	}
+
+	if ack.Size >= 0 && offset+n != ack.Size {
+		return n, lcode.Errorf(lcode.CodeInvalidRequest, "rpc client: object %s size %d, expect %d", name, offset+n, ack.Size)
+	}
+	return n, nil
+}
@@ -8,15 +8,32 @@ package consts
  * */
 
 const (
-	DefaultRpcPath   = "/_lrpc_"
-	DefaultDebugPath = "/debug/_lrpc_"
-	MethodConnect    = "CONNECT"
-	Connected        = "200 Connected to lrpc"
+	DefaultRpcPath       = "/_lrpc_"
+	DefaultDebugPath     = "/debug/_lrpc_"
+	DefaultDebugJSONPath = "/debug/_lrpc_/json"
+	DefaultMetricsPath   = "/metrics"              // Prometheus 默认抓取的路径
+	DebugMetricsPath     = "/debug/_lrpc_/metrics" // HandleHTTP 挂在这里, 不占用应用自己的 /metrics
+	DefaultJSONRPCPath   = "/jsonrpc"
+	DefaultWebSocketPath = "/_lrpc_/ws"
+	MethodConnect        = "CONNECT"
+	Connected            = "200 Connected to lrpc"
 )
 
 const (
 	ProtocolHTTP = "http"
 	ProtocolRPC  = "rpc"
+	ProtocolTCP  = "tcp"
+	ProtocolUnix = "unix"
+	ProtocolMem  = "mem"
+	ProtocolTLS  = "tls"
+
+	ProtocolJSONRPC = "jsonrpc" // JSON-RPC 2.0, 每行一个请求
+	ProtocolWS      = "ws"      // http@ 监听地址上的 websocket
+	ProtocolWSS     = "wss"
+)
+
+const (
+	DefaultServerAddr = "tcp@:0"
 )
 
 /* vim: set tabstop=4 set shiftwidth=4 */
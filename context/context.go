@@ -11,9 +11,12 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sync"
 )
 
+// Context 可以在多个 goroutine 中同时读写
 type Context struct {
+	mu   sync.RWMutex
 	meta map[interface{}]interface{}
 	context.Context
 }
@@ -25,24 +28,39 @@ func NewContext(ctx context.Context) *Context {
 }
 
 func (c *Context) Value(key interface{}) interface{} {
-	if c.meta == nil {
-		c.meta = make(map[interface{}]interface{})
-	}
-
-	if v, ok := c.meta[key]; ok {
+	c.mu.RLock()
+	v, ok := c.meta[key]
+	c.mu.RUnlock()
+	if ok {
 		return v
 	}
 	return c.Context.Value(key)
 }
 
 func (c *Context) SetValue(key, val interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.meta == nil {
 		c.meta = make(map[interface{}]interface{})
 	}
 	c.meta[key] = val
 }
 
+// update 在锁内用 f 的返回值替换 key 的值, 返回新值
+func (c *Context) update(key interface{}, f func(old interface{}) interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.meta == nil {
+		c.meta = make(map[interface{}]interface{})
+	}
+	v := f(c.meta[key])
+	c.meta[key] = v
+	return v
+}
+
 func (c *Context) String() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return fmt.Sprintf("%v.WithValue(%v)", c.Context, c.meta)
 }
 
@@ -67,11 +85,7 @@ func WithLocalValue(ctx *Context, key, val interface{}) *Context {
 		panic("key is not comparable")
 	}
 
-	if ctx.meta == nil {
-		ctx.meta = make(map[interface{}]interface{})
-	}
-
-	ctx.meta[key] = val
+	ctx.SetValue(key, val)
 	return ctx
 }
 
@@ -0,0 +1,33 @@
+package context
+
+var (
+	keyMetadata = "metaMetadata"
+)
+
+// SetMetadata 随调用发送给服务端, 服务端通过同名函数读取
+func SetMetadata(ctx *Context, k, v string) {
+	md, _ := ctx.Value(keyMetadata).(map[string]string)
+	nmd := make(map[string]string, len(md)+1)
+	for mk, mv := range md {
+		nmd[mk] = mv
+	}
+	nmd[k] = v
+	ctx.SetValue(keyMetadata, nmd)
+}
+
+func GetMetadata(ctx *Context, k string) string {
+	md, _ := ctx.Value(keyMetadata).(map[string]string)
+	return md[k]
+}
+
+// Metadata 返回的 map 不能修改
+func Metadata(ctx *Context) map[string]string {
+	md, _ := ctx.Value(keyMetadata).(map[string]string)
+	return md
+}
+
+// WithMetadata 整体替换
+func WithMetadata(ctx *Context, md map[string]string) *Context {
+	ctx.SetValue(keyMetadata, md)
+	return ctx
+}
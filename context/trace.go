@@ -1,5 +1,10 @@
 package context
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
 var (
 	keyTraceId = "metaTraceId"
 )
@@ -8,6 +13,24 @@ func SetTraceId(ctx *Context, traceId string) {
 	ctx.SetValue(keyTraceId, traceId)
 }
 
+// GetTraceId 没有设置时生成一个, 格式与 W3C trace-id 相同
+// 多个 goroutine 同时调用时得到同一个
 func GetTraceId(ctx *Context) string {
-	return ctx.Value(keyTraceId).(string)
+	if id, ok := ctx.Value(keyTraceId).(string); ok && id != "" {
+		return id
+	}
+	id := NewTraceId()
+	return ctx.update(keyTraceId, func(old interface{}) interface{} {
+		if s, ok := old.(string); ok && s != "" {
+			return s
+		}
+		return id
+	}).(string)
+}
+
+// NewTraceId 32位十六进制
+func NewTraceId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
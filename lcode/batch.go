@@ -0,0 +1,51 @@
+package lcode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrBatchMalformed = errors.New("lcode: malformed batch")
+
+// PackBatch 批量调用的 body, 每条与帧相同: | uint32 长度 | Message.Pack() |
+// 只有新版本的连接才有批量调用, 每条都带完整的帧头
+func PackBatch(msgs []*Message) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	var l [4]byte
+	for _, m := range msgs {
+		m.Version = HeaderVersion
+		bs, err := m.Pack()
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(l[:], uint32(len(bs)))
+		buf.Write(l[:])
+		buf.Write(bs)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnpackBatch 每条的 body 都是独立的副本
+func UnpackBatch(b []byte) ([]*Message, error) {
+	var msgs []*Message
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, ErrBatchMalformed
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint64(n) > uint64(len(b)) {
+			return nil, ErrBatchMalformed
+		}
+		m := &Message{H: &Header{}, Version: HeaderVersion}
+		err := m.Unpack(b[:n])
+		if err != nil {
+			return nil, err
+		}
+		m.B = append([]byte(nil), m.B...)
+		msgs = append(msgs, m)
+		b = b[n:]
+	}
+	return msgs, nil
+}
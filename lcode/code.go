@@ -0,0 +1,156 @@
+package lcode
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Code 错误码, 随响应返回给调用方
+type Code uint32
+
+const (
+	CodeOK Code = iota
+	CodeUnknown
+	CodeInvalidRequest
+	CodeUnauthenticated
+	CodePermissionDenied
+	CodeResourceExhausted
+	CodeNotFound
+	CodeDeadlineExceeded
+	CodeUnavailable
+	CodeCanceled
+)
+
+var codeText = map[Code]string{
+	CodeOK:                "ok",
+	CodeUnknown:           "unknown",
+	CodeInvalidRequest:    "invalid request",
+	CodeUnauthenticated:   "unauthenticated",
+	CodePermissionDenied:  "permission denied",
+	CodeResourceExhausted: "resource exhausted",
+	CodeNotFound:          "not found",
+	CodeDeadlineExceeded:  "deadline exceeded",
+	CodeUnavailable:       "unavailable",
+	CodeCanceled:          "canceled",
+}
+
+var codeHTTPStatus = map[Code]int{
+	CodeOK:                http.StatusOK,
+	CodeUnknown:           http.StatusInternalServerError,
+	CodeInvalidRequest:    http.StatusBadRequest,
+	CodeUnauthenticated:   http.StatusUnauthorized,
+	CodePermissionDenied:  http.StatusForbidden,
+	CodeResourceExhausted: http.StatusTooManyRequests,
+	CodeNotFound:          http.StatusNotFound,
+	CodeDeadlineExceeded:  http.StatusGatewayTimeout,
+	CodeUnavailable:       http.StatusServiceUnavailable,
+	CodeCanceled:          499, // 同 nginx, 客户端关闭请求
+}
+
+// HTTPStatus 网关使用的 http 状态码, 未知错误码返回 500
+func (c Code) HTTPStatus() int {
+	if s, ok := codeHTTPStatus[c]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// JSON-RPC 2.0 预定义的错误码, -32000 ~ -32099 留给实现自定义
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+	JSONRPCServerError    = -32000
+)
+
+// JSONRPCCode 对应的 JSON-RPC 错误码, 没有预定义的映射到 -32000 - code
+func (c Code) JSONRPCCode() int {
+	switch c {
+	case CodeOK:
+		return 0
+	case CodeUnknown:
+		return JSONRPCInternalError
+	case CodeInvalidRequest:
+		return JSONRPCInvalidRequest
+	}
+	return JSONRPCServerError - int(c)
+}
+
+// CodeFromJSONRPC JSONRPCCode 的逆映射
+func CodeFromJSONRPC(n int) Code {
+	switch {
+	case n == 0:
+		return CodeOK
+	case n == JSONRPCParseError, n == JSONRPCInvalidRequest, n == JSONRPCInvalidParams:
+		return CodeInvalidRequest
+	case n == JSONRPCMethodNotFound:
+		return CodeNotFound
+	case n <= JSONRPCServerError && n > JSONRPCServerError-100:
+		return Code(JSONRPCServerError - n)
+	}
+	return CodeUnknown
+}
+
+func (c Code) String() string {
+	if s, ok := codeText[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("code(%d)", uint32(c))
+}
+
+// Error 带错误码的rpc错误
+type Error struct {
+	Code Code
+	Msg  string
+}
+
+func NewError(code Code, msg string) *Error {
+	return &Error{Code: code, Msg: msg}
+}
+
+func Errorf(code Code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", e.Code, e.Msg)
+}
+
+// ErrorCode 取出err中的错误码, 非*Error返回CodeUnknown
+func ErrorCode(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeUnknown
+}
+
+// HeaderError 从响应头还原错误
+func HeaderError(h *Header) error {
+	if h.Error == "" && h.Code == CodeOK {
+		return nil
+	}
+	code := h.Code
+	if code == CodeOK {
+		code = CodeUnknown
+	}
+	return NewError(code, h.Error)
+}
+
+// ErrorDesc 取出err的描述, 不带错误码前缀
+func ErrorDesc(err error) string {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Msg
+	}
+	return err.Error()
+}
@@ -13,6 +13,37 @@ type Header struct {
 	Seq           uint64
 	TraceId       string
 	Error         string
+	Code          Code
+	Flag          Flag
+	Traceparent   string            // W3C traceparent, 00-traceid-spanid-flags
+	Meta          map[string]string // 调用方附带的元数据
+}
+
+// Flag 帧类型标记, 按位组合
+type Flag uint32
+
+const (
+	FlagPing Flag = 1 << iota // 保活探测, 对端需回 FlagPong
+	FlagPong
+
+	// 流式调用, Seq 为流 id, 打开流的帧带 ServiceMethod 且没有 body
+	FlagStream
+	FlagEOS    // 发送方半关闭; 服务端的 EOS 帧带最终的 Code/Error
+	FlagWindow // 流控窗口更新, 增加的消息数在 Meta 中
+	FlagReset  // 中止流, 双向都不再收发
+
+	// 反向调用: 服务端调用客户端注册的方法, 请求和响应都带此标记, Seq 由服务端分配
+	FlagReverse
+
+	// 单向调用: 服务端处理后不发送响应
+	FlagOneway
+
+	// 批量调用: body 为 PackBatch 打包的多条调用, 响应按条带各自的 Code/Error
+	FlagBatch
+)
+
+func (h *Header) Is(f Flag) bool {
+	return h.Flag&f != 0
 }
 
 
@@ -3,15 +3,18 @@ package lcode
 import (
 	"bytes"
 	"encoding/binary"
-
-	"github.com/zulong210220/lrpc/consts"
+	"io"
 
 	"github.com/zulong210220/lrpc/log"
 )
 
+// HeaderVersion 握手版本不低于该值时帧头带 Code/Flag/Traceparent/Meta, 旧版本对端没有这些字段
+const HeaderVersion = 1
+
 type Message struct {
-	H *Header
-	B []byte
+	H       *Header
+	B       []byte
+	Version int // 连接协商的握手版本, 见 HeaderVersion
 }
 
 func (m *Message) Pack() ([]byte, error) {
@@ -67,6 +70,44 @@ func (m *Message) Pack() ([]byte, error) {
 		}
 	}
 
+	if m.Version < HeaderVersion {
+		goto body
+	}
+
+	err = binary.Write(dataBuf, binary.BigEndian, uint32(m.H.Code))
+	if err != nil {
+		log.Errorf("Message.Pack", " binary.Write Code failed err:%v", err)
+		return nil, err
+	}
+
+	err = binary.Write(dataBuf, binary.BigEndian, uint32(m.H.Flag))
+	if err != nil {
+		log.Errorf("Message.Pack", " binary.Write Flag failed err:%v", err)
+		return nil, err
+	}
+
+	n = uint32(len(m.H.Traceparent))
+	err = binary.Write(dataBuf, binary.BigEndian, n)
+	if err != nil {
+		log.Errorf("Message.Pack", " binary.Write len Traceparent failed err:%v", err)
+		return nil, err
+	}
+
+	if n > 0 {
+		err = binary.Write(dataBuf, binary.BigEndian, []byte(m.H.Traceparent))
+		if err != nil {
+			log.Errorf("Message.Pack", " binary.Write Traceparent failed err:%v", err)
+			return nil, err
+		}
+	}
+
+	err = packMeta(dataBuf, m.H.Meta)
+	if err != nil {
+		log.Errorf("Message.Pack", " binary.Write Meta failed err:%v", err)
+		return nil, err
+	}
+
+body:
 	n = uint32(len(m.B))
 	err = binary.Write(dataBuf, binary.BigEndian, n)
 	if err != nil {
@@ -97,8 +138,7 @@ func (m *Message) Unpack(data []byte) error {
 		return err
 	}
 
-	buf := make([]byte, n)
-	err = binary.Read(dataBuf, binary.BigEndian, &buf)
+	buf, err := readBytes(dataBuf, n)
 	if err != nil {
 		log.Errorf("Message.Unpack", " binary.Read ServiceMethod failed err:%v", err)
 		return err
@@ -118,8 +158,7 @@ func (m *Message) Unpack(data []byte) error {
 		return err
 	}
 
-	buf = make([]byte, n)
-	err = binary.Read(dataBuf, binary.BigEndian, &buf)
+	buf, err = readBytes(dataBuf, n)
 	if err != nil {
 		log.Errorf("Message.Unpack", " binary.Read TraceId failed err:%v", err)
 		return err
@@ -133,8 +172,7 @@ func (m *Message) Unpack(data []byte) error {
 	}
 
 	if n > 0 {
-		buf = make([]byte, n)
-		err = binary.Read(dataBuf, binary.BigEndian, &buf)
+		buf, err = readBytes(dataBuf, n)
 		if err != nil {
 			log.Errorf("Message.Unpack", " binary.Read Error failed err:%v", err)
 			return err
@@ -142,25 +180,54 @@ func (m *Message) Unpack(data []byte) error {
 		m.H.Error = string(buf)
 	}
 
+	if m.Version < HeaderVersion {
+		goto body
+	}
+
 	err = binary.Read(dataBuf, binary.BigEndian, &n)
 	if err != nil {
-		log.Errorf("Message.Unpack", " binary.Read len Body failed err:%v", err)
+		log.Errorf("Message.Unpack", " binary.Read Code failed err:%v", err)
 		return err
 	}
+	m.H.Code = Code(n)
 
-	//buf = make([]byte, n)
-	if n > consts.BufferPoolSizeMax {
-		buf = make([]byte, n)
-	} else {
-		bb := limitedPool.Get(int(n))
-		if len(*bb) > int(n) {
-			buf = (*bb)[:int(n)]
-		} else {
-			buf = *bb
+	err = binary.Read(dataBuf, binary.BigEndian, &n)
+	if err != nil {
+		log.Errorf("Message.Unpack", " binary.Read Flag failed err:%v", err)
+		return err
+	}
+	m.H.Flag = Flag(n)
+
+	err = binary.Read(dataBuf, binary.BigEndian, &n)
+	if err != nil {
+		log.Errorf("Message.Unpack", " binary.Read len Traceparent failed err:%v", err)
+		return err
+	}
+
+	if n > 0 {
+		buf, err = readBytes(dataBuf, n)
+		if err != nil {
+			log.Errorf("Message.Unpack", " binary.Read Traceparent failed err:%v", err)
+			return err
 		}
-		defer limitedPool.Put(bb)
+		m.H.Traceparent = string(buf)
 	}
-	err = binary.Read(dataBuf, binary.BigEndian, &buf)
+
+	m.H.Meta, err = unpackMeta(dataBuf)
+	if err != nil {
+		log.Errorf("Message.Unpack", " binary.Read Meta failed err:%v", err)
+		return err
+	}
+
+body:
+	err = binary.Read(dataBuf, binary.BigEndian, &n)
+	if err != nil {
+		log.Errorf("Message.Unpack", " binary.Read len Body failed err:%v", err)
+		return err
+	}
+
+	// m.B 在返回后解码, 不能使用会归还的缓冲
+	buf, err = readBytes(dataBuf, n)
 	if err != nil {
 		log.Errorf("Message.Unpack", " binary.Read Body failed err:%v", err)
 		return err
@@ -169,3 +236,64 @@ func (m *Message) Unpack(data []byte) error {
 
 	return err
 }
+
+// readBytes 长度来自对端, 超过剩余数据时不分配
+func readBytes(r *bytes.Reader, n uint32) ([]byte, error) {
+	if int64(n) > int64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// | n uint32 | len k | k | len v | v | ...
+func packMeta(w *bytes.Buffer, meta map[string]string) error {
+	err := binary.Write(w, binary.BigEndian, uint32(len(meta)))
+	if err != nil {
+		return err
+	}
+	for k, v := range meta {
+		for _, s := range []string{k, v} {
+			err = binary.Write(w, binary.BigEndian, uint32(len(s)))
+			if err != nil {
+				return err
+			}
+			w.WriteString(s)
+		}
+	}
+	return nil
+}
+
+func unpackMeta(r *bytes.Reader) (map[string]string, error) {
+	var n uint32
+	err := binary.Read(r, binary.BigEndian, &n)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	if int64(n) > int64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	meta := make(map[string]string, n)
+	var kv [2]string
+	for i := uint32(0); i < n; i++ {
+		for j := range kv {
+			var l uint32
+			err = binary.Read(r, binary.BigEndian, &l)
+			if err != nil {
+				return nil, err
+			}
+			buf, err := readBytes(r, l)
+			if err != nil {
+				return nil, err
+			}
+			kv[j] = string(buf)
+		}
+		meta[kv[0]] = kv[1]
+	}
+	return meta, nil
+}
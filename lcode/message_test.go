@@ -0,0 +1,55 @@
+package lcode
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestMessageVersion(t *testing.T) {
+	h := &Header{
+		ServiceMethod: "Foo.Sum",
+		Seq:           7,
+		TraceId:       "t1",
+		Code:          CodeNotFound,
+		Flag:          FlagOneway,
+		Traceparent:   "00-1-2-01",
+		Meta:          map[string]string{"k": "v"},
+	}
+
+	m := &Message{H: h, B: []byte("body"), Version: HeaderVersion}
+	bs, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Message{H: &Header{}, Version: HeaderVersion}
+	err = got.Unpack(bs)
+	if err != nil || got.H.Code != CodeNotFound || got.H.Flag != FlagOneway || got.H.Meta["k"] != "v" || string(got.B) != "body" {
+		t.Fatalf("expect full header, got %+v err:%v", got.H, err)
+	}
+
+	// 旧版本对端只有 ServiceMethod/Seq/TraceId/Error/Body
+	m.Version = 0
+	bs, err = m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := 4 + len("Foo.Sum") + 8 + 4 + len("t1") + 4 + 4 + len("body")
+	if len(bs) != legacy {
+		t.Fatalf("expect legacy frame %d bytes, got %d", legacy, len(bs))
+	}
+	got = &Message{H: &Header{}}
+	err = got.Unpack(bs)
+	if err != nil || got.H.ServiceMethod != "Foo.Sum" || got.H.Seq != 7 || got.H.Flag != 0 || string(got.B) != "body" {
+		t.Fatalf("expect legacy header, got %+v err:%v", got.H, err)
+	}
+}
+
+func TestUnpackLength(t *testing.T) {
+	// ServiceMethod 长度声明为 4G, 实际只有 8 字节
+	bs := make([]byte, 12)
+	binary.BigEndian.PutUint32(bs, 0xffffffff)
+	m := &Message{H: &Header{}, Version: HeaderVersion}
+	if err := m.Unpack(bs); err == nil {
+		t.Fatal("expect error for oversized length")
+	}
+}
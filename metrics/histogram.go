@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type Histogram struct {
+	upper  []float64
+	counts []uint64 // 不累加, 输出时再累加
+	count  uint64
+	sum    uint64 // float64 bits
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upper:  buckets,
+		counts: make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		nv := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, nv) {
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+}
+
+// ObserveDuration 以秒为单位记录
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string, labels, values []string) {
+	var acc uint64
+	for i, upper := range h.upper {
+		acc += atomic.LoadUint64(&h.counts[i])
+		writeSample(w, name+"_bucket", labels, values, "le", formatFloat(upper), float64(acc))
+	}
+	count := h.Count()
+	writeSample(w, name+"_bucket", labels, values, "le", "+Inf", float64(count))
+	writeSample(w, name+"_sum", labels, values, "", "", h.Sum())
+	writeSample(w, name+"_count", labels, values, "", "", float64(count))
+}
+
+type HistogramVec struct {
+	*family
+	buckets []float64
+}
+
+// NewHistogramVec buckets 为空时使用 DefBuckets, 必须升序
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: " + name + " buckets must be sorted")
+	}
+	return &HistogramVec{
+		family:  newFamily(name, help, typeHistogram, labels),
+		buckets: buckets,
+	}
+}
+
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	s := hv.get(values, func() *series {
+		return &series{obj: newHistogram(hv.buckets)}
+	})
+	return s.obj.(*Histogram)
+}
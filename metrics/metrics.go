@@ -0,0 +1,310 @@
+package metrics
+
+/*
+ * Prometheus 文本格式(0.0.4)的最小实现, 不依赖 prometheus client
+ * 支持 counter/gauge/histogram, 都可以带 label
+ * */
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefBuckets 请求耗时的默认分桶, 单位秒
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Collector interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) MustRegister(cs ...Collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, cs...)
+	r.mu.Unlock()
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	cs := make([]Collector, len(r.collectors))
+	copy(cs, r.collectors)
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range cs {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_, _ = r.WriteTo(w)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// ---
+
+type series struct {
+	values []string
+	obj    interface{} // *Counter, *Gauge, *Histogram; Func 注册的为空
+	value  func() float64
+}
+
+// family 同名指标的所有 label 组合
+type family struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+func newFamily(name, help, typ string, labels []string) *family {
+	return &family{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+func (f *family) get(values []string, create func() *series) *series {
+	if len(values) != len(f.labels) {
+		panic("metrics: " + f.name + " label values count mismatch")
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.RLock()
+	s := f.series[key]
+	f.mu.RUnlock()
+	if s != nil {
+		return s
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s = f.series[key]
+	if s == nil {
+		s = create()
+		s.values = append([]string(nil), values...)
+		f.series[key] = s
+	}
+	return s
+}
+
+// Delete 删除一组 label 的数据, 如已经下线的 endpoint
+func (f *family) Delete(values ...string) {
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	delete(f.series, key)
+	f.mu.Unlock()
+}
+
+func (f *family) sorted() []*series {
+	f.mu.RLock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ss := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		ss = append(ss, f.series[k])
+	}
+	f.mu.RUnlock()
+	return ss
+}
+
+func (f *family) write(w *bufio.Writer) {
+	ss := f.sorted()
+	if len(ss) == 0 {
+		return
+	}
+
+	w.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+	w.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+	for _, s := range ss {
+		if h, ok := s.obj.(*Histogram); ok {
+			h.write(w, f.name, f.labels, s.values)
+			continue
+		}
+		writeSample(w, f.name, f.labels, s.values, "", "", s.value())
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + "=\"" + escapeLabel(values[i]) + "\"")
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + "=\"" + extraValue + "\"")
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+// ---
+
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+type CounterVec struct {
+	*family
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newFamily(name, help, typeCounter, labels)}
+}
+
+func (cv *CounterVec) With(values ...string) *Counter {
+	s := cv.get(values, func() *series {
+		c := &Counter{}
+		return &series{obj: c, value: func() float64 { return float64(c.Value()) }}
+	})
+	return s.obj.(*Counter)
+}
+
+// Func 由 f 提供取值, 用于已有的统计数据; 同一组 label 不能再调用 With
+func (cv *CounterVec) Func(f func() float64, values ...string) {
+	cv.get(values, func() *series { return &series{value: f} })
+}
+
+type Gauge struct {
+	v int64
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+type GaugeVec struct {
+	*family
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newFamily(name, help, typeGauge, labels)}
+}
+
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	s := gv.get(values, func() *series {
+		g := &Gauge{}
+		return &series{obj: g, value: func() float64 { return float64(g.Value()) }}
+	})
+	return s.obj.(*Gauge)
+}
+
+func (gv *GaugeVec) Func(f func() float64, values ...string) {
+	gv.get(values, func() *series { return &series{value: f} })
+}
+
+// NewGaugeFunc 不带 label, 由 f 提供取值
+func NewGaugeFunc(name, help string, f func() float64) *GaugeVec {
+	gv := NewGaugeVec(name, help)
+	gv.Func(f)
+	return gv
+}
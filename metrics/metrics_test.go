@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	cv := NewCounterVec("test_requests_total", "Requests.", "method", "code")
+	gv := NewGaugeVec("test_in_flight", "In flight.", "method")
+	hv := NewHistogramVec("test_duration_seconds", "Latency.", []float64{0.1, 1}, "method")
+	empty := NewCounterVec("test_empty_total", "Never used.", "method")
+	r.MustRegister(cv, gv, hv, empty)
+
+	cv.With("Foo.Sum", "ok").Add(2)
+	cv.With("Foo.Sum", "ok").Inc()
+	cv.With("Foo.\"Bad\"", "unknown").Inc()
+	gv.With("Foo.Sum").Inc()
+	gv.With("Foo.Sum").Inc()
+	gv.With("Foo.Sum").Dec()
+	h := hv.With("Foo.Sum")
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{method="Foo.\"Bad\"",code="unknown"} 1
+test_requests_total{method="Foo.Sum",code="ok"} 3
+# HELP test_in_flight In flight.
+# TYPE test_in_flight gauge
+test_in_flight{method="Foo.Sum"} 1
+# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{method="Foo.Sum",le="0.1"} 1
+test_duration_seconds_bucket{method="Foo.Sum",le="1"} 2
+test_duration_seconds_bucket{method="Foo.Sum",le="+Inf"} 3
+test_duration_seconds_sum{method="Foo.Sum"} 5.55
+test_duration_seconds_count{method="Foo.Sum"} 3
+`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestFunc(t *testing.T) {
+	r := NewRegistry()
+	n := 7.0
+	r.MustRegister(NewGaugeFunc("test_open", "Open.", func() float64 { return n }))
+
+	var buf bytes.Buffer
+	_, _ = r.WriteTo(&buf)
+	if !strings.Contains(buf.String(), "\ntest_open 7\n") {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestDelete(t *testing.T) {
+	r := NewRegistry()
+	gv := NewGaugeVec("test_state", "State.", "endpoint")
+	r.MustRegister(gv)
+	gv.With("a").Set(1)
+	gv.With("b").Set(2)
+	gv.Delete("a")
+
+	var buf bytes.Buffer
+	_, _ = r.WriteTo(&buf)
+	if strings.Contains(buf.String(), `endpoint="a"`) || !strings.Contains(buf.String(), `test_state{endpoint="b"} 2`) {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
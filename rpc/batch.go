@@ -0,0 +1,154 @@
+package rpc
+
+/*
+ * 批量调用, 一帧带多条普通调用, 见 lcode.FlagBatch
+ *   请求: 外层头带 TraceId/Traceparent/Meta, 每条的 ServiceMethod 和参数在 body 中, Seq 为序号
+ *   各条在单独的 goroutine 中放入工作协程的队列, 不阻塞连接的读取, 并行处理, 共用一个整体期限
+ *   响应: 全部完成后一次返回, 每条带各自的 Code/Error 和结果
+ * */
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+)
+
+const (
+	// BatchServiceMethod 批量帧外层的 ServiceMethod
+	BatchServiceMethod = "lrpc.Batch"
+
+	// MetaBatchTimeout 客户端的整体超时, 毫秒, 超过连接的处理超时时不生效
+	MetaBatchTimeout = "lrpc-batch-timeout"
+
+	// DefaultMaxBatch Limits.MaxBatch 为 0 时单个批量调用的最大条数
+	DefaultMaxBatch = 256
+)
+
+type batch struct {
+	h        *lcode.Header
+	deadline time.Time
+	headers  []*lcode.Header
+	replies  []interface{} // 出错的条目为空
+	left     int32
+}
+
+func (c *Conn) handleBatch(h *lcode.Header, body []byte) {
+	fun := "Conn.handleBatch"
+	max := c.limits.MaxBatch
+	if max == 0 {
+		max = DefaultMaxBatch
+	}
+	msgs, err := lcode.UnpackBatch(body)
+	if err != nil {
+		err = lcode.Errorf(lcode.CodeInvalidRequest, "rpc server: %v", err)
+	} else if max > 0 && len(msgs) > max {
+		err = lcode.Errorf(lcode.CodeResourceExhausted, "rpc server: batch size %d exceeds %d", len(msgs), max)
+	}
+	if err != nil {
+		log.Errorf(h.TraceId, "%s failed err:%v", fun, err)
+		h.Code = lcode.ErrorCode(err)
+		h.Error = lcode.ErrorDesc(err)
+		_ = c.push(&response{h: h})
+		return
+	}
+
+	timeout := c.opt.HandleTimeout
+	if ms, _ := strconv.Atoi(h.Meta[MetaBatchTimeout]); ms > 0 && time.Duration(ms)*time.Millisecond < timeout {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	b := &batch{
+		h:        h,
+		deadline: time.Now().Add(timeout),
+		headers:  make([]*lcode.Header, len(msgs)),
+		replies:  make([]interface{}, len(msgs)),
+		left:     int32(len(msgs)),
+	}
+	if len(msgs) == 0 {
+		b.reply(c)
+		return
+	}
+
+	go c.enqueueBatch(b, msgs)
+}
+
+// enqueueBatch 队列满时等待, 连接关闭后放弃剩余的条目
+func (c *Conn) enqueueBatch(b *batch, msgs []*lcode.Message) {
+	fun := "Conn.enqueueBatch"
+	h := b.h
+	for i, m := range msgs {
+		eh := &lcode.Header{
+			ServiceMethod: m.H.ServiceMethod,
+			Seq:           uint64(i),
+			TraceId:       h.TraceId,
+			Traceparent:   h.Traceparent,
+			Meta:          h.Meta,
+		}
+		req, err := c.s.newRequest(eh, func(argv interface{}) error {
+			return c.Decode(m.B, argv)
+		})
+		if err != nil {
+			log.Errorf(h.TraceId, "%s entry:%d serviceMethod:%s err:%v", fun, i, eh.ServiceMethod, err)
+			b.done(c, &request{h: eh}, err)
+			continue
+		}
+		req.batch = b
+		select {
+		case c.reqChan <- req:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// done 每条结束时调用, 最后一条结束后发送合并的响应
+func (b *batch) done(c *Conn, req *request, err error) {
+	h := &lcode.Header{Seq: req.h.Seq}
+	if err != nil {
+		h.Code = lcode.ErrorCode(err)
+		h.Error = lcode.ErrorDesc(err)
+	} else {
+		b.replies[h.Seq] = req.replyv.Interface()
+	}
+	b.headers[h.Seq] = h
+
+	if atomic.AddInt32(&b.left, -1) == 0 {
+		b.reply(c)
+	}
+}
+
+func (b *batch) reply(c *Conn) {
+	_ = c.push(&response{
+		h: &lcode.Header{
+			ServiceMethod: b.h.ServiceMethod,
+			Seq:           b.h.Seq,
+			TraceId:       b.h.TraceId,
+			Flag:          lcode.FlagBatch,
+		},
+		batch: b,
+	})
+}
+
+// pack 在写协程中调用, 打包失败时各条都返回错误
+func (b *batch) pack(c *Conn) []byte {
+	msgs := make([]*lcode.Message, len(b.headers))
+	for i, h := range b.headers {
+		msgs[i] = &lcode.Message{H: h}
+		if b.replies[i] != nil {
+			msgs[i].B = c.Encode(b.replies[i])
+		}
+	}
+	payload, err := lcode.PackBatch(msgs)
+	if err != nil {
+		log.Errorf(b.h.TraceId, "Conn.handleBatch pack results failed err:%v", err)
+		for _, m := range msgs {
+			m.H.Code = lcode.CodeUnknown
+			m.H.Error = err.Error()
+			m.B = nil
+		}
+		payload, _ = lcode.PackBatch(msgs)
+	}
+	return payload
+}
@@ -0,0 +1,109 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+type Sleeper struct{}
+
+// Sleep 等待 Num1 毫秒
+func (s *Sleeper) Sleep(args models.Args, reply *models.Reply) error {
+	time.Sleep(time.Duration(args.Num1) * time.Millisecond)
+	reply.Num = args.Num1
+	return nil
+}
+
+func TestBatch(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var foo models.Foo
+	_ = s.Register(&foo)
+	_ = s.Register(&Sleeper{})
+	s.SetLimits(rpc.Limits{MaxBatch: 8})
+	ln, _ := transport.ListenMem("batch")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	c, err := client.XDial("mem@batch", &rpc.Option{HandleTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	ctx := context.NewContext(gctx.Background())
+
+	// 每条有各自的结果和错误码, 超过整体期限的返回 deadline exceeded
+	b := c.Batch()
+	sums := make([]*models.Reply, 3)
+	for i := range sums {
+		sums[i] = &models.Reply{}
+		b.Add("Foo.Sum", &models.Args{Num1: i, Num2: 10}, sums[i])
+	}
+	missing := b.Add("Foo.Missing", &models.Args{}, &models.Reply{})
+	var fast, slow models.Reply
+	fastCall := b.Add("Sleeper.Sleep", &models.Args{Num1: 10}, &fast)
+	slowCall := b.Add("Sleeper.Sleep", &models.Args{Num1: 1000}, &slow)
+	err = b.Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range sums {
+		if r.Num != i+10 {
+			t.Fatalf("entry %d expect %d, got %d", i, i+10, r.Num)
+		}
+	}
+	if lcode.ErrorCode(missing.Error) != lcode.CodeNotFound {
+		t.Fatalf("expect not found, got %v", missing.Error)
+	}
+	if fastCall.Error != nil || fast.Num != 10 {
+		t.Fatalf("expect 10, got %d err:%v", fast.Num, fastCall.Error)
+	}
+	if lcode.ErrorCode(slowCall.Error) != lcode.CodeDeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", slowCall.Error)
+	}
+
+	// 各条并行处理
+	b = c.Batch()
+	for i := 0; i < 4; i++ {
+		b.Add("Sleeper.Sleep", &models.Args{Num1: 100}, &models.Reply{})
+	}
+	start := time.Now()
+	if err = b.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Fatalf("expect entries handled in parallel, took %s", d)
+	}
+
+	// 超过条数限制时整个批量失败
+	b = c.Batch()
+	first := b.Add("Foo.Sum", &models.Args{}, &models.Reply{})
+	for i := 1; i < 9; i++ {
+		b.Add("Foo.Sum", &models.Args{Num1: i}, &models.Reply{})
+	}
+	err = b.Do(ctx)
+	if lcode.ErrorCode(err) != lcode.CodeResourceExhausted {
+		t.Fatalf("expect resource exhausted, got %v", err)
+	}
+	if lcode.ErrorCode(first.Error) != lcode.CodeResourceExhausted {
+		t.Fatalf("expect entry error set, got %v", first.Error)
+	}
+
+	if err = c.Batch().Do(ctx); err != nil {
+		t.Fatalf("expect empty batch ok, got %v", err)
+	}
+	var r models.Reply
+	err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 1, Num2: 2}, &r)
+	if err != nil || r.Num != 3 {
+		t.Fatalf("expect 3, got %d err:%v", r.Num, err)
+	}
+}
@@ -4,21 +4,23 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	goproto "github.com/gogo/protobuf/proto"
 	"github.com/golang/protobuf/proto"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/zulong210220/lrpc/auth"
 	"github.com/zulong210220/lrpc/consts"
 	"github.com/zulong210220/lrpc/lcode"
 	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/transport"
 	"github.com/zulong210220/lrpc/utils"
 )
 
@@ -38,10 +40,26 @@ type Conn struct {
 	s         *Server
 	conn      net.Conn
 	opt       *Option
-	reqChan   chan *request
-	respChan  chan *response
-	closeChan chan bool
-	die       chan struct{}
+	lc        *ListenerConfig
+	principal *auth.Principal
+	limits    *Limits
+	reason    int32 // CloseReason
+	start     time.Time
+
+	lastRead   int64 // unix nano, 最后收到数据
+	lastActive int64 // unix nano, 最后一次请求开始或结束
+	inflight   int32
+
+	smu     sync.Mutex
+	streams map[uint64]*Stream
+
+	rmu    sync.Mutex
+	rseq   uint64
+	rcalls map[uint64]*reverseCall // 反向调用
+
+	reqChan  chan *request
+	respChan chan *response
+	done     chan struct{} // CloseWithReason 时关闭, 发送方都需要同时等待它
 }
 
 const (
@@ -52,16 +70,40 @@ const (
 )
 
 func NewConn(s *Server, conn net.Conn) *Conn {
+	return newConn(s, conn, nil)
+}
+
+func newConn(s *Server, conn net.Conn, lc *ListenerConfig) *Conn {
+	if lc == nil {
+		lc = &ListenerConfig{}
+	}
+	workerNum := DefaultHandlerNumber
+	if lc.HandlerNumber > 0 {
+		workerNum = lc.HandlerNumber
+	}
+	limits := lc.Limits
+	if limits == nil {
+		limits = &s.limits
+	}
+	now := time.Now()
 	return &Conn{
 		state:     StateRunninng,
 		fd:        socketFD(conn),
-		workerNum: DefaultHandlerNumber,
+		workerNum: workerNum,
 		s:         s,
 		conn:      conn,
-		reqChan:   make(chan *request, 64),
-		respChan:  make(chan *response, 64),
-		closeChan: make(chan bool, 64),
-		die:       make(chan struct{}),
+		lc:        lc,
+		limits:    limits,
+		start:     now,
+
+		lastRead:   now.UnixNano(),
+		lastActive: now.UnixNano(),
+
+		streams:  make(map[uint64]*Stream),
+		rcalls:   make(map[uint64]*reverseCall),
+		reqChan:  make(chan *request, 64),
+		respChan: make(chan *response, 64),
+		done:     make(chan struct{}),
 	}
 }
 
@@ -86,7 +128,7 @@ func PutBuffer(buffer *bytes.Buffer) {
 }
 
 func (c *Conn) Serve() {
-	fun := "Conn.Serve"
+	//fun := "Conn.Serve"
 	//defer func() {
 	//	err := c.conn.Close()
 	//	if err != nil {
@@ -95,57 +137,76 @@ func (c *Conn) Serve() {
 	//}()
 	//data, err := ioutil.ReadAll(conn)
 
+	c.s.stats.onOpen()
+
 	err := c.preHandle()
 	if err != nil {
+		c.closeReason(CloseHandshake)
+		c.s.stats.onClose(CloseHandshake)
 		return
 	}
+	c.s.conns.Store(c, struct{}{})
 
-	f := lcode.NewCodecFuncMap[c.opt.CodecType]
-	if f == false {
-		log.Errorf("", "%s rpc server invalid codec type %s", fun, c.opt.CodecType)
-		return
-	}
 	c.startWorkers()
-	go c.close()
+	go c.keepalive()
 	c.serveCodec()
 
 }
 
 func (c *Conn) preHandle() error {
 	fun := "Server.preHandle"
-	var data = make([]byte, 2)
-	n, err := c.conn.Read(data)
+
+	_ = c.conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	opt := &Option{}
+	err := ReadHandshake(c.conn, opt)
 	if err != nil {
-		log.Errorf("", "%s rpc server read failed %v", fun, err)
+		log.Errorf("", "%s rpc server read option failed %v", fun, err)
+		_ = c.conn.Close()
 		return err
 	}
 
-	total := binary.BigEndian.Uint16(data)
-	data = make([]byte, total)
-	n, err = c.conn.Read(data)
-	if err != nil {
-		log.Errorf("", "%s rpc server read failed %v", fun, err)
-		return err
+	// also block
+
+	if opt.CodecType == "" {
+		opt.CodecType = c.lc.CodecType
+	}
+	if opt.CodecType == "" {
+		opt.CodecType = DefaultOption.CodecType
 	}
 
-	if uint16(n) != total {
-		log.Warningf("ne", "%s rpc server read n:%d total:%d", fun, n, total)
+	if opt.MagicNumber != MagicNumber {
+		log.Errorf("", "%s rpc server invalid magic number %x", fun, opt.MagicNumber)
+		err = lcode.NewError(lcode.CodeInvalidRequest, "invalid magic number")
+	} else if !lcode.NewCodecFuncMap[opt.CodecType] {
+		log.Errorf("", "%s rpc server invalid codec type %s", fun, opt.CodecType)
+		err = lcode.Errorf(lcode.CodeInvalidRequest, "invalid codec type %s", opt.CodecType)
+	} else {
+		err = c.authenticate(opt)
 	}
 
-	opt := &Option{}
-	err = jsoniter.Unmarshal(data, opt)
+	if opt.Version >= HandshakeVersion {
+		reply := &HandshakeReply{CodecType: opt.CodecType}
+		if err != nil {
+			reply.Code = lcode.ErrorCode(err)
+			reply.Error = lcode.ErrorDesc(err)
+		}
+		werr := WriteHandshake(c.conn, reply)
+		if werr != nil {
+			log.Errorf("", "%s rpc server write handshake reply failed %v", fun, werr)
+			if err == nil {
+				err = werr
+			}
+		}
+	}
 	if err != nil {
-		log.Errorf("UnpackHeader", " Unmarshal Option failed err:%v", err)
+		_ = c.conn.Close()
 		return err
 	}
+	_ = c.conn.SetDeadline(time.Time{})
 
-	// also block
-
-	if opt.MagicNumber != MagicNumber {
-		log.Errorf("", "%s rpc server invalid magic number %x", fun, opt.MagicNumber)
-		return errors.New("Invalid MagicNumber")
+	if opt.HandleTimeout == 0 {
+		opt.HandleTimeout = c.lc.HandleTimeout
 	}
-
 	if opt.HandleTimeout == 0 {
 		opt.HandleTimeout = 3 * time.Second
 	}
@@ -160,30 +221,65 @@ func (c *Conn) serveCodec() {
 	//fun := "Server.serveCodec"
 	for {
 		select {
-		case <-c.closeChan:
+		case <-c.done:
 			return
 		default:
 			// wait 偶尔阻塞在此
 			req, err := c.readRequest()
+			if err == errWaitTimeout {
+				if r := c.waitExpired(); r != CloseNone {
+					c.CloseWithReason(r)
+					return
+				}
+				continue
+			}
 			if err != nil {
 				// close conn
-				c.Close()
+				switch {
+				case err == errFrameTimeout:
+					c.CloseWithReason(CloseReadTimeout)
+				case err == transport.ErrBufferFull:
+					c.CloseWithReason(CloseLimit)
+				case req.h == nil:
+					c.CloseWithReason(ClosePeer)
+				default:
+					c.CloseWithReason(CloseProtocol)
+				}
+				return
+			}
+			if req.h.Is(lcode.FlagPing | lcode.FlagPong) {
+				c.handleControl(req.h)
+				continue
+			}
+			if req.h.Is(lcode.FlagStream) {
+				c.handleStream(req.h, req.body)
+				continue
+			}
+			if req.h.Is(lcode.FlagReverse) {
+				c.handleReverse(req.h, req.body)
+				continue
+			}
+			if req.h.Is(lcode.FlagBatch) {
+				c.handleBatch(req.h, req.body)
+				continue
+			}
+			select {
+			case c.reqChan <- req:
+			case <-c.done:
 				return
-				//req.h.Error = err.Error()
-				////c.sendResponse(req.h, invalidRequest, sending)
-				//resp := &response{
-				//	h:    req.h,
-				//	body: invalidRequest,
-				//}
-				//c.respChan <- resp
-				//continue
 			}
-			c.reqChan <- req
 			//go c.handleRequest(req, sending, wg, c.opt.HandleTimeout)
 		}
 	}
 }
 
+// handleControl 对端的ping需要回pong, pong只用于刷新 lastRead
+func (c *Conn) handleControl(h *lcode.Header) {
+	if h.Is(lcode.FlagPing) {
+		_ = c.push(&response{h: &lcode.Header{Seq: h.Seq, Flag: lcode.FlagPong}})
+	}
+}
+
 func (c *Conn) startWorkers() {
 	for i := 0; i < c.workerNum; i++ {
 		go c.loopHandleRequest(i + 1)
@@ -195,95 +291,94 @@ func (c *Conn) startWorkers() {
 func (c *Conn) loopHandleRequest(i int) {
 	for {
 		select {
-		case <-c.closeChan:
+		case <-c.done:
 			return
 		case req := <-c.reqChan:
-			if req == nil {
-				return
-			}
 			c.handleSingleRequest(req)
 		}
 	}
 }
 
 func (c *Conn) handleSingleRequest(req *request) {
-	called := make(chan struct{})
-	send := make(chan struct{})
+	atomic.AddInt32(&c.inflight, 1)
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	defer func() {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+		atomic.AddInt32(&c.inflight, -1)
+	}()
 
-	resp := &response{}
+	info := &CallInfo{
+		Header:    req.h,
+		Peer:      c.conn.RemoteAddr().String(),
+		Principal: c.principal,
+		Transport: TransportLrpc,
+		conn:      c,
+	}
 	timeout := c.opt.HandleTimeout
+	if req.batch != nil {
+		timeout = time.Until(req.batch.deadline)
+	}
+	var err error
+	if timeout > 0 {
+		err = c.s.invoke(info, req, timeout)
+	} else {
+		// 批量调用在队列中已经超过整体期限
+		err = lcode.NewError(lcode.CodeDeadlineExceeded, "rpc server: batch deadline exceeded")
+	}
+	if req.batch != nil {
+		req.batch.done(c, req, err)
+		return
+	}
 
-	go func() {
-		// 此处真正执行代码逻辑
-		err := req.svc.call(req.mType, req.argv, req.replyv)
-		called <- struct{}{}
+	resp := &response{h: req.h}
+	if req.h.Is(lcode.FlagOneway) {
+		// 单向调用不响应, 错误只记录日志
 		if err != nil {
-			req.h.Error = err.Error()
-
-			resp.h = req.h
-			resp.body = invalidRequest
-
-			c.respChan <- resp
-			send <- struct{}{}
-			return
+			log.Errorf(req.h.TraceId, "Conn.handleSingleRequest oneway serviceMethod:%s failed err:%v", req.h.ServiceMethod, err)
 		}
-		resp.h = req.h
+		return
+	}
+	if err != nil {
+		resp.body = invalidRequest
+	} else {
 		resp.body = req.replyv.Interface()
+	}
+	_ = c.push(resp)
+}
 
-		c.respChan <- resp
-		send <- struct{}{}
-	}()
-
-	/*
-		if timeout == 0 {
-			<-called
-			<-send
-			return
-		}
-	*/
-
-	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout %s", timeout)
-		resp.h = req.h
-		resp.body = req.replyv.Interface()
-		c.respChan <- resp
-	case <-called:
-		<-send
+func (c *Conn) writeResponse(resp *response) {
+	fun := "Server.sendResponse"
+	var err error
+	if resp.batch != nil {
+		err = c.writeEncoded(resp.h, resp.batch.pack(c))
+	} else {
+		err = c.Write(resp.h, resp.body)
+	}
+	if err != nil {
+		log.Errorf(resp.h.TraceId, "%s rpc server write response failed error:%v", fun, err)
 	}
 }
 
+// handleResponse 唯一的写协程, 连接关闭后写完已排队的响应再关闭socket
 func (c *Conn) handleResponse() {
-	fun := "Server.sendResponse"
 	for {
 		select {
-		case <-c.closeChan:
+		case <-c.done:
 			goto clear
 		case resp := <-c.respChan:
-			if resp == nil {
-				break
-			}
-
-			traceId := resp.h.TraceId
-			err := c.Write(resp.h, resp.body)
-			if err != nil {
-				log.Errorf(traceId, "%s rpc server write response failed error:%v", fun, err)
-			}
+			c.writeResponse(resp)
 		}
 	}
 
 clear:
-	c.respChan <- nil
-	for resp := range c.respChan {
-		if resp == nil {
-			break
-		}
-
-		traceId := resp.h.TraceId
-		err := c.Write(resp.h, resp.body)
-		if err != nil {
-			log.Errorf(traceId, "%s rpc server write response failed error:%v", fun, err)
+	for {
+		select {
+		case resp := <-c.respChan:
+			c.writeResponse(resp)
+			continue
+		default:
 		}
+		break
 	}
 	err := c.conn.Close()
 	if err != nil {
@@ -321,15 +416,26 @@ func (c *Conn) serveCodec0() {
 func (c *Conn) Read(msg *lcode.Message) error {
 	fun := "Conn.Read"
 	var data = make([]byte, 4)
-	n, err := c.conn.Read(data)
+
+	_ = c.conn.SetReadDeadline(c.waitDeadline())
+	n, err := io.ReadFull(c.conn, data)
 	if err != nil {
+		if n == 0 && isTimeout(err) {
+			return errWaitTimeout
+		}
 		log.Errorf("CR", "%s connection total n:%d failed err:%v", fun, n, err)
-		if err == io.EOF {
-			// TODO
-			return err
+		if isTimeout(err) {
+			return errFrameTimeout
 		}
 		return err
 	}
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+
+	if c.limits.ReadTimeout > 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.limits.ReadTimeout))
+	} else {
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
 
 	total := binary.BigEndian.Uint32(data)
 
@@ -345,15 +451,18 @@ func (c *Conn) Read(msg *lcode.Message) error {
 		defer limitedPool.Put(bb)
 	}
 
-	n, err = c.conn.Read(data)
+	n, err = io.ReadFull(c.conn, data)
 	if err != nil {
 		log.Errorf("JCR", "%s connection data n:%d failed err:%v", fun, n, err)
-		if err == io.EOF {
-			// TODO
-			return err
+		if isTimeout(err) {
+			return errFrameTimeout
 		}
+		return err
 	}
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	c.s.metrics.bytesIn.Add(uint64(4 + total))
 
+	msg.Version = c.opt.Version
 	err = msg.Unpack(data)
 
 	return err
@@ -372,7 +481,21 @@ func (c *Conn) readRequest() (*request, error) {
 	traceId := msg.H.TraceId
 
 	req.h = msg.H
-	req.svc, req.mType, err = c.s.findService(msg.H.ServiceMethod)
+	if msg.H.Is(lcode.FlagPing | lcode.FlagPong) {
+		return req, nil
+	}
+	if msg.H.Is(lcode.FlagStream) {
+		// 消息在 Stream.Recv 时才解码
+		req.body = msg.B
+		return req, nil
+	}
+	if msg.H.Is(lcode.FlagReverse | lcode.FlagBatch) {
+		// 反向调用的响应或批量调用, 分别由 handleReverse/handleBatch 解码
+		req.body = msg.B
+		return req, nil
+	}
+
+	req.svc, req.mType, err = c.s.findMethod(msg.H.ServiceMethod, false)
 	if err != nil {
 		log.Errorf(traceId, "%s findService failed serviceMethod:%s err:%v", fun, msg.H.ServiceMethod, err)
 		return req, err
@@ -469,11 +592,12 @@ func (c *Conn) Encode(body interface{}) []byte {
 	case lcode.GobType:
 		buffer = GetBuffer()
 		err = gob.NewEncoder(buffer).Encode(body)
-		bs = buffer.Bytes()
+		// buffer 归还后会被其它连接复用, 需要复制
+		bs = append([]byte(nil), buffer.Bytes()...)
 	case lcode.JsonType:
 		buffer = GetBuffer()
 		err = jsoniter.NewEncoder(buffer).Encode(body)
-		bs = buffer.Bytes()
+		bs = append([]byte(nil), buffer.Bytes()...)
 	case lcode.ProtoType:
 		bs, err = proto.Marshal(body.(lcode.IMessage))
 	case lcode.GoProtoType:
@@ -490,20 +614,29 @@ func (c *Conn) Encode(body interface{}) []byte {
 	return bs
 }
 
-func (c *Conn) Write(h *lcode.Header, body interface{}) (err error) {
+func (c *Conn) Write(h *lcode.Header, body interface{}) error {
+	// 控制帧没有body
+	var bs []byte
+	if body != nil {
+		bs = c.Encode(body)
+	}
+	return c.writeEncoded(h, bs)
+}
+
+// writeEncoded bs 为已编码的 body
+func (c *Conn) writeEncoded(h *lcode.Header, bs []byte) (err error) {
 	fun := "Conn.Write"
 	defer func() {
 		if err != nil {
-			c.Close()
+			c.CloseWithReason(CloseWriteError)
 		}
 	}()
 
-	bs := c.Encode(body)
-
 	var n int
 	msg := &lcode.Message{}
 	msg.H = h
 	msg.B = bs
+	msg.Version = c.opt.Version
 	traceId := h.TraceId
 
 	bs, err = msg.Pack()
@@ -518,8 +651,13 @@ func (c *Conn) Write(h *lcode.Header, body interface{}) (err error) {
 		return
 	}
 
+	// 写入连接后再归还
+	defer PutBuffer(dataBuf)
 	tbs := dataBuf.Bytes()
-	PutBuffer(dataBuf)
+
+	if c.limits.WriteTimeout > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.limits.WriteTimeout))
+	}
 
 	n, err = c.conn.Write(tbs)
 	if err != nil {
@@ -530,43 +668,52 @@ func (c *Conn) Write(h *lcode.Header, body interface{}) (err error) {
 	n, err = c.conn.Write(bs)
 	if err != nil {
 		log.Errorf(traceId, "%s rpc codec: json error write : %d buffer :%v", fun, n, err)
+		return
 	}
+	c.s.metrics.bytesOut.Add(uint64(len(tbs) + len(bs)))
 
 	return
 }
 
 func (c *Conn) Close() {
-	if atomic.LoadInt32(&c.state) == StateClosed {
-		return
-	}
-
-	atomic.StoreInt32(&c.state, StateClosed)
-	c.die <- struct{}{}
+	c.CloseWithReason(ClosePeer)
 }
 
-func (c *Conn) close() {
-	<-c.die
-	// 假定开启的goroutine不会超过65535
-	for i := 0; i < 64; i++ {
-		c.closeChan <- true
+// closeReason 只记录第一次关闭的原因
+func (c *Conn) closeReason(r CloseReason) bool {
+	if !atomic.CompareAndSwapInt32(&c.state, StateRunninng, StateClosed) {
+		return false
 	}
+	atomic.StoreInt32(&c.reason, int32(r))
+	return true
+}
 
-	time.Sleep(3 * time.Second)
-	close(c.respChan)
-	close(c.reqChan)
-	close(c.closeChan)
-	close(c.die)
+func (c *Conn) CloseWithReason(r CloseReason) {
+	if !c.closeReason(r) {
+		return
+	}
+	close(c.done)
+	c.s.conns.Delete(c)
+	c.s.stats.onClose(r)
+	c.abortStreams()
+	c.failReverse()
+	log.Infof("", "Conn:%d remote:%s closed reason:%s", c.fd, c.conn.RemoteAddr(), r)
 }
 
+// socketFD 非系统socket(如内存连接)返回-1
 func socketFD(conn net.Conn) int {
-	//tls := reflect.TypeOf(conn.UnderlyingConn()) == reflect.TypeOf(&tls.Conn{})
-	// Extract the file descriptor associated with the connection
-	//connVal := reflect.Indirect(reflect.ValueOf(conn)).FieldByName("conn").Elem()
-	tcpConn := reflect.Indirect(reflect.ValueOf(conn)).FieldByName("conn")
-	//if tls {
-	//	tcpConn = reflect.Indirect(tcpConn.Elem())
-	//}
-	fdVal := tcpConn.FieldByName("fd")
-	pfdVal := reflect.Indirect(fdVal).FieldByName("pfd")
-	return int(pfdVal.FieldByName("Sysfd").Int())
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1
+	}
+
+	fd := -1
+	_ = raw.Control(func(f uintptr) {
+		fd = int(f)
+	})
+	return fd
 }
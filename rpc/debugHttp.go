@@ -8,28 +8,110 @@ package rpc
  * */
 
 import (
+	"encoding/json"
 	"fmt"
+	"html/template"
 	"net/http"
-	"text/template"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 const debugText = `<html>
+	<head>
+	<title>lrpc {{.Name}}</title>
+	<style>
+	body { font-family: sans-serif; font-size: 13px; }
+	table { border-collapse: collapse; margin-bottom: 8px; }
+	th, td { border: 1px solid #ccc; padding: 2px 8px; }
+	th { background: #eee; }
+	td.num { text-align: right; font-family: monospace; }
+	</style>
+	</head>
 	<body>
-	<title>GeeRPC Services</title>
-	{{range .}}
-	<hr>
-	Service {{.Name}}
-	<hr>
+	<h3>lrpc {{.Name}}</h3>
+	started {{.Start.Format "2006-01-02 15:04:05"}}, up {{.Uptime}}, <a href="/debug/_lrpc_/json">json</a>
+
+	<h4>Listeners</h4>
+	<table>
+	<tr><th>Endpoint</th><th>Codec</th><th>HandleTimeout</th><th>Handlers</th><th>Limits</th></tr>
+	{{range .Listeners}}
+		<tr><td>{{.Endpoint}}</td><td>{{.CodecType}}</td><td>{{.HandleTimeout}}</td><td class=num>{{.HandlerNumber}}</td><td>{{printf "%+v" .Limits}}</td></tr>
+	{{end}}
+	</table>
+
+	<h4>Registry</h4>
+	<table>
+	<tr><td>enabled</td><td>{{.Registry.Enabled}}</td></tr>
+	{{if .Registry.Enabled}}
+	<tr><td>etcd</td><td>{{.Registry.EtcdAddr}}</td></tr>
+	<tr><td>lease</td><td>{{printf "%x" .Registry.LeaseID}}</td></tr>
+	<tr><td>last keepalive</td><td>{{if .Registry.LastKeepAlive.IsZero}}never{{else}}{{.Registry.LastKeepAlive.Format "15:04:05"}}{{end}}</td></tr>
+	{{range .Registry.Keys}}<tr><td>key</td><td>{{.}}</td></tr>{{end}}
+	{{end}}
+	</table>
+
+	<h4>Services</h4>
+	{{range .Services}}
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
-		{{range $name, $mtype := .Method}}
+		<tr><th>{{.Name}}</th><th>Calls</th><th>Oneway</th><th>Errors</th><th>p50</th><th>p90</th><th>p99</th><th>max</th></tr>
+		{{range .Methods}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
-			<td align=center>{{$mtype.NumCalls}}</td>
+			<td>{{.Name}}({{.ArgType}}{{if not .Stream}}, {{.ReplyType}}{{end}}) error</td>
+			<td class=num>{{.Calls}}</td>
+			<td class=num>{{.Oneway}}</td>
+			<td class=num>{{.Errors}}</td>
+			<td class=num>{{.Latency.P50}}</td>
+			<td class=num>{{.Latency.P90}}</td>
+			<td class=num>{{.Latency.P99}}</td>
+			<td class=num>{{.Latency.Max}}</td>
 			</tr>
+			{{range .RecentErrors}}
+			<tr><td colspan=8>&nbsp;&nbsp;{{.Time.Format "15:04:05.000"}} [{{.TraceId}}] {{.Code}}: {{.Error}}</td></tr>
+			{{end}}
 		{{end}}
 		</table>
 	{{end}}
+
+	<h4>Connections</h4>
+	<table>
+	<tr><td>open</td><td class=num>{{.Conns.Open}}</td></tr>
+	<tr><td>accepted</td><td class=num>{{.Conns.Accepted}}</td></tr>
+	{{range .Conns.Closed}}
+		<tr><td>closed {{.Reason}}</td><td class=num>{{.Count}}</td></tr>
+	{{end}}
+	</table>
+	<table>
+	<tr><th>Remote</th><th>Local</th><th>Codec</th><th>Principal</th><th>Age</th><th>Idle</th><th>InFlight</th></tr>
+	{{range .Connections}}
+		<tr><td>{{.Remote}}</td><td>{{.Local}}</td><td>{{.CodecType}}</td><td>{{.Principal}}</td><td class=num>{{.Age}}</td><td class=num>{{.Idle}}</td><td class=num>{{.InFlight}}</td></tr>
+	{{end}}
+	</table>
+
+	<h4>In-flight requests</h4>
+	<table>
+	<tr><th>Method</th><th>TraceId</th><th>Seq</th><th>Peer</th><th>Principal</th><th>Elapsed</th></tr>
+	{{range .InFlight}}
+		<tr><td>{{.Method}}</td><td>{{.TraceId}}</td><td class=num>{{.Seq}}</td><td>{{.Peer}}</td><td>{{.Principal}}</td><td class=num>{{.Elapsed}}</td></tr>
+	{{end}}
+	</table>
+
+	<h4>Slow requests</h4>
+	<table>
+	<tr><th>Start</th><th>Method</th><th>TraceId</th><th>Peer</th><th>Elapsed</th><th>Code</th><th>Header</th></tr>
+	{{range .Slow}}
+		<tr><td>{{.Start.Format "15:04:05.000"}}</td><td>{{.Method}}</td><td>{{.TraceId}}</td><td>{{.Peer}}</td><td class=num>{{.Elapsed}}</td><td>{{.Code}}</td><td>{{printf "%+v" .Header}}</td></tr>
+	{{end}}
+	</table>
+
+	<h4>Failed requests</h4>
+	<table>
+	<tr><th>Start</th><th>Method</th><th>TraceId</th><th>Peer</th><th>Elapsed</th><th>Code</th><th>Error</th></tr>
+	{{range .Failed}}
+		<tr><td>{{.Start.Format "15:04:05.000"}}</td><td>{{.Method}}</td><td>{{.TraceId}}</td><td>{{.Peer}}</td><td class=num>{{.Elapsed}}</td><td>{{.Code}}</td><td>{{.Error}}</td></tr>
+	{{end}}
+	</table>
 	</body>
 	</html>`
 
@@ -39,26 +121,234 @@ type debugHTTP struct {
 	*Server
 }
 
-type debugService struct {
-	Name   string
-	Method map[string]*methodType
+// debugJSON 与调试页面相同的数据, 方便脚本和告警系统使用
+type debugJSON struct {
+	*Server
 }
 
-func (s debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// Build a sorted version of the data.
-	var services []debugService
-	s.serviceMap.Range(func(namei, svci interface{}) bool {
-		svc := svci.(*service)
-		services = append(services, debugService{
-			Name:   namei.(string),
-			Method: svc.method,
+type DebugInfo struct {
+	Name        string
+	Start       time.Time
+	Uptime      Duration
+	Config      *Config
+	Limits      Limits
+	Listeners   []ListenerInfo
+	Registry    RegistryInfo
+	Services    []ServiceInfo
+	Conns       ConnStats
+	Connections []ConnInfo
+	InFlight    []InFlightRequest
+	Slow        []RequestRecord
+	Failed      []RequestRecord
+}
+
+// Duration json 输出为可读的字符串
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var str string
+	err := json.Unmarshal(b, &str)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type ListenerInfo struct {
+	Endpoint      string
+	CodecType     string
+	HandleTimeout Duration
+	HandlerNumber int
+	Limits        *Limits
+}
+
+type RegistryInfo struct {
+	Enabled       bool
+	EtcdAddr      []string
+	LeaseID       int64
+	LastKeepAlive time.Time
+	Keys          []string
+}
+
+type ServiceInfo struct {
+	Name    string
+	Methods []MethodInfo
+}
+
+type MethodInfo struct {
+	Name         string
+	ArgType      string
+	ReplyType    string // 流式方法为空
+	Stream       bool
+	Calls        uint64
+	Oneway       uint64 // Calls 中的单向调用
+	Errors       uint64
+	Latency      LatencyInfo
+	RecentErrors []ErrorRecord
+}
+
+type LatencyInfo struct {
+	Samples int
+	P50     Duration
+	P90     Duration
+	P99     Duration
+	Max     Duration
+}
+
+type ConnInfo struct {
+	Remote    string
+	Local     string
+	CodecType string
+	Principal string
+	Start     time.Time
+	Age       Duration
+	Idle      Duration
+	InFlight  int32
+}
+
+// DebugInfo 当前服务状态的快照
+func (s *Server) DebugInfo() *DebugInfo {
+	now := time.Now()
+	info := &DebugInfo{
+		Name:     s.name,
+		Start:    s.start,
+		Uptime:   Duration(now.Sub(s.start).Truncate(time.Second)),
+		Config:   s.config,
+		Limits:   s.limits,
+		Registry: s.registryInfo(),
+		Conns:    s.ConnStats(),
+		InFlight: s.InFlight(),
+		Slow:     s.SlowRequests(),
+		Failed:   s.FailedRequests(),
+	}
+
+	s.mu.Lock()
+	for _, l := range s.listeners {
+		info.Listeners = append(info.Listeners, ListenerInfo{
+			Endpoint:      l.endpoint,
+			CodecType:     string(l.cfg.CodecType),
+			HandleTimeout: Duration(l.cfg.HandleTimeout),
+			HandlerNumber: l.cfg.HandlerNumber,
+			Limits:        l.cfg.Limits,
 		})
+	}
+	s.mu.Unlock()
+
+	s.serviceMap.Range(func(namei, svci interface{}) bool {
+		info.Services = append(info.Services, serviceInfo(namei.(string), svci.(*service)))
 		return true
 	})
-	err := debug.Execute(w, services)
+	sort.Slice(info.Services, func(i, j int) bool { return info.Services[i].Name < info.Services[j].Name })
+
+	s.conns.Range(func(k, v interface{}) bool {
+		info.Connections = append(info.Connections, k.(*Conn).info(now))
+		return true
+	})
+	sort.Slice(info.Connections, func(i, j int) bool {
+		return info.Connections[i].Start.Before(info.Connections[j].Start)
+	})
+	return info
+}
+
+func (s *Server) registryInfo() RegistryInfo {
+	ri := RegistryInfo{Enabled: s.client != nil}
+	if !ri.Enabled {
+		return ri
+	}
+	if s.config != nil {
+		ri.EtcdAddr = s.config.EtcdAddr
+	}
+	ri.LeaseID = int64(s.lease())
+	if ka := atomic.LoadInt64(&s.lastKeepAlive); ka != 0 {
+		ri.LastKeepAlive = time.Unix(0, ka)
+	}
+	if ri.LeaseID != 0 {
+		for _, ep := range s.Endpoints() {
+			ri.Keys = append(ri.Keys, s.getEtcdKey(ep))
+		}
+	}
+	return ri
+}
+
+func typeString(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	return t.String()
+}
+
+func serviceInfo(name string, svc *service) ServiceInfo {
+	si := ServiceInfo{Name: name}
+	for mn, m := range svc.method {
+		errs, lat, recent := m.stats.snapshot()
+		si.Methods = append(si.Methods, MethodInfo{
+			Name:      mn,
+			ArgType:   m.ArgType.String(),
+			ReplyType: typeString(m.ReplyType),
+			Stream:    m.stream,
+			Calls:     m.NumCalls(),
+			Oneway:    m.NumOneway(),
+			Errors:    errs,
+			Latency: LatencyInfo{
+				Samples: lat.Samples,
+				P50:     Duration(lat.P50),
+				P90:     Duration(lat.P90),
+				P99:     Duration(lat.P99),
+				Max:     Duration(lat.Max),
+			},
+			RecentErrors: recent,
+		})
+	}
+	sort.Slice(si.Methods, func(i, j int) bool { return si.Methods[i].Name < si.Methods[j].Name })
+	return si
+}
+
+func (c *Conn) info(now time.Time) ConnInfo {
+	ci := ConnInfo{
+		Remote:   c.conn.RemoteAddr().String(),
+		Local:    c.conn.LocalAddr().String(),
+		Start:    c.start,
+		Age:      Duration(now.Sub(c.start).Truncate(time.Millisecond)),
+		Idle:     Duration(now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive))).Truncate(time.Millisecond)),
+		InFlight: atomic.LoadInt32(&c.inflight),
+	}
+	if c.opt != nil {
+		ci.CodecType = string(c.opt.CodecType)
+	}
+	if c.principal != nil {
+		ci.Principal = c.principal.Name
+	}
+	return ci
+}
+
+func (s debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	err := debug.Execute(w, s.DebugInfo())
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
 }
 
+func (s debugJSON) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set(headerContentType, "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(s.DebugInfo())
+	if err != nil {
+		_, _ = fmt.Fprintln(w, "rpc: error encoding debug info:", err.Error())
+	}
+}
+
 /* vim: set tabstop=4 set shiftwidth=4 */
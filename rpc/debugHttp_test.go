@@ -0,0 +1,109 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/consts"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+)
+
+func TestDebugInfo(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	_ = s.Register(&models.Gogo{})
+	s.SetAuthorizer(auth.NewPolicyAuthorizer(&auth.Policy{
+		Default: auth.EffectAllow,
+		Rules:   []*auth.Rule{{Effect: auth.EffectDeny, Service: "Gogo"}},
+	}))
+	err := s.AddListener(&rpc.ListenerConfig{Addr: "http@127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	ep := s.Endpoints()[0]
+
+	c, err := client.XDial(ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	ctx := context.NewContext(gctx.Background())
+	context.SetTraceId(ctx, "debug")
+	var reply models.Reply
+	for i := 0; i < 3; i++ {
+		_ = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 1, Num2: 2}, &reply)
+	}
+	_ = c.Call(ctx, "Gogo.Demo", &models.GogoProtoColorGroup{}, &models.GogoProtoColorGroupRsp{})
+
+	base := "http://" + strings.TrimPrefix(ep, "http@")
+	resp, err := http.Get(base + consts.DefaultDebugJSONPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		Listeners []struct{ Endpoint string }
+		Services  []struct {
+			Name    string
+			Methods []struct {
+				Name         string
+				Calls        uint64
+				Errors       uint64
+				Latency      struct{ Samples int }
+				RecentErrors []struct{ TraceId, Code string }
+			}
+		}
+		Connections []struct {
+			CodecType string
+			InFlight  int32
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Listeners) != 1 || info.Listeners[0].Endpoint != ep {
+		t.Fatalf("unexpected listeners %+v", info.Listeners)
+	}
+	if len(info.Connections) != 1 || info.Connections[0].CodecType != string(lcode.JsonType) || info.Connections[0].InFlight != 0 {
+		t.Fatalf("unexpected connections %+v", info.Connections)
+	}
+	if len(info.Services) != 2 || info.Services[0].Name != "Foo" || info.Services[1].Name != "Gogo" {
+		t.Fatalf("unexpected services %+v", info.Services)
+	}
+	for _, m := range info.Services[0].Methods {
+		if m.Name == "Sum" && (m.Calls != 3 || m.Errors != 0 || m.Latency.Samples != 3) {
+			t.Fatalf("unexpected Foo.Sum %+v", m)
+		}
+	}
+	demo := info.Services[1].Methods[0]
+	if demo.Errors != 1 || len(demo.RecentErrors) != 1 || demo.RecentErrors[0].TraceId != "debug" ||
+		demo.RecentErrors[0].Code != lcode.CodePermissionDenied.String() {
+		t.Fatalf("unexpected Gogo.Demo %+v", demo)
+	}
+
+	resp, err = http.Get(base + consts.DefaultDebugPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "permission denied") {
+		t.Fatalf("unexpected debug page %d:\n%s", resp.StatusCode, page)
+	}
+}
@@ -0,0 +1,211 @@
+package rpc
+
+/*
+ * HTTP/JSON 网关
+ *   POST /{Service}/{Method}  body 为 JSON 参数, 返回 JSON 结果
+ *   错误码通过 lcode.Code.HTTPStatus 映射为 http 状态码
+ *   Authorization: <scheme> <token>  与握手使用同一个 Authenticator
+ *   X-Lrpc-Trace-Id, Traceparent, X-Lrpc-Meta-* 对应 Header 的同名字段
+ * */
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+)
+
+const (
+	HeaderTraceId       = "X-Lrpc-Trace-Id"
+	HeaderTraceparent   = "Traceparent"
+	HeaderMetaPrefix    = "X-Lrpc-Meta-"
+	HeaderCode          = "X-Lrpc-Code"
+	HeaderAuthorization = "Authorization"
+
+	gatewayMaxBody = 16 << 20
+)
+
+type gateway struct {
+	s       *Server
+	cfg     *ListenerConfig
+	limiter *connLimiter
+}
+
+// GatewayError 失败时的响应体
+type GatewayError struct {
+	Code    lcode.Code `json:"code"`
+	Status  string     `json:"status"`
+	Error   string     `json:"error"`
+	TraceId string     `json:"trace_id,omitempty"`
+}
+
+// Gateway 使用 Server 级别的鉴权和限制, http@ 监听地址会自动挂载在 / 上
+func (s *Server) Gateway() http.Handler {
+	return &gateway{s: s, cfg: &ListenerConfig{}, limiter: &connLimiter{}}
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fun := "gateway.ServeHTTP"
+
+	h := &lcode.Header{
+		TraceId:     r.Header.Get(HeaderTraceId),
+		Traceparent: r.Header.Get(HeaderTraceparent),
+		Meta:        gatewayMeta(r.Header),
+	}
+	if h.TraceId == "" {
+		h.TraceId = context.NewTraceId()
+	}
+	w.Header().Set(HeaderTraceId, h.TraceId)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		g.writeError(w, h, lcode.Errorf(lcode.CodeInvalidRequest, "method %s not allowed, use POST", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		g.writeError(w, h, lcode.Errorf(lcode.CodeNotFound, "invalid path %s, expect /{Service}/{Method}", r.URL.Path), 0)
+		return
+	}
+	h.ServiceMethod = parts[0] + "." + parts[1]
+
+	limits := g.cfg.Limits
+	if limits == nil {
+		limits = &g.s.limits
+	}
+	ip := remoteHost(r.RemoteAddr)
+	err := g.s.acquireConn(g.limiter, limits, ip)
+	if err != nil {
+		g.writeError(w, h, err, 0)
+		return
+	}
+	defer g.s.releaseConn(g.limiter, ip)
+
+	p, err := g.s.authenticateHTTP(g.cfg, r)
+	if err != nil {
+		log.Warningf(h.TraceId, "%s remote:%s authenticate failed err:%v", fun, r.RemoteAddr, err)
+		g.writeError(w, h, err, 0)
+		return
+	}
+
+	req := &request{h: h}
+	req.svc, req.mType, err = g.s.findMethod(h.ServiceMethod, false)
+	if err != nil {
+		g.writeError(w, h, err, 0)
+		return
+	}
+
+	req.argv = req.mType.newArgv()
+	req.replyv = req.mType.newReplyv()
+	argvi := req.argv.Interface()
+	if req.argv.Type().Kind() != reflect.Ptr {
+		argvi = req.argv.Addr().Interface()
+	}
+	err = jsoniter.NewDecoder(io.LimitReader(r.Body, gatewayMaxBody)).Decode(argvi)
+	if err != nil && err != io.EOF {
+		g.writeError(w, h, lcode.Errorf(lcode.CodeInvalidRequest, "decode body failed: %v", err), 0)
+		return
+	}
+
+	timeout := handleTimeout(g.cfg)
+	info := &CallInfo{
+		Header:    h,
+		Peer:      r.RemoteAddr,
+		Principal: p,
+		Transport: TransportHTTP,
+	}
+	err = g.s.invoke(info, req, timeout)
+	if err != nil {
+		g.writeError(w, h, err, 0)
+		return
+	}
+
+	w.Header().Set(headerContentType, "application/json")
+	w.Header().Set(HeaderCode, lcode.CodeOK.String())
+	err = jsoniter.NewEncoder(w).Encode(req.replyv.Interface())
+	if err != nil {
+		log.Errorf(h.TraceId, "%s write reply failed err:%v", fun, err)
+	}
+}
+
+// authenticateHTTP 网关和 JSON-RPC 共用, 没有配置 Authenticator 时返回 nil
+func (s *Server) authenticateHTTP(cfg *ListenerConfig, r *http.Request) (*auth.Principal, error) {
+	a := s.authenticator
+	if cfg.Authenticator != nil {
+		a = cfg.Authenticator
+	}
+	if a == nil {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(r.Header.Get(HeaderAuthorization), " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, lcode.NewError(lcode.CodeUnauthenticated, "credentials required")
+	}
+	p, err := a.Authenticate(strings.ToLower(parts[0]), parts[1])
+	if err != nil {
+		return nil, lcode.NewError(lcode.CodeUnauthenticated, err.Error())
+	}
+	if p == nil {
+		p = &auth.Principal{}
+	}
+	return p, nil
+}
+
+// writeError status 为 0 时按错误码映射
+func (g *gateway) writeError(w http.ResponseWriter, h *lcode.Header, err error, status int) {
+	code := lcode.ErrorCode(err)
+	if status == 0 {
+		status = code.HTTPStatus()
+	}
+	w.Header().Set(headerContentType, "application/json")
+	w.Header().Set(HeaderCode, code.String())
+	w.WriteHeader(status)
+	_ = jsoniter.NewEncoder(w).Encode(&GatewayError{
+		Code:    code,
+		Status:  code.String(),
+		Error:   lcode.ErrorDesc(err),
+		TraceId: h.TraceId,
+	})
+}
+
+// gatewayMeta http 头不区分大小写, 元数据的 key 统一为小写
+func gatewayMeta(hdr http.Header) map[string]string {
+	var meta map[string]string
+	for k, vs := range hdr {
+		if !strings.HasPrefix(k, HeaderMetaPrefix) || len(vs) == 0 {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(k[len(HeaderMetaPrefix):])] = vs[0]
+	}
+	return meta
+}
+
+// handleTimeout 没有握手的传输方式使用监听地址的处理超时
+func handleTimeout(cfg *ListenerConfig) time.Duration {
+	if cfg.HandleTimeout > 0 {
+		return cfg.HandleTimeout
+	}
+	return 3 * time.Second
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
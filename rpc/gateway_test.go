@@ -0,0 +1,130 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+)
+
+type Meta struct{}
+
+func (m *Meta) Len(ctx *context.Context, args models.Args, reply *models.Reply) error {
+	reply.Num = len(context.GetMetadata(ctx, "tenant"))
+	if context.GetTraceId(ctx) == "" {
+		return errors.New("missing trace id")
+	}
+	return nil
+}
+
+func TestGateway(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	_ = s.Register(&models.Gogo{})
+	_ = s.Register(&Meta{})
+	s.SetAuthorizer(auth.NewPolicyAuthorizer(&auth.Policy{
+		Default: auth.EffectAllow,
+		Rules:   []*auth.Rule{{Effect: auth.EffectDeny, Service: "Gogo"}},
+	}))
+
+	var mu sync.Mutex
+	transports := map[string]int{}
+	s.Use(func(ctx *context.Context, info *rpc.CallInfo, args, reply interface{}, handler rpc.Handler) error {
+		mu.Lock()
+		transports[info.Transport]++
+		mu.Unlock()
+		return handler(ctx, args, reply)
+	})
+
+	ta := auth.NewTokenAuthenticator()
+	ta.AddToken("t0ken", &auth.Principal{Name: "alice"})
+	err := s.AddListener(&rpc.ListenerConfig{Addr: "http@127.0.0.1:0", Authenticator: ta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	ep := s.Endpoints()[0]
+	base := "http://" + strings.TrimPrefix(ep, "http@")
+
+	post := func(method, path, body string, hdr map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, base+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer t0ken")
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp, strings.TrimSpace(string(b))
+	}
+
+	resp, body := post("POST", "/Foo/Sum", `{"Num1":1,"Num2":2}`, map[string]string{rpc.HeaderTraceId: "gw"})
+	if resp.StatusCode != http.StatusOK || body != `{"Num":3}` || resp.Header.Get(rpc.HeaderTraceId) != "gw" {
+		t.Fatalf("unexpected %d %s %v", resp.StatusCode, body, resp.Header)
+	}
+
+	resp, body = post("POST", "/Meta/Len", `{}`, map[string]string{rpc.HeaderMetaPrefix + "Tenant": "abcd"})
+	if resp.StatusCode != http.StatusOK || body != `{"Num":4}` {
+		t.Fatalf("unexpected metadata %d %s", resp.StatusCode, body)
+	}
+
+	for _, c := range []struct {
+		method, path, body, auth string
+		status                   int
+		code                     lcode.Code
+	}{
+		{"POST", "/Foo/Sum", `{}`, "none", http.StatusUnauthorized, lcode.CodeUnauthenticated},
+		{"POST", "/Gogo/Demo", `{}`, "", http.StatusForbidden, lcode.CodePermissionDenied},
+		{"POST", "/Foo/Nope", `{}`, "", http.StatusNotFound, lcode.CodeNotFound},
+		{"POST", "/Foo/Sum", `{"Num1":`, "", http.StatusBadRequest, lcode.CodeInvalidRequest},
+		{"GET", "/Foo/Sum", ``, "", http.StatusMethodNotAllowed, lcode.CodeInvalidRequest},
+	} {
+		hdr := map[string]string{}
+		if c.auth != "" {
+			hdr["Authorization"] = c.auth
+		}
+		resp, body = post(c.method, c.path, c.body, hdr)
+		var ge rpc.GatewayError
+		_ = json.Unmarshal([]byte(body), &ge)
+		if resp.StatusCode != c.status || ge.Code != c.code || ge.TraceId == "" {
+			t.Fatalf("%s %s expect %d/%s, got %d %s", c.method, c.path, c.status, c.code, resp.StatusCode, body)
+		}
+	}
+
+	// 原生调用走同样的拦截器
+	cli, err := client.XDial(ep, &rpc.Option{Credentials: auth.TokenCredentials("t0ken")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = cli.Close() }()
+	ctx := context.NewContext(gctx.Background())
+	context.SetMetadata(ctx, "tenant", "xy")
+	var reply models.Reply
+	err = cli.Call(ctx, "Meta.Len", &models.Args{}, &reply)
+	if err != nil || reply.Num != 2 {
+		t.Fatalf("expect native metadata 2, got %d err:%v", reply.Num, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if transports[rpc.TransportHTTP] != 2 || transports[rpc.TransportLrpc] != 1 {
+		t.Fatalf("unexpected interceptor calls %v", transports)
+	}
+}
@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+)
+
+// 握手流程, 每一帧都是 | uint16 len | JSON |
+// client -> Option
+// client -> AuthRequest (仅当 Option.AuthScheme 不为空)
+// server -> HandshakeReply (仅当 Option.Version >= HandshakeVersion, 旧客户端失败时直接断开)
+// 新服务端兼容旧客户端, 反之不行: 客户端总是声明 HandshakeVersion 并等待 HandshakeReply,
+// 旧服务端不回复, 客户端在 ConnectTimeout 后失败, 升级时需要先升级服务端
+
+type AuthRequest struct {
+	Token string
+}
+
+// HandshakeReply CodecType 为本连接最终使用的编解码
+type HandshakeReply struct {
+	Code      lcode.Code
+	Error     string
+	CodecType lcode.Type
+}
+
+func (hr *HandshakeReply) Err() error {
+	if hr.Code == lcode.CodeOK {
+		return nil
+	}
+	return lcode.NewError(hr.Code, hr.Error)
+}
+
+func WriteHandshake(w io.Writer, v interface{}) error {
+	bs, err := jsoniter.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(bs) > 0xffff {
+		return errors.New("rpc handshake: frame too large")
+	}
+
+	data := make([]byte, 2+len(bs))
+	binary.BigEndian.PutUint16(data, uint16(len(bs)))
+	copy(data[2:], bs)
+	_, err = w.Write(data)
+	return err
+}
+
+func ReadHandshake(r io.Reader, v interface{}) error {
+	var data = make([]byte, 2)
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return err
+	}
+
+	total := binary.BigEndian.Uint16(data)
+	data = make([]byte, total)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return err
+	}
+	return jsoniter.Unmarshal(data, v)
+}
+
+// authenticate 校验客户端凭证, 通过后记录 principal
+func (c *Conn) authenticate(opt *Option) error {
+	fun := "Conn.authenticate"
+
+	var token string
+	if opt.AuthScheme != "" {
+		ar := &AuthRequest{}
+		err := ReadHandshake(c.conn, ar)
+		if err != nil {
+			log.Errorf("", "%s read auth request failed err:%v", fun, err)
+			return lcode.Errorf(lcode.CodeInvalidRequest, "read auth request failed: %v", err)
+		}
+		token = ar.Token
+	}
+
+	a := c.s.authenticator
+	if c.lc.Authenticator != nil {
+		a = c.lc.Authenticator
+	}
+	if a == nil {
+		return nil
+	}
+
+	if opt.AuthScheme == "" {
+		return lcode.NewError(lcode.CodeUnauthenticated, "credentials required")
+	}
+
+	p, err := a.Authenticate(opt.AuthScheme, token)
+	if err != nil {
+		log.Warningf("", "%s remote:%s scheme:%s failed err:%v", fun, c.conn.RemoteAddr(), opt.AuthScheme, err)
+		return lcode.NewError(lcode.CodeUnauthenticated, err.Error())
+	}
+	if p == nil {
+		p = &auth.Principal{}
+	}
+	c.principal = p
+	return nil
+}
+
+func (c *Conn) Principal() *auth.Principal {
+	return c.principal
+}
@@ -0,0 +1,71 @@
+package rpc_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+func TestAuth(t *testing.T) {
+	lcode.Init()
+
+	ln, _ := transport.ListenMem("auth")
+	defer ln.Close()
+	s := rpc.NewServer()
+	ta := auth.NewTokenAuthenticator()
+	ta.AddToken("t0ken", &auth.Principal{Name: "alice"})
+	s.SetAuthenticator(ta)
+	go s.Accept(ln)
+
+	addr := "mem@auth"
+	c, err := client.XDial(addr, &rpc.Option{Credentials: auth.TokenCredentials("t0ken")})
+	if err != nil {
+		t.Fatal("expect authenticated, got", err)
+	}
+	_ = c.Close()
+
+	_, err = client.XDial(addr, &rpc.Option{Credentials: auth.TokenCredentials("bad")})
+	if lcode.ErrorCode(err) != lcode.CodeUnauthenticated {
+		t.Fatal("expect unauthenticated, got", err)
+	}
+
+	_, err = client.XDial(addr, &rpc.Option{})
+	if lcode.ErrorCode(err) != lcode.CodeUnauthenticated {
+		t.Fatal("expect unauthenticated without credentials, got", err)
+	}
+
+	// 旧客户端不读取 HandshakeReply, 失败时直接断开
+	old, _ := transport.DialMem("auth")
+	defer old.Close()
+	_ = rpc.WriteHandshake(old, &rpc.Option{MagicNumber: rpc.MagicNumber})
+	_ = old.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := old.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatal("expect legacy client closed without reply, got", n, err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	ln, _ := transport.ListenMem("handshake-timeout")
+	defer ln.Close()
+	s := rpc.NewServer()
+	go s.Accept(ln)
+
+	// 连上后不发送 Option 的客户端在握手超时后被关闭
+	silent, _ := transport.DialMem("handshake-timeout")
+	defer silent.Close()
+	_ = silent.SetReadDeadline(time.Now().Add(rpc.HandshakeTimeout + 2*time.Second))
+	if n, err := silent.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatal("expect silent client closed, got", n, err)
+	}
+	if !waitFor(time.Second, func() bool { return s.ConnStats().ClosedBy(rpc.CloseHandshake) == 1 }) {
+		t.Fatal("expect handshake close counted, got", s.ConnStats())
+	}
+}
@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"io"
+	"net"
 	"net/http"
 
 	"github.com/zulong210220/lrpc/consts"
@@ -14,30 +15,50 @@ const (
 )
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, ok := hijackConnect(w, r)
+	if !ok {
+		return
+	}
+	s.serveConn(s.httpl, conn)
+}
+
+func hijackConnect(w http.ResponseWriter, r *http.Request) (net.Conn, bool) {
 	if r.Method != consts.MethodConnect {
 		w.Header().Set(headerContentType, ContentType)
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		_, _ = io.WriteString(w, "405 must CONNECT")
-		return
+		return nil, false
 	}
 
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
 		log.Error("", "rpc hijacking ", r.RemoteAddr, " : ", err)
-		return
+		return nil, false
 	}
 
 	_, _ = io.WriteString(conn, "HTTP/1.0 "+consts.Connected+"\n\n")
-	c := NewConn(s, conn)
-	c.Serve()
+	return conn, true
 }
 
 func (s *Server) HandleHTTP() {
 	http.Handle(consts.DefaultRpcPath, s)
 	http.Handle(consts.DefaultDebugPath, debugHTTP{s})
+	http.Handle(consts.DefaultDebugJSONPath, debugJSON{s})
+	http.Handle(consts.DebugMetricsPath, s.Metrics())
+	http.Handle(consts.DefaultWebSocketPath, s.WebSocket())
 	log.Info("", "Server.HandleHTTP serveing....")
 }
 
 func HandleHTTP() {
 	DefaultServer.HandleHTTP()
 }
+
+// HandleMetrics 把指标挂到 http.DefaultServeMux 的 consts.DefaultMetricsPath
+// 应用已经占用该路径时不要调用, 改为自行挂载 s.Metrics()
+func (s *Server) HandleMetrics() {
+	http.Handle(consts.DefaultMetricsPath, s.Metrics())
+}
+
+func HandleMetrics() {
+	DefaultServer.HandleMetrics()
+}
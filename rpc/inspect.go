@@ -0,0 +1,277 @@
+package rpc
+
+/*
+ * 正在处理的请求, 耗时最长的慢请求和最近的失败请求
+ * 通过调试页面和 Admin.Inspect 查看
+ * */
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulong210220/lrpc/lcode"
+)
+
+const (
+	DefaultSlowThreshold = time.Second
+
+	inspectRingSize = 64
+)
+
+type InFlightRequest struct {
+	Method    string
+	TraceId   string
+	Seq       uint64
+	Peer      string
+	Principal string
+	Start     time.Time
+	Elapsed   Duration
+}
+
+type RequestRecord struct {
+	Method    string
+	TraceId   string
+	Peer      string
+	Principal string
+	Start     time.Time
+	Elapsed   Duration
+	Code      string
+	Error     string
+	Header    lcode.Header
+}
+
+type activeRequest struct {
+	h         *lcode.Header
+	peer      string
+	principal string
+	start     time.Time
+}
+
+type requestRing struct {
+	mu   sync.Mutex
+	recs [inspectRingSize]RequestRecord
+	n    int
+}
+
+func (r *requestRing) add(rec RequestRecord) {
+	r.mu.Lock()
+	r.recs[r.n%inspectRingSize] = rec
+	r.n++
+	r.mu.Unlock()
+}
+
+// list 新的在前
+func (r *requestRing) list() []RequestRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := r.n
+	if m > inspectRingSize {
+		m = inspectRingSize
+	}
+	res := make([]RequestRecord, 0, m)
+	for i := 0; i < m; i++ {
+		res = append(res, r.recs[(r.n-1-i)%inspectRingSize])
+	}
+	return res
+}
+
+// slowTop 只保留耗时最长的 inspectRingSize 条, 偶发的慢请求不会被大量刚过阈值的请求冲掉
+type slowTop struct {
+	mu   sync.Mutex
+	recs []RequestRecord
+}
+
+func (t *slowTop) add(rec RequestRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.recs) < inspectRingSize {
+		t.recs = append(t.recs, rec)
+		return
+	}
+	min := 0
+	for i := range t.recs {
+		if t.recs[i].Elapsed < t.recs[min].Elapsed {
+			min = i
+		}
+	}
+	if rec.Elapsed > t.recs[min].Elapsed {
+		t.recs[min] = rec
+	}
+}
+
+// list 耗时长的在前
+func (t *slowTop) list() []RequestRecord {
+	t.mu.Lock()
+	res := make([]RequestRecord, len(t.recs))
+	copy(res, t.recs)
+	t.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Elapsed > res[j].Elapsed })
+	return res
+}
+
+type inspector struct {
+	seq    uint64
+	active sync.Map // uint64 => *activeRequest
+
+	mu         sync.RWMutex
+	thresholds map[string]time.Duration // ServiceMethod => 慢请求阈值, "" 为默认值
+
+	slow   slowTop
+	failed requestRing
+}
+
+func (in *inspector) begin(info *CallInfo) uint64 {
+	ar := &activeRequest{
+		h:     info.Header,
+		peer:  info.Peer,
+		start: time.Now(),
+	}
+	if info.Principal != nil {
+		ar.principal = info.Principal.Name
+	}
+	id := atomic.AddUint64(&in.seq, 1)
+	in.active.Store(id, ar)
+	return id
+}
+
+func (in *inspector) end(id uint64, code lcode.Code) {
+	v, ok := in.active.Load(id)
+	if !ok {
+		return
+	}
+	in.active.Delete(id)
+
+	ar := v.(*activeRequest)
+	elapsed := time.Since(ar.start)
+	slow := elapsed >= in.threshold(ar.h.ServiceMethod)
+	if !slow && code == lcode.CodeOK {
+		return
+	}
+
+	rec := RequestRecord{
+		Method:    ar.h.ServiceMethod,
+		TraceId:   ar.h.TraceId,
+		Peer:      ar.peer,
+		Principal: ar.principal,
+		Start:     ar.start,
+		Elapsed:   Duration(elapsed),
+		Code:      code.String(),
+		Error:     ar.h.Error,
+		Header:    *ar.h,
+	}
+	if slow {
+		in.slow.add(rec)
+	}
+	if code != lcode.CodeOK {
+		in.failed.add(rec)
+	}
+}
+
+func (in *inspector) threshold(sm string) time.Duration {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+
+	if d, ok := in.thresholds[sm]; ok {
+		return d
+	}
+	if d, ok := in.thresholds[""]; ok {
+		return d
+	}
+	return DefaultSlowThreshold
+}
+
+// SetSlowThreshold 设置 Service.Method 的慢请求阈值, serviceMethod 为空时设置默认值
+func (s *Server) SetSlowThreshold(serviceMethod string, d time.Duration) {
+	in := &s.inspector
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.thresholds == nil {
+		in.thresholds = make(map[string]time.Duration)
+	}
+	in.thresholds[serviceMethod] = d
+}
+
+// InFlight 正在处理的请求, 耗时长的在前
+func (s *Server) InFlight() []InFlightRequest {
+	now := time.Now()
+	var res []InFlightRequest
+	s.inspector.active.Range(func(k, v interface{}) bool {
+		ar := v.(*activeRequest)
+		res = append(res, InFlightRequest{
+			Method:    ar.h.ServiceMethod,
+			TraceId:   ar.h.TraceId,
+			Seq:       ar.h.Seq,
+			Peer:      ar.peer,
+			Principal: ar.principal,
+			Start:     ar.start,
+			Elapsed:   Duration(now.Sub(ar.start)),
+		})
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Start.Before(res[j].Start) })
+	return res
+}
+
+// SlowRequests 超过阈值的请求中耗时最长的, 耗时长的在前
+func (s *Server) SlowRequests() []RequestRecord {
+	return s.inspector.slow.list()
+}
+
+// FailedRequests 最近失败的请求, 新的在前
+func (s *Server) FailedRequests() []RequestRecord {
+	return s.inspector.failed.list()
+}
+
+// ---
+
+// Admin 内置的管理服务, 需要通过 Server.RegisterAdmin 开启
+// 建议配合 SetAuthorizer 只允许运维账号访问 Admin
+type Admin struct {
+	s *Server
+}
+
+type InspectArgs struct {
+	Limit int // 每个列表最多返回的条数, 0 不限制
+}
+
+func (a *InspectArgs) Reset()         { *a = InspectArgs{} }
+func (a *InspectArgs) String() string { return "inspect" }
+func (a *InspectArgs) ProtoMessage()  {}
+
+type InspectReply struct {
+	InFlight []InFlightRequest
+	Slow     []RequestRecord
+	Failed   []RequestRecord
+}
+
+func (r *InspectReply) Reset()         { *r = InspectReply{} }
+func (r *InspectReply) String() string { return "inspect" }
+func (r *InspectReply) ProtoMessage()  {}
+
+func (a *Admin) Inspect(args InspectArgs, reply *InspectReply) error {
+	reply.InFlight = a.s.InFlight()
+	reply.Slow = a.s.SlowRequests()
+	reply.Failed = a.s.FailedRequests()
+	if n := args.Limit; n > 0 {
+		if len(reply.InFlight) > n {
+			reply.InFlight = reply.InFlight[:n]
+		}
+		if len(reply.Slow) > n {
+			reply.Slow = reply.Slow[:n]
+		}
+		if len(reply.Failed) > n {
+			reply.Failed = reply.Failed[:n]
+		}
+	}
+	return nil
+}
+
+func (s *Server) RegisterAdmin() error {
+	return s.Register(&Admin{s: s})
+}
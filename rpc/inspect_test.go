@@ -0,0 +1,80 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+type intArg int
+
+func (a *intArg) Reset()         {}
+func (a *intArg) String() string { return "" }
+func (a *intArg) ProtoMessage()  {}
+
+func TestInspect(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	_ = s.Register(&models.Gogo{})
+	_ = s.RegisterAdmin()
+	s.SetAuthorizer(auth.NewPolicyAuthorizer(&auth.Policy{
+		Default: auth.EffectAllow,
+		Rules:   []*auth.Rule{{Effect: auth.EffectDeny, Service: "Gogo"}},
+	}))
+	s.SetSlowThreshold("", time.Hour)
+	s.SetSlowThreshold("Foo.Sum", 0)
+	ln, _ := transport.ListenMem("inspect")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	c, err := client.XDial("mem@inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	ctx := context.NewContext(gctx.Background())
+	context.SetTraceId(ctx, "inspect")
+	var reply models.Reply
+	_ = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 1, Num2: 2}, &reply)
+	_ = c.Call(ctx, "Gogo.Demo", &models.GogoProtoColorGroup{}, &models.GogoProtoColorGroupRsp{})
+
+	var arg, res intArg
+	c.Do("stuck", "Foo.Timeout", &arg, &res, nil)
+	if !waitFor(time.Second, func() bool { return len(s.InFlight()) == 1 }) {
+		t.Fatal("expect Foo.Timeout in flight")
+	}
+
+	var ir rpc.InspectReply
+	err = c.Call(ctx, "Admin.Inspect", &rpc.InspectArgs{}, &ir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stuck *rpc.InFlightRequest
+	for i := range ir.InFlight {
+		if ir.InFlight[i].Method == "Foo.Timeout" {
+			stuck = &ir.InFlight[i]
+		}
+	}
+	if stuck == nil || stuck.TraceId != "stuck" || stuck.Peer != "inspect#client" || stuck.Elapsed <= 0 {
+		t.Fatalf("unexpected in flight %+v", ir.InFlight)
+	}
+	if len(ir.Slow) != 1 || ir.Slow[0].Method != "Foo.Sum" || ir.Slow[0].Header.Seq == 0 {
+		t.Fatalf("unexpected slow %+v", ir.Slow)
+	}
+	if len(ir.Failed) != 1 || ir.Failed[0].Method != "Gogo.Demo" || ir.Failed[0].Code != lcode.CodePermissionDenied.String() {
+		t.Fatalf("unexpected failed %+v", ir.Failed)
+	}
+}
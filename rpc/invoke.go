@@ -0,0 +1,195 @@
+package rpc
+
+/*
+ * 一次调用的公共流程, 原生连接和 http 网关共用
+ *   鉴权 -> 拦截器 -> 服务方法, 处理超时, 指标, trace
+ * */
+
+import (
+	gctx "context"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/tracing"
+)
+
+const (
+	TransportLrpc = "lrpc"
+	TransportHTTP = "http"
+
+	TransportJSONRPC = "jsonrpc"
+	TransportReverse = "reverse" // 客户端处理服务端的反向调用
+)
+
+type CallInfo struct {
+	Header    *lcode.Header
+	Peer      string
+	Principal *auth.Principal
+	Transport string // lrpc, http, jsonrpc ...
+
+	conn *Conn // 原生连接, 用于反向调用
+}
+
+// Handler 执行服务方法, args/reply 为注册方法的参数, 拦截器可以替换为同类型的值
+type Handler func(ctx *context.Context, args, reply interface{}) error
+
+// Interceptor 必须调用 handler 才会执行服务方法
+type Interceptor func(ctx *context.Context, info *CallInfo, args, reply interface{}, handler Handler) error
+
+// Use 按添加顺序由外向内执行, 需要在开始服务前设置
+func (s *Server) Use(is ...Interceptor) {
+	s.interceptors = append(s.interceptors, is...)
+}
+
+// invoke 返回的错误已经写入 req.h 的 Code/Error
+func (s *Server) invoke(info *CallInfo, req *request, timeout time.Duration) (err error) {
+	h := req.h
+	start := time.Now()
+	done := s.metrics.begin(h.ServiceMethod)
+	if h.Is(lcode.FlagOneway) {
+		atomic.AddUint64(&req.mType.numOneway, 1)
+		s.metrics.oneway.With(h.ServiceMethod).Inc()
+	}
+	id := s.inspector.begin(info)
+	span := tracing.StartServerSpan(h.Traceparent, h.ServiceMethod)
+	defer func() {
+		code := lcode.ErrorCode(err)
+		if err != nil {
+			h.Code = code
+			h.Error = lcode.ErrorDesc(err)
+			span.SetStatus(code.String(), h.Error)
+		}
+		done(code)
+		req.mType.stats.observe(time.Since(start), code, h)
+		s.inspector.end(id, code)
+		span.End()
+	}()
+
+	err = s.authorize(info, req)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := handlerContext(info, req, span, timeout)
+	defer cancel()
+
+	called := make(chan error, 1)
+	go func() {
+		// 此处真正执行代码逻辑
+		called <- s.intercept(ctx, info, req)
+	}()
+
+	select {
+	case <-ctx.Done():
+		if ctx.Err() == gctx.Canceled {
+			return lcode.NewError(lcode.CodeCanceled, "rpc server: request canceled")
+		}
+		return lcode.Errorf(lcode.CodeDeadlineExceeded, "rpc server: request handle timeout %s", timeout)
+	case err = <-called:
+		return err
+	}
+}
+
+func (s *Server) intercept(ctx *context.Context, info *CallInfo, req *request) error {
+	// 最内层使用拦截器传下来的 args/reply, 替换的 reply 在返回后拷回 req.replyv 用于响应
+	handler := func(ctx *context.Context, args, reply interface{}) error {
+		argv, err := handlerValue(args, req.argv)
+		if err != nil {
+			return err
+		}
+		if !req.replyv.IsValid() {
+			return req.svc.callCtx(req.mType, ctx, argv, req.replyv)
+		}
+		replyv, err := handlerValue(reply, req.replyv)
+		if err != nil {
+			return err
+		}
+		err = req.svc.callCtx(req.mType, ctx, argv, replyv)
+		if err == nil && replyv.Pointer() != req.replyv.Pointer() {
+			req.replyv.Elem().Set(replyv.Elem())
+		}
+		return err
+	}
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		ic, next := s.interceptors[i], handler
+		handler = func(ctx *context.Context, args, reply interface{}) error {
+			return ic(ctx, info, args, reply, next)
+		}
+	}
+	var reply interface{}
+	if req.replyv.IsValid() {
+		reply = req.replyv.Interface()
+	}
+	return handler(ctx, req.argv.Interface(), reply)
+}
+
+// handlerValue 拦截器传入的参数必须和注册方法的类型一致
+func handlerValue(v interface{}, want reflect.Value) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Type() != want.Type() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return want, lcode.Errorf(lcode.CodeUnknown, "rpc server: interceptor passed %T, want %s", v, want.Type())
+	}
+	return rv, nil
+}
+
+// authorize 拒绝时记录审计日志
+func (s *Server) authorize(info *CallInfo, req *request) error {
+	a := s.authorizer
+	if a == nil {
+		return nil
+	}
+
+	err := a.Authorize(info.Principal, req.svc.name, req.mType.method.Name)
+	if err == nil {
+		return nil
+	}
+
+	name := ""
+	if info.Principal != nil {
+		name = info.Principal.Name
+	}
+	log.Warningf(req.h.TraceId, "audit: permission denied principal:%q remote:%s method:%s err:%v",
+		name, info.Peer, req.h.ServiceMethod, err)
+	return lcode.NewError(lcode.CodePermissionDenied, err.Error())
+}
+
+// handlerContext 传给带 ctx 参数的服务方法, 处理超时后取消; timeout 为 0 时不限制
+func handlerContext(info *CallInfo, req *request, span *tracing.Span, timeout time.Duration) (*context.Context, gctx.CancelFunc) {
+	h := info.Header
+	span.SetAttr("peer", info.Peer)
+	span.SetAttr("transport", info.Transport)
+	if h.TraceId != "" {
+		span.SetAttr("lrpc.trace_id", h.TraceId)
+	}
+
+	parent := req.ctx
+	if parent == nil {
+		parent = gctx.Background()
+	}
+	var (
+		cctx   gctx.Context
+		cancel gctx.CancelFunc
+	)
+	if timeout > 0 {
+		cctx, cancel = gctx.WithTimeout(parent, timeout)
+	} else {
+		cctx, cancel = gctx.WithCancel(parent)
+	}
+	ctx := context.NewContext(cctx)
+	if h.TraceId != "" {
+		context.SetTraceId(ctx, h.TraceId)
+	}
+	if len(h.Meta) > 0 {
+		context.WithMetadata(ctx, h.Meta)
+	}
+	tracing.ContextWithSpan(ctx, span)
+	if info.conn != nil {
+		ctx.SetValue(connKey{}, info.conn)
+	}
+	return ctx, cancel
+}
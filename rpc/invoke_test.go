@@ -0,0 +1,208 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/tracing"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+func TestPermissionDenied(t *testing.T) {
+	lcode.Init()
+
+	ln, _ := transport.ListenMem("perm")
+	defer ln.Close()
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+
+	ta := auth.NewTokenAuthenticator()
+	ta.AddToken("admin", &auth.Principal{Name: "alice", Attrs: map[string]string{"role": "admin"}})
+	ta.AddToken("guest", &auth.Principal{Name: "bob"})
+	s.SetAuthenticator(ta)
+	s.SetAuthorizer(auth.NewPolicyAuthorizer(&auth.Policy{
+		Default: auth.EffectDeny,
+		Rules: []*auth.Rule{
+			{Effect: auth.EffectAllow, Service: "Foo", Attrs: map[string]string{"role": "admin"}},
+		},
+	}))
+	go s.Accept(ln)
+
+	call := func(token string) error {
+		c, err := client.XDial("mem@perm", &rpc.Option{Credentials: auth.TokenCredentials(token)})
+		if err != nil {
+			return err
+		}
+		defer func() { _ = c.Close() }()
+
+		ctx := context.NewContext(gctx.Background())
+		context.SetTraceId(ctx, "perm")
+		var reply models.Reply
+		return c.Call(ctx, "Foo.Sum", &models.Args{Num1: 1, Num2: 2}, &reply)
+	}
+
+	if err := call("admin"); err != nil {
+		t.Fatal("expect admin allowed, got", err)
+	}
+	if err := call("guest"); lcode.ErrorCode(err) != lcode.CodePermissionDenied {
+		t.Fatal("expect permission denied, got", err)
+	}
+}
+
+type Relay struct {
+	c *client.Client
+}
+
+func (r *Relay) Forward(ctx *context.Context, args models.Args, reply *models.Reply) error {
+	return r.c.Call(ctx, "Foo.Sum", &args, reply)
+}
+
+func TestTracing(t *testing.T) {
+	lcode.Init()
+
+	dir, _ := ioutil.TempDir("", "lrpc-client")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+	fe, err := tracing.NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracing.SetExporter(fe)
+	defer func() {
+		tracing.SetExporter(nil)
+		_ = fe.Close()
+	}()
+
+	backend := rpc.NewServer()
+	var f models.Foo
+	_ = backend.Register(&f)
+	bln, _ := transport.ListenMem("trace-backend")
+	go backend.Accept(bln)
+	defer backend.Shutdown()
+
+	bc, err := client.XDial("mem@trace-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = bc.Close() }()
+
+	front := rpc.NewServer()
+	_ = front.Register(&Relay{c: bc})
+	fln, _ := transport.ListenMem("trace-front")
+	go front.Accept(fln)
+	defer front.Shutdown()
+
+	fc, err := client.XDial("mem@trace-front")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fc.Close() }()
+
+	// 没有设置 traceId 时自动生成
+	ctx := context.NewContext(gctx.Background())
+	var reply models.Reply
+	err = fc.Call(ctx, "Relay.Forward", &models.Args{Num1: 3, Num2: 4}, &reply)
+	if err != nil || reply.Num != 7 {
+		t.Fatalf("expect 7, got %d err:%v", reply.Num, err)
+	}
+	traceId := context.GetTraceId(ctx)
+
+	// 服务端 span 在回包之后结束, exporter 是全局的, 只看本次 trace
+	var spans []*tracing.SpanData
+	waitFor(time.Second, func() bool {
+		file, _ := os.Open(path)
+		defer file.Close()
+		all, _ := tracing.ReadSpans(file)
+		spans = spans[:0]
+		for _, d := range all {
+			if d.TraceID == traceId {
+				spans = append(spans, d)
+			}
+		}
+		return len(spans) == 4
+	})
+	if len(spans) != 4 {
+		t.Fatalf("expect 4 spans, got %d", len(spans))
+	}
+
+	trees := tracing.BuildTrees(spans)
+	roots := trees[traceId]
+	if len(trees) != 1 || len(roots) != 1 {
+		t.Fatalf("expect one tree for %s, got %+v", traceId, trees)
+	}
+	expect := []struct{ name, kind string }{
+		{"Relay.Forward", tracing.KindClient},
+		{"Relay.Forward", tracing.KindServer},
+		{"Foo.Sum", tracing.KindClient},
+		{"Foo.Sum", tracing.KindServer},
+	}
+	n := roots[0]
+	for i, e := range expect {
+		if n.Span.Name != e.name || n.Span.Kind != e.kind {
+			t.Fatalf("level %d expect %s/%s, got %+v", i, e.name, e.kind, n.Span)
+		}
+		if i == len(expect)-1 {
+			break
+		}
+		if len(n.Children) != 1 {
+			t.Fatalf("level %d expect 1 child, got %d", i, len(n.Children))
+		}
+		n = n.Children[0]
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	// 替换参数和响应, 服务方法和客户端都应该看到替换后的值
+	s.Use(func(ctx *context.Context, info *rpc.CallInfo, args, reply interface{}, handler rpc.Handler) error {
+		a := args.(models.Args)
+		if a.Num1 < 0 {
+			return handler(ctx, &a, reply)
+		}
+		a.Num1 *= 10
+		r := &models.Reply{}
+		err := handler(ctx, a, r)
+		r.Num++
+		return err
+	})
+	ln, err := s.Listen("mem@interceptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.Accept(ln)
+
+	c, err := client.XDial("mem@interceptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	ctx := context.NewContext(gctx.Background())
+	context.SetTraceId(ctx, "interceptor")
+	var reply models.Reply
+	err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 1, Num2: 2}, &reply)
+	if err != nil || reply.Num != 12 {
+		t.Fatalf("expect 12, got %d err:%v", reply.Num, err)
+	}
+
+	err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: -1, Num2: 2}, &reply)
+	if lcode.ErrorCode(err) != lcode.CodeUnknown {
+		t.Fatal("expect mismatched args rejected, got", err)
+	}
+}
@@ -0,0 +1,583 @@
+package rpc
+
+/*
+ * JSON-RPC 2.0
+ *   http@ 监听地址的 /jsonrpc 路径, 或 jsonrpc@host:port 每行一个请求(或批量请求)
+ *   method 为 Service.Method, params 为参数对象或只有一个元素的数组
+ *   错误对象的 data 带原生错误码, 数值映射见 lcode.Code.JSONRPCCode
+ *   也可以通过子协议为 lrpc.json 的 websocket 连接, 每个文本消息一个请求
+ *   tcp/websocket 上配置了 Authenticator 时需要先调用 rpc.authenticate
+ *   连接上的请求并发处理, 最多 HandlerNumber 个; 鉴权前和 rpc.authenticate 按顺序处理
+ * */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/consts"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+const (
+	JSONRPCVersion = "2.0"
+
+	// JSONRPCAuthMethod params 为 {"scheme": "...", "token": "..."}
+	JSONRPCAuthMethod = "rpc.authenticate"
+
+	jsonrpcMaxLine = 16 << 20
+)
+
+var jsonrpcNull = json.RawMessage("null")
+
+type JSONRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"` // 没有 id 的为通知, 不返回响应
+}
+
+type JSONRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"` // 成功时至少为 null
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type JSONRPCError struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Data    *JSONRPCErrorData `json:"data,omitempty"`
+}
+
+// JSONRPCErrorData 与原生响应的 Code/Error 对应
+type JSONRPCErrorData struct {
+	Code    lcode.Code `json:"lrpc_code"`
+	Status  string     `json:"status"`
+	TraceId string     `json:"trace_id,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return e.Err().Error()
+}
+
+// Err 还原为原生错误
+func (e *JSONRPCError) Err() error {
+	code := lcode.CodeFromJSONRPC(e.Code)
+	if e.Data != nil {
+		code = e.Data.Code
+	}
+	return lcode.NewError(code, e.Message)
+}
+
+func newJSONRPCError(n int, err error, traceId string) *JSONRPCError {
+	code := lcode.ErrorCode(err)
+	if n == 0 {
+		n = code.JSONRPCCode()
+	}
+	return &JSONRPCError{
+		Code:    n,
+		Message: lcode.ErrorDesc(err),
+		Data: &JSONRPCErrorData{
+			Code:    code,
+			Status:  code.String(),
+			TraceId: traceId,
+		},
+	}
+}
+
+type jsonrpcAuthParams struct {
+	Scheme string `json:"scheme"`
+	Token  string `json:"token"`
+}
+
+// jsonrpcPeer 一个 http 请求或一条 tcp 连接
+type jsonrpcPeer struct {
+	addr      string
+	transport string
+	hdr       http.Header // http 请求头, 取 trace 和元数据
+
+	mu        sync.Mutex
+	authed    bool
+	principal *auth.Principal
+}
+
+func (p *jsonrpcPeer) auth() (*auth.Principal, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.principal, p.authed
+}
+
+type jsonrpcHandler struct {
+	s       *Server
+	cfg     *ListenerConfig
+	limiter *connLimiter
+}
+
+// JSONRPC 使用 Server 级别的鉴权和限制, http@ 监听地址会自动挂载在 /jsonrpc 上
+func (s *Server) JSONRPC() http.Handler {
+	return &jsonrpcHandler{s: s, cfg: &ListenerConfig{}, limiter: &connLimiter{}}
+}
+
+func (j *jsonrpcHandler) authenticator() auth.Authenticator {
+	if j.cfg.Authenticator != nil {
+		return j.cfg.Authenticator
+	}
+	return j.s.authenticator
+}
+
+func (j *jsonrpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fun := "jsonrpcHandler.ServeHTTP"
+	traceId := r.Header.Get(HeaderTraceId)
+	if traceId != "" {
+		w.Header().Set(HeaderTraceId, traceId)
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		err := lcode.Errorf(lcode.CodeInvalidRequest, "method %s not allowed, use POST", r.Method)
+		j.writeHTTP(w, http.StatusMethodNotAllowed, j.errorResponse(nil, 0, err, traceId))
+		return
+	}
+
+	limits := j.cfg.Limits
+	if limits == nil {
+		limits = &j.s.limits
+	}
+	ip := remoteHost(r.RemoteAddr)
+	err := j.s.acquireConn(j.limiter, limits, ip)
+	if err != nil {
+		j.writeHTTP(w, lcode.ErrorCode(err).HTTPStatus(), j.errorResponse(nil, 0, err, traceId))
+		return
+	}
+	defer j.s.releaseConn(j.limiter, ip)
+
+	p := &jsonrpcPeer{addr: r.RemoteAddr, transport: TransportJSONRPC, hdr: r.Header, authed: true}
+	p.principal, err = j.s.authenticateHTTP(j.cfg, r)
+	if err != nil {
+		log.Warningf(traceId, "%s remote:%s authenticate failed err:%v", fun, r.RemoteAddr, err)
+		j.writeHTTP(w, http.StatusUnauthorized, j.errorResponse(nil, 0, err, traceId))
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, jsonrpcMaxLine))
+	if err != nil {
+		j.writeHTTP(w, http.StatusBadRequest, j.errorResponse(nil, lcode.JSONRPCParseError,
+			lcode.Errorf(lcode.CodeInvalidRequest, "read body failed: %v", err), traceId))
+		return
+	}
+
+	out := j.serve(p, data)
+	if out == nil {
+		// 全部是通知
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set(headerContentType, "application/json")
+	_, err = w.Write(out)
+	if err != nil {
+		log.Errorf(traceId, "%s write response failed err:%v", fun, err)
+	}
+}
+
+func (j *jsonrpcHandler) writeHTTP(w http.ResponseWriter, status int, resp *JSONRPCResponse) {
+	w.Header().Set(headerContentType, "application/json")
+	w.WriteHeader(status)
+	_ = jsoniter.NewEncoder(w).Encode(resp)
+}
+
+// serve 处理单个或批量请求, 没有需要返回的响应时返回 nil
+func (j *jsonrpcHandler) serve(p *jsonrpcPeer, data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if !jsoniter.Valid(data) {
+		err := lcode.NewError(lcode.CodeInvalidRequest, "parse error")
+		return j.marshal(j.errorResponse(nil, lcode.JSONRPCParseError, err, ""))
+	}
+
+	if len(data) == 0 || data[0] != '[' {
+		resp := j.call(p, data)
+		if resp == nil {
+			return nil
+		}
+		return j.marshal(resp)
+	}
+
+	var raws []json.RawMessage
+	err := jsoniter.Unmarshal(data, &raws)
+	if err != nil || len(raws) == 0 {
+		err = lcode.NewError(lcode.CodeInvalidRequest, "invalid batch request")
+		return j.marshal(j.errorResponse(nil, 0, err, ""))
+	}
+
+	// 批量请求并发执行, 响应按请求顺序返回; rpc.authenticate 先执行
+	resps := make([]*JSONRPCResponse, len(raws))
+	authed := make([]bool, len(raws))
+	for i := range raws {
+		if isJSONRPCAuth(raws[i]) {
+			resps[i] = j.call(p, raws[i])
+			authed[i] = true
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range raws {
+		if authed[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i] = j.call(p, raws[i])
+		}(i)
+	}
+	wg.Wait()
+
+	out := resps[:0]
+	for _, resp := range resps {
+		if resp != nil {
+			out = append(out, resp)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return j.marshal(out)
+}
+
+func (j *jsonrpcHandler) marshal(v interface{}) []byte {
+	data, err := jsoniter.Marshal(v)
+	if err != nil {
+		log.Errorf("", "jsonrpcHandler.marshal failed err:%v", err)
+		data, _ = jsoniter.Marshal(j.errorResponse(nil, 0, lcode.NewError(lcode.CodeUnknown, err.Error()), ""))
+	}
+	return data
+}
+
+func (j *jsonrpcHandler) errorResponse(id json.RawMessage, n int, err error, traceId string) *JSONRPCResponse {
+	if id == nil {
+		id = jsonrpcNull
+	}
+	return &JSONRPCResponse{
+		JSONRPC: JSONRPCVersion,
+		Error:   newJSONRPCError(n, err, traceId),
+		ID:      id,
+	}
+}
+
+// call 通知返回 nil
+func (j *jsonrpcHandler) call(p *jsonrpcPeer, raw []byte) *JSONRPCResponse {
+	var jr JSONRPCRequest
+	err := jsoniter.Unmarshal(raw, &jr)
+	if err != nil || jr.JSONRPC != JSONRPCVersion || jr.Method == "" {
+		err = lcode.NewError(lcode.CodeInvalidRequest, "invalid request")
+		return j.errorResponse(jr.ID, 0, err, "")
+	}
+
+	h := &lcode.Header{ServiceMethod: jr.Method}
+	if p.hdr != nil {
+		h.TraceId = p.hdr.Get(HeaderTraceId)
+		h.Traceparent = p.hdr.Get(HeaderTraceparent)
+		h.Meta = gatewayMeta(p.hdr)
+	}
+	if h.TraceId == "" {
+		h.TraceId = context.NewTraceId()
+	}
+
+	result, n, err := j.dispatch(p, h, jr.Params)
+	if jr.ID == nil {
+		return nil
+	}
+	if err != nil {
+		return j.errorResponse(jr.ID, n, err, h.TraceId)
+	}
+	data, err := jsoniter.Marshal(result)
+	if err != nil {
+		return j.errorResponse(jr.ID, 0, lcode.Errorf(lcode.CodeUnknown, "marshal result failed: %v", err), h.TraceId)
+	}
+	return &JSONRPCResponse{JSONRPC: JSONRPCVersion, Result: data, ID: jr.ID}
+}
+
+// isJSONRPCAuth 单个请求是否为 rpc.authenticate
+func isJSONRPCAuth(raw []byte) bool {
+	var jr struct {
+		Method string `json:"method"`
+	}
+	return jsoniter.Unmarshal(raw, &jr) == nil && jr.Method == JSONRPCAuthMethod
+}
+
+// dispatch 出错时 n 为需要使用的 JSON-RPC 错误码, 0 表示按原生错误码映射
+func (j *jsonrpcHandler) dispatch(p *jsonrpcPeer, h *lcode.Header, params json.RawMessage) (interface{}, int, error) {
+	if h.ServiceMethod == JSONRPCAuthMethod {
+		return j.authenticate(p, h, params)
+	}
+
+	principal, authed := p.auth()
+	if !authed {
+		return nil, 0, lcode.Errorf(lcode.CodeUnauthenticated, "call %s first", JSONRPCAuthMethod)
+	}
+
+	req := &request{h: h}
+	var err error
+	req.svc, req.mType, err = j.s.findMethod(h.ServiceMethod, false)
+	if lcode.ErrorCode(err) == lcode.CodeNotFound {
+		return nil, lcode.JSONRPCMethodNotFound, err
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.argv = req.mType.newArgv()
+	req.replyv = req.mType.newReplyv()
+	argvi := req.argv.Interface()
+	if req.argv.Type().Kind() != reflect.Ptr {
+		argvi = req.argv.Addr().Interface()
+	}
+	err = decodeParams(params, argvi)
+	if err != nil {
+		return nil, lcode.JSONRPCInvalidParams, lcode.Errorf(lcode.CodeInvalidRequest, "invalid params: %v", err)
+	}
+
+	info := &CallInfo{
+		Header:    h,
+		Peer:      p.addr,
+		Principal: principal,
+		Transport: p.transport,
+	}
+	err = j.s.invoke(info, req, handleTimeout(j.cfg))
+	if err != nil {
+		return nil, 0, err
+	}
+	return req.replyv.Interface(), 0, nil
+}
+
+func (j *jsonrpcHandler) authenticate(p *jsonrpcPeer, h *lcode.Header, params json.RawMessage) (interface{}, int, error) {
+	var ap jsonrpcAuthParams
+	err := decodeParams(params, &ap)
+	if err != nil || ap.Scheme == "" || ap.Token == "" {
+		return nil, lcode.JSONRPCInvalidParams, lcode.NewError(lcode.CodeInvalidRequest, "scheme and token required")
+	}
+
+	a := j.authenticator()
+	var principal *auth.Principal
+	if a != nil {
+		principal, err = a.Authenticate(ap.Scheme, ap.Token)
+		if err != nil {
+			log.Warningf(h.TraceId, "jsonrpcHandler.authenticate remote:%s failed err:%v", p.addr, err)
+			return nil, 0, lcode.NewError(lcode.CodeUnauthenticated, err.Error())
+		}
+	}
+	if principal == nil {
+		principal = &auth.Principal{}
+	}
+
+	p.mu.Lock()
+	p.authed = true
+	p.principal = principal
+	p.mu.Unlock()
+	return principal, 0, nil
+}
+
+// decodeParams 支持按名称的对象, 或只有一个元素的数组
+func decodeParams(params json.RawMessage, v interface{}) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, jsonrpcNull) {
+		return nil
+	}
+	if params[0] == '[' {
+		var arr []json.RawMessage
+		err := jsoniter.Unmarshal(params, &arr)
+		if err != nil {
+			return err
+		}
+		switch len(arr) {
+		case 0:
+			return nil
+		case 1:
+			params = arr[0]
+		default:
+			return lcode.Errorf(lcode.CodeInvalidRequest, "expect at most 1 positional param, got %d", len(arr))
+		}
+	}
+	return jsoniter.Unmarshal(params, v)
+}
+
+// jsonrpcStream tcp 按行, websocket 按文本消息
+type jsonrpcStream interface {
+	next() ([]byte, error)
+	write(data []byte) error
+}
+
+type jsonrpcLines struct {
+	conn net.Conn
+	sc   *bufio.Scanner
+	mu   sync.Mutex
+}
+
+func newJSONRPCLines(conn net.Conn) *jsonrpcLines {
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), jsonrpcMaxLine)
+	return &jsonrpcLines{conn: conn, sc: sc}
+}
+
+func (jl *jsonrpcLines) next() ([]byte, error) {
+	if !jl.sc.Scan() {
+		err := jl.sc.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	return append([]byte(nil), jl.sc.Bytes()...), nil
+}
+
+func (jl *jsonrpcLines) write(data []byte) error {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+	_, err := jl.conn.Write(append(data, '\n'))
+	return err
+}
+
+type jsonrpcWS struct {
+	wc *transport.WSConn
+}
+
+func (jw jsonrpcWS) next() ([]byte, error) {
+	_, data, err := jw.wc.ReadMessage()
+	return data, err
+}
+
+func (jw jsonrpcWS) write(data []byte) error {
+	return jw.wc.WriteMessage(transport.WSText, data)
+}
+
+func newJSONRPCStream(conn net.Conn) jsonrpcStream {
+	if wc, ok := conn.(*transport.WSConn); ok {
+		return jsonrpcWS{wc}
+	}
+	return newJSONRPCLines(conn)
+}
+
+// isJSONRPC 连接上使用 JSON-RPC 而不是原生帧
+func isJSONRPC(l *listener, conn net.Conn) bool {
+	if wc, ok := conn.(*transport.WSConn); ok {
+		return wc.Protocol() == WSProtocolJSON
+	}
+	return l.protocol == consts.ProtocolJSONRPC
+}
+
+// serveJSONRPC jsonrpc@ 的 tcp 连接或 JSON 模式的 websocket
+func (s *Server) serveJSONRPC(l *listener, conn net.Conn) {
+	fun := "Server.serveJSONRPC"
+	j := &jsonrpcHandler{s: s, cfg: l.cfg, limiter: &l.limiter}
+	p := &jsonrpcPeer{
+		addr:      conn.RemoteAddr().String(),
+		transport: TransportJSONRPC,
+		authed:    j.authenticator() == nil,
+	}
+	limits := l.cfg.Limits
+	if limits == nil {
+		limits = &s.limits
+	}
+	st := newJSONRPCStream(conn)
+	n := DefaultHandlerNumber
+	if l.cfg.HandlerNumber > 0 {
+		n = l.cfg.HandlerNumber
+	}
+	// 处理中的请求达到上限时不再读取
+	sem := make(chan struct{}, n)
+
+	s.stats.onOpen()
+	reason := ClosePeer
+	die := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		close(die)
+		_ = conn.Close()
+		s.stats.onClose(reason)
+	}()
+	go func() {
+		select {
+		case <-s.done:
+			_ = conn.Close()
+		case <-die:
+		}
+	}()
+
+	write := func(data []byte) {
+		if limits.WriteTimeout > 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(limits.WriteTimeout))
+		}
+		err := st.write(data)
+		if err != nil {
+			log.Warningf("", "%s remote:%s write failed err:%v", fun, p.addr, err)
+		}
+	}
+
+	for {
+		if limits.IdleTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(limits.IdleTimeout))
+		}
+		data, err := st.next()
+		switch {
+		case err == nil:
+		case err == bufio.ErrTooLong || err == transport.ErrWSTooLarge:
+			reason = CloseProtocol
+			write(j.marshal(j.errorResponse(nil, lcode.JSONRPCParseError,
+				lcode.Errorf(lcode.CodeResourceExhausted, "request exceeds %d bytes", jsonrpcMaxLine), "")))
+			return
+		case isTimeout(err):
+			reason = CloseIdle
+			return
+		default:
+			return
+		}
+
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+		// 鉴权的结果影响之后的请求, 需要处理完再读下一个
+		if _, authed := p.auth(); !authed || bytes.Contains(data, []byte(JSONRPCAuthMethod)) {
+			out := j.serve(p, data)
+			if out != nil {
+				write(out)
+			}
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			out := j.serve(p, data)
+			if out != nil {
+				write(out)
+			}
+		}()
+	}
+}
+
+// rejectJSONRPC 连接数超限
+func rejectJSONRPC(conn net.Conn, err error) {
+	log.Warningf("", "rejectJSONRPC remote:%s err:%v", conn.RemoteAddr(), err)
+	j := &jsonrpcHandler{}
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = newJSONRPCStream(conn).write(j.marshal(j.errorResponse(nil, 0, err, "")))
+	_ = conn.Close()
+}
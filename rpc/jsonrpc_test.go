@@ -0,0 +1,161 @@
+package rpc_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/consts"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+)
+
+func TestJSONRPC(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	_ = s.Register(&models.Gogo{})
+	s.SetAuthorizer(auth.NewPolicyAuthorizer(&auth.Policy{
+		Default: auth.EffectAllow,
+		Rules:   []*auth.Rule{{Effect: auth.EffectDeny, Service: "Gogo"}},
+	}))
+	ta := auth.NewTokenAuthenticator()
+	ta.AddToken("t0ken", &auth.Principal{Name: "alice"})
+	err := s.AddListener(&rpc.ListenerConfig{Addr: "http@127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddListener(&rpc.ListenerConfig{Addr: "jsonrpc@127.0.0.1:0", Authenticator: ta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	eps := s.Endpoints()
+	url := "http://" + strings.TrimPrefix(eps[0], "http@") + consts.DefaultJSONRPCPath
+
+	post := func(body string) (int, string) {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	status, body := post(`{"jsonrpc":"2.0","method":"Foo.Sum","params":{"Num1":1,"Num2":2},"id":1}`)
+	if status != http.StatusOK || body != `{"jsonrpc":"2.0","result":{"Num":3},"id":1}` {
+		t.Fatalf("unexpected %d %s", status, body)
+	}
+
+	status, body = post(`[
+		{"jsonrpc":"2.0","method":"Foo.Sum","params":[{"Num1":2,"Num2":3}],"id":"a"},
+		{"jsonrpc":"2.0","method":"Foo.Sum","params":{"Num1":1,"Num2":1}},
+		{"jsonrpc":"2.0","method":"Foo.Nope","id":2},
+		{"jsonrpc":"2.0","method":"Gogo.Demo","params":{},"id":3},
+		{"foo":1}
+	]`)
+	var resps []rpc.JSONRPCResponse
+	err = json.Unmarshal([]byte(body), &resps)
+	if err != nil || status != http.StatusOK || len(resps) != 4 {
+		t.Fatalf("unexpected batch %d %s err:%v", status, body, err)
+	}
+	if string(resps[0].ID) != `"a"` || resps[0].Error != nil {
+		t.Fatalf("unexpected batch[0] %s", body)
+	}
+	for i, c := range []struct {
+		id   string
+		n    int
+		code lcode.Code
+	}{
+		{"2", lcode.JSONRPCMethodNotFound, lcode.CodeNotFound},
+		{"3", lcode.CodePermissionDenied.JSONRPCCode(), lcode.CodePermissionDenied},
+		{"null", lcode.JSONRPCInvalidRequest, lcode.CodeInvalidRequest},
+	} {
+		r := resps[i+1]
+		if string(r.ID) != c.id || r.Error == nil || r.Error.Code != c.n || lcode.ErrorCode(r.Error.Err()) != c.code {
+			t.Fatalf("batch[%d] expect %s/%d/%s, got %s", i+1, c.id, c.n, c.code, body)
+		}
+	}
+
+	status, body = post(`[{"jsonrpc":"2.0","method":"Foo.Sum","params":{}}]`)
+	if status != http.StatusNoContent || body != "" {
+		t.Fatalf("expect no content for notifications, got %d %s", status, body)
+	}
+	status, body = post(`{"jsonrpc":"2.0","method"`)
+	if !strings.Contains(body, `"code":-32700`) || !strings.HasSuffix(body, `"id":null}`) {
+		t.Fatalf("expect parse error, got %d %s", status, body)
+	}
+
+	// tcp 每行一个请求, 需要先鉴权
+	conn, err := net.Dial("tcp", strings.TrimPrefix(eps[1], "jsonrpc@"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	roundTrip := func(line string) *rpc.JSONRPCResponse {
+		_, err := conn.Write([]byte(line + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		data, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp rpc.JSONRPCResponse
+		err = json.Unmarshal(data, &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &resp
+	}
+
+	sum := `{"jsonrpc":"2.0","method":"Foo.Sum","params":{"Num1":4,"Num2":5},"id":7}`
+	resp := roundTrip(sum)
+	if resp.Error == nil || resp.Error.Data.Code != lcode.CodeUnauthenticated {
+		t.Fatalf("expect unauthenticated, got %+v", resp)
+	}
+	resp = roundTrip(`{"jsonrpc":"2.0","method":"rpc.authenticate","params":{"scheme":"bearer","token":"t0ken"},"id":0}`)
+	if resp.Error != nil {
+		t.Fatalf("authenticate failed %+v", resp.Error)
+	}
+	_, _ = conn.Write([]byte(`{"jsonrpc":"2.0","method":"Foo.Sum","params":{}}` + "\n"))
+	resp = roundTrip(sum)
+	if resp.Error != nil || string(resp.ID) != "7" || string(resp.Result) != `{"Num":9}` {
+		t.Fatalf("unexpected %+v", resp)
+	}
+
+	// 鉴权和之后的调用一起发送时按顺序处理
+	pipelined, err := net.Dial("tcp", strings.TrimPrefix(eps[1], "jsonrpc@"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = pipelined.Close() }()
+	_, err = pipelined.Write([]byte(`{"jsonrpc":"2.0","method":"rpc.authenticate","params":{"scheme":"bearer","token":"t0ken"},"id":0}` + "\n" + sum + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pipelined.SetReadDeadline(time.Now().Add(time.Second))
+	pr := bufio.NewReader(pipelined)
+	for i := 0; i < 2; i++ {
+		data, err := pr.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp rpc.JSONRPCResponse
+		if err = json.Unmarshal(data, &resp); err != nil || resp.Error != nil {
+			t.Fatalf("expect pipelined call ok, got %s", data)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package rpc
+
+/*
+ * 连接数限制, 空闲超时, 单帧读写超时, 保活探测
+ * */
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+)
+
+// Limits 零值表示不限制, MaxBatch 和 MaxWSMessage 除外
+type Limits struct {
+	MaxConns      int           // 单个监听地址的最大连接数, 所有地址合计见 Server.SetMaxConns
+	MaxConnsPerIP int           // 单个来源ip的最大连接数, 只对tcp生效
+	IdleTimeout   time.Duration // 没有请求超过该时间关闭连接
+	ReadTimeout   time.Duration // 收到帧长度后读完整帧的超时
+	WriteTimeout  time.Duration // 写一帧的超时
+	PingInterval  time.Duration // 连接上没有数据超过该时间发送ping
+	PingTimeout   time.Duration // 发送ping后超过该时间没有任何数据则关闭
+	MaxBatch      int           // 单个批量调用的最大条数, 0 使用 DefaultMaxBatch, 小于 0 不限制
+	MaxWSMessage  int           // websocket 单个消息的最大字节数, 0 使用 transport.DefaultWSMaxMessage
+}
+
+func (l *Limits) keepalive() bool {
+	return l.PingInterval > 0
+}
+
+type CloseReason int32
+
+const (
+	CloseNone CloseReason = iota
+	ClosePeer
+	CloseIdle
+	CloseReadTimeout
+	CloseWriteError
+	ClosePingTimeout
+	CloseLimit
+	CloseHandshake
+	CloseProtocol
+	CloseShutdown
+
+	closeReasonNum
+)
+
+var closeReasonText = [closeReasonNum]string{
+	CloseNone:        "none",
+	ClosePeer:        "peer",
+	CloseIdle:        "idle",
+	CloseReadTimeout: "read_timeout",
+	CloseWriteError:  "write_error",
+	ClosePingTimeout: "ping_timeout",
+	CloseLimit:       "limit",
+	CloseHandshake:   "handshake",
+	CloseProtocol:    "protocol",
+	CloseShutdown:    "shutdown",
+}
+
+func (r CloseReason) String() string {
+	if r < 0 || r >= closeReasonNum {
+		return "unknown"
+	}
+	return closeReasonText[r]
+}
+
+var (
+	errWaitTimeout  = errors.New("rpc server: wait frame timeout")
+	errFrameTimeout = errors.New("rpc server: read frame timeout")
+)
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+type connStats struct {
+	open     int64
+	accepted uint64
+	closed   [closeReasonNum]uint64
+}
+
+func (cs *connStats) onOpen() {
+	atomic.AddInt64(&cs.open, 1)
+	atomic.AddUint64(&cs.accepted, 1)
+}
+
+func (cs *connStats) onClose(r CloseReason) {
+	atomic.AddInt64(&cs.open, -1)
+	atomic.AddUint64(&cs.closed[r], 1)
+}
+
+// ClosedStat 按关闭原因统计的连接数
+type ClosedStat struct {
+	Reason string
+	Count  uint64
+}
+
+type ConnStats struct {
+	Open     int64
+	Accepted uint64
+	Closed   []ClosedStat
+}
+
+func (s *Server) ConnStats() ConnStats {
+	cs := &s.stats
+	res := ConnStats{
+		Open:     atomic.LoadInt64(&cs.open),
+		Accepted: atomic.LoadUint64(&cs.accepted),
+	}
+	for r := ClosePeer; r < closeReasonNum; r++ {
+		res.Closed = append(res.Closed, ClosedStat{Reason: r.String(), Count: atomic.LoadUint64(&cs.closed[r])})
+	}
+	return res
+}
+
+func (cs ConnStats) ClosedBy(r CloseReason) uint64 {
+	for _, c := range cs.Closed {
+		if c.Reason == r.String() {
+			return c.Count
+		}
+	}
+	return 0
+}
+
+// SetLimits 监听地址没有单独配置 Limits 时使用
+func (s *Server) SetLimits(l Limits) {
+	s.limits = l
+}
+
+// SetMaxConns 所有监听地址合计的最大连接数, 包括网关和 jsonrpc 的 http 请求及 HandleHTTP 的入口, 0 不限制
+func (s *Server) SetMaxConns(n int) {
+	atomic.StoreInt64(&s.maxConns, int64(n))
+}
+
+// acquireConn 先占服务端的总名额, 再占监听地址的名额
+func (s *Server) acquireConn(cl *connLimiter, l *Limits, ip string) error {
+	err := s.limiter.acquire(int(atomic.LoadInt64(&s.maxConns)), 0, "")
+	if err != nil {
+		return err
+	}
+	err = cl.acquire(l.MaxConns, l.MaxConnsPerIP, ip)
+	if err != nil {
+		s.limiter.release("")
+		return err
+	}
+	return nil
+}
+
+func (s *Server) releaseConn(cl *connLimiter, ip string) {
+	cl.release(ip)
+	s.limiter.release("")
+}
+
+type connLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func remoteIP(conn net.Conn) string {
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	return ""
+}
+
+// acquire max/maxPerIP 为 0 时不限制
+func (cl *connLimiter) acquire(max, maxPerIP int, ip string) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if max > 0 && cl.total >= max {
+		return lcode.Errorf(lcode.CodeResourceExhausted, "too many connections, max %d", max)
+	}
+	if ip != "" && maxPerIP > 0 && cl.perIP[ip] >= maxPerIP {
+		return lcode.Errorf(lcode.CodeResourceExhausted, "too many connections from %s, max %d", ip, maxPerIP)
+	}
+
+	cl.total++
+	if ip != "" {
+		if cl.perIP == nil {
+			cl.perIP = make(map[string]int)
+		}
+		cl.perIP[ip]++
+	}
+	return nil
+}
+
+func (cl *connLimiter) release(ip string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.total--
+	if ip == "" {
+		return
+	}
+	cl.perIP[ip]--
+	if cl.perIP[ip] <= 0 {
+		delete(cl.perIP, ip)
+	}
+}
+
+// rejectConn 读完 Option 后返回错误码, 让客户端拿到明确的拒绝原因
+func rejectConn(conn net.Conn, err error) {
+	fun := "rejectConn"
+	log.Warningf("", "%s remote:%s err:%v", fun, conn.RemoteAddr(), err)
+
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	opt := &Option{}
+	if ReadHandshake(conn, opt) == nil && opt.Version >= HandshakeVersion {
+		_ = WriteHandshake(conn, &HandshakeReply{
+			Code:  lcode.ErrorCode(err),
+			Error: lcode.ErrorDesc(err),
+		})
+	}
+	_ = conn.Close()
+}
+
+// pings 旧版本客户端不认识控制帧, 只靠空闲超时
+func (c *Conn) pings() bool {
+	return c.limits.keepalive() && c.opt.Version >= HandshakeVersion
+}
+
+// waitDeadline 等待下一帧的超时, 取空闲超时和保活超时中较早的
+func (c *Conn) waitDeadline() time.Time {
+	var dl time.Time
+	l := c.limits
+	if l.IdleTimeout > 0 {
+		// 有请求在处理时不算空闲, 到期后再检查
+		base := time.Unix(0, atomic.LoadInt64(&c.lastActive))
+		if atomic.LoadInt32(&c.inflight) > 0 {
+			base = time.Now()
+		}
+		dl = base.Add(l.IdleTimeout)
+	}
+	if c.pings() {
+		pd := time.Unix(0, atomic.LoadInt64(&c.lastRead)).Add(l.PingInterval + l.PingTimeout)
+		if dl.IsZero() || pd.Before(dl) {
+			dl = pd
+		}
+	}
+	return dl
+}
+
+// waitExpired 等待超时后判断是否需要关闭连接
+func (c *Conn) waitExpired() CloseReason {
+	now := time.Now()
+	l := c.limits
+	if c.pings() {
+		lr := time.Unix(0, atomic.LoadInt64(&c.lastRead))
+		if now.Sub(lr) >= l.PingInterval+l.PingTimeout {
+			return ClosePingTimeout
+		}
+	}
+	if l.IdleTimeout > 0 && atomic.LoadInt32(&c.inflight) == 0 {
+		la := time.Unix(0, atomic.LoadInt64(&c.lastActive))
+		if now.Sub(la) >= l.IdleTimeout {
+			return CloseIdle
+		}
+	}
+	return CloseNone
+}
+
+// keepalive 连接上一段时间没有数据时发送ping
+func (c *Conn) keepalive() {
+	l := c.limits
+	if !c.pings() {
+		return
+	}
+
+	t := time.NewTicker(l.PingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			lr := time.Unix(0, atomic.LoadInt64(&c.lastRead))
+			if time.Since(lr) >= l.PingInterval {
+				_ = c.push(&response{h: &lcode.Header{Flag: lcode.FlagPing}})
+			}
+		}
+	}
+}
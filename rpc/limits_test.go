@@ -0,0 +1,128 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+func TestLimits(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	err := s.AddListener(&rpc.ListenerConfig{
+		Addr:   "mem@limits",
+		Limits: &rpc.Limits{MaxConns: 1, IdleTimeout: 100 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	c, err := client.XDial("mem@limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	_, err = client.XDial("mem@limits")
+	if lcode.ErrorCode(err) != lcode.CodeResourceExhausted {
+		t.Fatal("expect resource exhausted, got", err)
+	}
+
+	if !waitFor(2*time.Second, func() bool { return !c.IsAvailable() }) {
+		t.Fatal("expect idle connection closed")
+	}
+	if n := s.ConnStats().ClosedBy(rpc.CloseIdle); n != 1 {
+		t.Fatal("expect 1 idle close, got", n)
+	}
+	if n := s.ConnStats().ClosedBy(rpc.CloseLimit); n != 1 {
+		t.Fatal("expect 1 limit close, got", n)
+	}
+
+	// 空闲关闭后释放了名额
+	if !waitFor(2*time.Second, func() bool {
+		c2, err := client.XDial("mem@limits")
+		if err != nil {
+			return false
+		}
+		_ = c2.Close()
+		return true
+	}) {
+		t.Fatal("expect slot released after idle close")
+	}
+
+	// 服务端总连接数对所有监听地址生效
+	s.SetMaxConns(1)
+	err = s.AddListener(&rpc.ListenerConfig{Addr: "mem@limits-total"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c3 *client.Client
+	if !waitFor(2*time.Second, func() bool {
+		c3, err = client.XDial("mem@limits")
+		return err == nil
+	}) {
+		t.Fatal(err)
+	}
+	defer func() { _ = c3.Close() }()
+	_, err = client.XDial("mem@limits-total")
+	if lcode.ErrorCode(err) != lcode.CodeResourceExhausted {
+		t.Fatal("expect server-wide resource exhausted, got", err)
+	}
+
+	// HandleHTTP 的 CONNECT 入口同样计入
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+	_, err = client.DialHTTP("tcp", hs.Listener.Addr().String())
+	if lcode.ErrorCode(err) != lcode.CodeResourceExhausted {
+		t.Fatal("expect http connect resource exhausted, got", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	s.SetLimits(rpc.Limits{PingInterval: 30 * time.Millisecond, PingTimeout: 60 * time.Millisecond})
+	ln, _ := transport.ListenMem("keepalive")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	// 正常客户端会回pong, 连接保持
+	c, err := client.XDial("mem@keepalive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	// 只完成握手不再读写的对端会被探测为死连接
+	dead, _ := transport.DialMem("keepalive")
+	defer dead.Close()
+	_ = rpc.WriteHandshake(dead, rpc.DefaultOption)
+	_ = rpc.ReadHandshake(dead, &rpc.HandshakeReply{})
+
+	if !waitFor(2*time.Second, func() bool { return s.ConnStats().ClosedBy(rpc.ClosePingTimeout) == 1 }) {
+		t.Fatal("expect dead peer closed by ping timeout")
+	}
+
+	ctx := context.NewContext(gctx.Background())
+	context.SetTraceId(ctx, "keepalive")
+	var reply models.Reply
+	err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 2, Num2: 3}, &reply)
+	if err != nil || reply.Num != 5 {
+		t.Fatalf("expect live connection kept, got %d err:%v", reply.Num, err)
+	}
+}
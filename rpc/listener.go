@@ -0,0 +1,248 @@
+package rpc
+
+/*
+ * 一个 Server 可以同时在多个地址上提供同一组服务
+ * 每个监听地址有自己的编解码默认值, 鉴权和处理限制
+ * */
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/consts"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+type ListenerConfig struct {
+	Addr      string              // protocol@addr, 支持 tcp/unix/mem/http/tls/jsonrpc
+	TLSConfig *tls.Config         // tls@ 必填
+	Transport transport.Transport // 非空时直接在其上服务, 忽略Addr (如gnet)
+
+	CodecType     lcode.Type         // 客户端未指定编解码时使用
+	Authenticator auth.Authenticator // 为空时使用 Server.SetAuthenticator 的设置
+	HandleTimeout time.Duration      // 客户端未指定时的处理超时
+	HandlerNumber int                // 每个连接的处理goroutine数
+	Limits        *Limits            // 为空时使用 Server.SetLimits 的设置
+}
+
+type listener struct {
+	cfg      *ListenerConfig
+	protocol string
+	endpoint string
+	t        transport.Transport
+	ln       net.Listener
+	hs       *http.Server // http@ 走 CONNECT 或 websocket, 其余路径为 JSON 网关
+	limiter  connLimiter
+}
+
+func (l *listener) close() error {
+	if l.hs != nil {
+		return l.hs.Close()
+	}
+	return l.t.Close()
+}
+
+func listenerEndpoint(protocol string, addr net.Addr) string {
+	ep := transport.Endpoint(addr)
+	if strings.Contains(ep, "@") {
+		return ep
+	}
+	return protocol + "@" + ep
+}
+
+func (s *Server) listen(cfg *ListenerConfig) (*listener, error) {
+	l := &listener{cfg: cfg}
+
+	if cfg.Transport != nil {
+		l.t = cfg.Transport
+		l.protocol = cfg.Transport.Addr().Network()
+		l.endpoint = listenerEndpoint(l.protocol, cfg.Transport.Addr())
+		return l, nil
+	}
+
+	addr := cfg.Addr
+	if addr == "" {
+		addr = consts.DefaultServerAddr
+	}
+	protocol, address, err := transport.ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	l.protocol = protocol
+
+	switch protocol {
+	case consts.ProtocolHTTP:
+		l.ln, err = net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		mux := http.NewServeMux()
+		mux.Handle(consts.DefaultRpcPath, &httpConnHandler{s: s, l: l})
+		mux.Handle(consts.DefaultDebugPath, debugHTTP{s})
+		mux.Handle(consts.DefaultDebugJSONPath, debugJSON{s})
+		mux.Handle(consts.DefaultMetricsPath, s.Metrics())
+		mux.Handle(consts.DebugMetricsPath, s.Metrics())
+		mux.Handle(consts.DefaultJSONRPCPath, &jsonrpcHandler{s: s, cfg: cfg, limiter: &l.limiter})
+		mux.Handle(consts.DefaultWebSocketPath, &wsHandler{s: s, l: l})
+		mux.Handle("/", &gateway{s: s, cfg: cfg, limiter: &l.limiter})
+		l.hs = &http.Server{Handler: mux}
+		if cfg.Limits != nil {
+			l.hs.IdleTimeout = cfg.Limits.IdleTimeout
+		}
+	case consts.ProtocolTLS:
+		if cfg.TLSConfig == nil {
+			return nil, errors.New("rpc server: tls listener requires TLSConfig")
+		}
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		l.ln = tls.NewListener(ln, cfg.TLSConfig)
+		l.t = transport.NewStdTransport(l.ln)
+	case consts.ProtocolJSONRPC:
+		l.ln, err = net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		l.t = transport.NewStdTransport(l.ln)
+	default:
+		l.ln, err = transport.Listen(protocol, address)
+		if err != nil {
+			return nil, err
+		}
+		l.t = transport.NewStdTransport(l.ln)
+	}
+
+	l.endpoint = listenerEndpoint(protocol, l.ln.Addr())
+	return l, nil
+}
+
+// AddListener 开始在新的地址上提供服务, 不阻塞
+func (s *Server) AddListener(cfg *ListenerConfig) error {
+	fun := "Server.AddListener"
+	l, err := s.listen(cfg)
+	if err != nil {
+		log.Errorf("", "%s listen %s failed err:%v", fun, cfg.Addr, err)
+		return err
+	}
+
+	s.addListener(l)
+	go func() {
+		err := s.serveListener(l)
+		if err != nil {
+			log.Errorf("", "%s serve %s stopped err:%v", fun, l.endpoint, err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) addListener(l *listener) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	log.Infof("", "Server.addListener serving on %s", l.endpoint)
+	if s.lease() != 0 {
+		_ = s.putEndpoint(l.endpoint)
+	}
+}
+
+func (s *Server) serveListener(l *listener) error {
+	if l.hs != nil {
+		return l.hs.Serve(l.ln)
+	}
+	return l.t.Serve(func(conn net.Conn) {
+		s.serveConn(l, conn)
+	})
+}
+
+func (s *Server) serveConn(l *listener, conn net.Conn) {
+	limits := l.cfg.Limits
+	if limits == nil {
+		limits = &s.limits
+	}
+
+	ip := remoteIP(conn)
+	err := s.acquireConn(&l.limiter, limits, ip)
+	if err != nil {
+		s.stats.onOpen()
+		s.stats.onClose(CloseLimit)
+		if isJSONRPC(l, conn) {
+			rejectJSONRPC(conn, err)
+		} else {
+			rejectConn(conn, err)
+		}
+		return
+	}
+	defer s.releaseConn(&l.limiter, ip)
+
+	if isJSONRPC(l, conn) {
+		s.serveJSONRPC(l, conn)
+		return
+	}
+
+	c := newConn(s, conn, l.cfg)
+	c.Serve()
+}
+
+// Endpoints 所有监听地址, 格式 protocol@addr
+func (s *Server) Endpoints() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eps := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		eps = append(eps, l.endpoint)
+	}
+	return eps
+}
+
+// Shutdown 关闭所有监听并从注册中心注销
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	ls := s.listeners
+	s.listeners = nil
+	s.mu.Unlock()
+
+	var first error
+	for _, l := range ls {
+		err := l.close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	s.conns.Range(func(k, v interface{}) bool {
+		k.(*Conn).CloseWithReason(CloseShutdown)
+		return true
+	})
+
+	if s.lease() != 0 {
+		s.Stop()
+	}
+
+	s.doneOnce.Do(func() {
+		close(s.done)
+	})
+	return first
+}
+
+type httpConnHandler struct {
+	s *Server
+	l *listener
+}
+
+func (h *httpConnHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, ok := hijackConnect(w, r)
+	if !ok {
+		return
+	}
+	h.s.serveConn(h.l, conn)
+}
@@ -0,0 +1,114 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+)
+
+func testTLSConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "lrpc-test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}, pool
+}
+
+func TestMultiListener(t *testing.T) {
+	lcode.Init()
+
+	dir, _ := ioutil.TempDir("", "lrpc-client")
+	defer os.RemoveAll(dir)
+	serverTLS, pool := testTLSConfig(t)
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+
+	ta := auth.NewTokenAuthenticator()
+	ta.AddToken("t0ken", &auth.Principal{Name: "alice"})
+
+	cfgs := []*rpc.ListenerConfig{
+		{Addr: "tcp@127.0.0.1:0"},
+		{Addr: "unix@" + filepath.Join(dir, "lrpc.sock")},
+		{Addr: "http@127.0.0.1:0"},
+		{Addr: "tls@127.0.0.1:0", TLSConfig: serverTLS},
+		{Addr: "mem@multi", Authenticator: ta, CodecType: lcode.GobType},
+	}
+	for _, cfg := range cfgs {
+		if err := s.AddListener(cfg); err != nil {
+			t.Fatal(cfg.Addr, err)
+		}
+	}
+
+	eps := s.Endpoints()
+	if len(eps) != len(cfgs) {
+		t.Fatalf("expect %d endpoints, got %v", len(cfgs), eps)
+	}
+
+	ctx := context.NewContext(gctx.Background())
+	context.SetTraceId(ctx, "multi")
+	for _, ep := range eps {
+		opt := &rpc.Option{TLSConfig: &tls.Config{RootCAs: pool}}
+		if strings.HasPrefix(ep, "mem@") {
+			opt.Credentials = auth.TokenCredentials("t0ken")
+		}
+		c, err := client.XDial(ep, opt)
+		if err != nil {
+			t.Fatal(ep, err)
+		}
+		var reply models.Reply
+		err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 1, Num2: 1}, &reply)
+		if err != nil || reply.Num != 2 {
+			t.Fatalf("%s expect 2, got %d err:%v", ep, reply.Num, err)
+		}
+		_ = c.Close()
+	}
+
+	if _, err := client.XDial("mem@multi"); lcode.ErrorCode(err) != lcode.CodeUnauthenticated {
+		t.Fatal("expect mem listener to require auth, got", err)
+	}
+
+	_ = s.Shutdown()
+	for _, ep := range eps {
+		if _, err := client.XDial(ep, &rpc.Option{ConnectTimeout: time.Second}); err == nil {
+			t.Fatal("expect dial failure after shutdown", ep)
+		}
+	}
+}
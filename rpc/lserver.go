@@ -2,24 +2,34 @@ package rpc
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 
+	"github.com/zulong210220/lrpc/auth"
 	"github.com/zulong210220/lrpc/consts"
 	"github.com/zulong210220/lrpc/lcode"
 	"github.com/zulong210220/lrpc/log"
-	"github.com/zulong210220/lrpc/utils"
+	"github.com/zulong210220/lrpc/transport"
 )
 
 const (
 	MagicNumber = 0x3bef5c
+
+	// HandshakeVersion 客户端声明该版本后服务端才回复 HandshakeReply, 旧客户端为 0
+	HandshakeVersion = 1
+
+	// HandshakeTimeout 服务端等待 Option 和 AuthRequest 的超时, 连上后不发数据的客户端不会一直占用连接
+	HandshakeTimeout = 3 * time.Second
 )
 
 type Option struct {
@@ -27,12 +37,36 @@ type Option struct {
 	CodecType      lcode.Type
 	ConnectTimeout time.Duration // 客户端连接超时时间
 	HandleTimeout  time.Duration // 服务端处理超时时间
+	AuthScheme     string        // 为空表示不携带凭证
+	Version        int           // 握手版本, 0 为不读取 HandshakeReply 的旧客户端
+
+	Credentials auth.Credentials `json:"-"` // 客户端凭证, 不参与序列化
+	TLSConfig   *tls.Config      `json:"-"` // tls@ 地址使用
+	Reconnect   *ReconnectPolicy `json:"-"` // 客户端断开后自动重连, 为空时不重连
+}
+
+// ReconnectPolicy 客户端重连的退避和排队, 零值字段使用 DefaultReconnectPolicy 中的值
+type ReconnectPolicy struct {
+	BaseDelay   time.Duration // 第一次失败后的等待
+	MaxDelay    time.Duration // 等待的上限
+	Multiplier  float64       // 每次失败后等待乘以该值
+	Jitter      float64       // 等待随机浮动的比例, 如 0.2 为 ±20%
+	MaxAttempts int           // 连续失败该次数后关闭客户端, 0 不限制
+	QueueSize   int           // 重连期间排队等待的调用数, 0 表示直接失败
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{
+	BaseDelay:  100 * time.Millisecond,
+	MaxDelay:   10 * time.Second,
+	Multiplier: 1.6,
+	Jitter:     0.2,
 }
 
 var DefaultOption = &Option{
 	MagicNumber:    MagicNumber,
 	CodecType:      lcode.JsonType,
 	ConnectTimeout: 3 * time.Second,
+	Version:        HandshakeVersion,
 }
 
 // | Option{MagicNumber: xxx, CodecType: xxx}  | Header{ServiceMethod ...} | Body interface{} |
@@ -43,22 +77,47 @@ type Config struct {
 	EtcdAddr    []string
 	EtcdTimeout int
 	ServerName  string
+	Addr        string // protocol@addr, 默认 tcp@:0
 }
 
 type Server struct {
 	serviceMap    sync.Map
 	client        *clientv3.Client
-	leaseID       clientv3.LeaseID //租约ID
+	leaseID       clientv3.LeaseID //租约ID, 原子读写, 见 lease
 	keepAliveChan <-chan *clientv3.LeaseKeepAliveResponse
-	ln            net.Listener
 	name          string
-	endpoint      string
+	addr          string
+	mu            sync.Mutex
+	listeners     []*listener
+	done          chan struct{}
+	doneOnce      sync.Once
 	stop          chan error
+	stopOnce      sync.Once
 	watchServers  []string
+	config        *Config
+	lastKeepAlive int64 // unix nano, etcd 最后一次续租成功
+	start         time.Time
+	authenticator auth.Authenticator
+	authorizer    auth.Authorizer
+	limits        Limits
+	maxConns      int64       // 所有监听地址合计, 见 SetMaxConns
+	limiter       connLimiter // 所有监听地址共用
+	httpl         *listener   // HandleHTTP 挂载的 CONNECT 入口, 使用 Server 级别的设置
+	stats         connStats
+	metrics       *serverMetrics
+	inspector     inspector
+	interceptors  []Interceptor
+	conns         sync.Map // *Conn => struct{}
 }
 
 func NewServer() *Server {
-	s := &Server{}
+	s := &Server{
+		done:  make(chan struct{}),
+		stop:  make(chan error),
+		start: time.Now(),
+		httpl: &listener{cfg: &ListenerConfig{}, protocol: consts.ProtocolHTTP},
+	}
+	s.metrics = newServerMetrics(s)
 	return s
 }
 
@@ -70,27 +129,19 @@ func (s *Server) Init(c *Config) {
 		DialTimeout: time.Duration(c.EtcdTimeout) * time.Second,
 	}
 	s.name = c.ServerName
+	s.addr = c.Addr
+	s.config = c
 
 	s.client, err = clientv3.New(config)
 	if err != nil {
 		log.Errorf("%s err:%v", fun, err)
 		return
 	}
-
-	s.stop = make(chan error)
-}
-
-func (s *Server) getListenPort() string {
-	la := s.ln.Addr().String()
-	ss := strings.Split(la, ":")
-	if len(ss) == 0 {
-		return ""
-	}
-	return ss[len(ss)-1]
 }
 
-func (s *Server) getEtcdKey() string {
-	return fmt.Sprintf("%s/%s/%s", consts.DefaultRegPath, s.name, s.endpoint)
+// etcd key 最后一段是 endpoint, unix 地址带 / 需要转义
+func (s *Server) getEtcdKey(endpoint string) string {
+	return fmt.Sprintf("%s/%s/%s", consts.DefaultRegPath, s.name, url.PathEscape(endpoint))
 }
 
 func (s *Server) getEtcdValue() string {
@@ -99,13 +150,6 @@ func (s *Server) getEtcdValue() string {
 
 func (s *Server) registryEtcd() error {
 	fun := "Server.registryEtcd"
-	ctx := context.Background()
-	// wait endpoint not null
-	for s.endpoint == "" {
-
-	}
-	key := s.getEtcdKey()
-	value := s.getEtcdValue()
 
 	//创建一个新的租约，并设置ttl时间
 	resp, err := s.client.Grant(context.Background(), consts.DefaultRegLease)
@@ -113,11 +157,14 @@ func (s *Server) registryEtcd() error {
 		log.Errorf("", "%s client.Grant failed err:%v", fun, err)
 		return err
 	}
+	atomic.StoreInt64((*int64)(&s.leaseID), int64(resp.ID))
 
-	ps, err := s.client.Put(ctx, key, value, clientv3.WithLease(resp.ID))
-	if err != nil {
-		log.Errorf("", "%s client.Put ps:%+v failed err:%v", fun, ps, err)
-		return err
+	// 每个监听地址一个key, 共用同一个租约
+	for _, ep := range s.Endpoints() {
+		err = s.putEndpoint(ep)
+		if err != nil {
+			return err
+		}
 	}
 
 	//设置续租 定期发送需求请求
@@ -130,59 +177,109 @@ func (s *Server) registryEtcd() error {
 		return err
 	}
 
-	s.leaseID = resp.ID
 	s.keepAliveChan = leaseRespChan
 
 	s.selectLoop()
 	return err
 }
 
+func (s *Server) putEndpoint(endpoint string) error {
+	fun := "Server.putEndpoint"
+	// jsonrpc@ 不是原生协议, 不注册给客户端发现
+	if strings.HasPrefix(endpoint, consts.ProtocolJSONRPC+"@") {
+		return nil
+	}
+	key := s.getEtcdKey(endpoint)
+	value := s.getEtcdValue()
+
+	ps, err := s.client.Put(context.Background(), key, value, clientv3.WithLease(s.lease()))
+	if err != nil {
+		log.Errorf("", "%s client.Put ps:%+v failed err:%v", fun, ps, err)
+		return err
+	}
+	return nil
+}
+
+// lease 注册前为 0, addListener 可能和 registryEtcd 并发
+func (s *Server) lease() clientv3.LeaseID {
+	return clientv3.LeaseID(atomic.LoadInt64((*int64)(&s.leaseID)))
+}
+
 // revoke 注销服务
 func (s *Server) revoke() error {
 	fun := "Server.revoke"
 	//撤销租约
-	if _, err := s.client.Revoke(context.Background(), s.leaseID); err != nil {
+	if _, err := s.client.Revoke(context.Background(), s.lease()); err != nil {
 		log.Errorf("", "%s client.Revoke failed err:%v", fun, err)
 		return err
 	}
 	return s.client.Close()
 }
 
+// SetAuthenticator 设置后所有连接都必须在握手阶段通过鉴权
+func (s *Server) SetAuthenticator(a auth.Authenticator) {
+	s.authenticator = a
+}
+
+// SetAuthorizer 设置后每次调用前按 service/method 校验调用方权限
+func (s *Server) SetAuthorizer(a auth.Authorizer) {
+	s.authorizer = a
+}
+
+// Stop 通知 selectLoop 注销服务, 可重复调用, selectLoop 已退出或未启动时不阻塞
 func (s *Server) Stop() {
-	s.stop <- nil
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
 }
 
 // https://github.com/golang/go/issues/27707
 
 var DefaultServer = NewServer()
 
-func (s *Server) Accept(ln net.Listener) {
-	fun := "Server.Accept"
-
-	if ln != nil {
-		s.ln = ln
-	} else {
-		s.ln, _ = net.Listen("tcp", ":0")
+// Listen 按 protocol@addr 监听, 支持 tcp/unix/mem
+func (s *Server) Listen(addr string) (net.Listener, error) {
+	if addr == "" {
+		addr = consts.DefaultServerAddr
 	}
+	network, address, err := transport.ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Listen(network, address)
+}
 
-	lip, _ := utils.ExternalIP()
-	s.endpoint = lip.String() + ":" + s.getListenPort()
-	fmt.Println(s.endpoint)
+// Accept 在ln上提供服务, 阻塞直到ln关闭
+func (s *Server) Accept(ln net.Listener) {
+	fun := "Server.Accept"
 
-	for {
-		conn, err := s.ln.Accept()
-		fmt.Println("Accept", conn.LocalAddr(), conn.LocalAddr())
+	if ln == nil {
+		var err error
+		ln, err = s.Listen(s.addr)
 		if err != nil {
-			log.Errorf("", "%s rpc server accept failed err:%v", fun, err)
+			log.Errorf("", "%s rpc server listen %s failed err:%v", fun, s.addr, err)
 			return
 		}
+	}
 
-		//go s.ServeConn(conn)
-		c := NewConn(s, conn)
-		go c.Serve()
+	err := s.Serve(transport.NewStdTransport(ln))
+	if err != nil {
+		log.Errorf("", "%s rpc server accept failed err:%v", fun, err)
 	}
 }
 
+// Serve 在指定的传输层上提供服务, 阻塞直到传输层关闭
+func (s *Server) Serve(t transport.Transport) error {
+	l := &listener{
+		cfg:      &ListenerConfig{Transport: t},
+		protocol: t.Addr().Network(),
+		t:        t,
+	}
+	l.endpoint = listenerEndpoint(l.protocol, t.Addr())
+	s.addListener(l)
+	return s.serveListener(l)
+}
+
 func (s *Server) selectLoop() {
 	for {
 		select {
@@ -199,14 +296,25 @@ func (s *Server) selectLoop() {
 				return
 			} else {
 				//log.Infof("", "Recv reply from service: %s, ttl:%d", s.name, ka.TTL)
+				atomic.StoreInt64(&s.lastKeepAlive, time.Now().UnixNano())
 			}
 		}
 	}
 }
 
+// Run 没有通过 AddListener 添加监听时使用 Config.Addr, 阻塞直到 Shutdown
 func (s *Server) Run() {
-	go s.registryEtcd()
-	s.Accept(nil)
+	if len(s.Endpoints()) == 0 {
+		err := s.AddListener(&ListenerConfig{Addr: s.addr})
+		if err != nil {
+			return
+		}
+	}
+
+	if s.client != nil {
+		go s.registryEtcd()
+	}
+	<-s.done
 }
 
 func Accept(ln net.Listener) {
@@ -254,4 +362,19 @@ func (s *Server) findService(sm string) (svc *service, mType *methodType, err er
 	return
 }
 
+// findMethod 流式方法只能通过流调用, 反之亦然
+func (s *Server) findMethod(sm string, stream bool) (*service, *methodType, error) {
+	svc, mType, err := s.findService(sm)
+	if err != nil {
+		return nil, nil, lcode.NewError(lcode.CodeNotFound, err.Error())
+	}
+	if mType.stream != stream {
+		if stream {
+			return nil, nil, lcode.Errorf(lcode.CodeInvalidRequest, "rpc server: %s is not a stream method", sm)
+		}
+		return nil, nil, lcode.Errorf(lcode.CodeInvalidRequest, "rpc server: %s is a stream method", sm)
+	}
+	return svc, mType, nil
+}
+
 /* vim: set tabstop=4 set shiftwidth=4 */
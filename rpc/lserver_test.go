@@ -0,0 +1,44 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"testing"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+func TestGnetTransport(t *testing.T) {
+	lcode.Init()
+
+	tr, err := transport.ListenGnet("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("gnet unavailable", err)
+	}
+	defer tr.Close()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	go s.Serve(tr)
+
+	c, err := client.Dial("tcp", tr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	ctx := context.NewContext(gctx.Background())
+	context.SetTraceId(ctx, "gnet")
+	for i := 0; i < 10; i++ {
+		var reply models.Reply
+		err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: i, Num2: i}, &reply)
+		if err != nil || reply.Num != 2*i {
+			t.Fatalf("expect %d, got %d err:%v", 2*i, reply.Num, err)
+		}
+	}
+}
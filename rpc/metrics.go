@@ -0,0 +1,78 @@
+package rpc
+
+/*
+ * 服务端指标, Prometheus 文本格式
+ * HandleHTTP 只挂 consts.DebugMetricsPath, consts.DefaultMetricsPath 需要 HandleMetrics 或自行挂载
+ * */
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/metrics"
+)
+
+type serverMetrics struct {
+	reg *metrics.Registry
+
+	requests *metrics.CounterVec   // method
+	errors   *metrics.CounterVec   // method, code
+	latency  *metrics.HistogramVec // method
+	inflight *metrics.GaugeVec     // method
+	oneway   *metrics.CounterVec   // method
+
+	bytesIn  *metrics.Counter
+	bytesOut *metrics.Counter
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	m := &serverMetrics{
+		reg:      metrics.NewRegistry(),
+		requests: metrics.NewCounterVec("lrpc_server_requests_total", "Total number of requests handled, by method.", "method"),
+		errors:   metrics.NewCounterVec("lrpc_server_errors_total", "Total number of failed requests, by method and code.", "method", "code"),
+		latency:  metrics.NewHistogramVec("lrpc_server_request_duration_seconds", "Request handling latency in seconds.", nil, "method"),
+		inflight: metrics.NewGaugeVec("lrpc_server_in_flight_requests", "Number of requests currently being handled.", "method"),
+		oneway:   metrics.NewCounterVec("lrpc_server_oneway_requests_total", "Total number of one-way requests handled without a response, by method.", "method"),
+	}
+
+	bytesIn := metrics.NewCounterVec("lrpc_server_received_bytes_total", "Total bytes of frames received.")
+	bytesOut := metrics.NewCounterVec("lrpc_server_sent_bytes_total", "Total bytes of frames sent.")
+	m.bytesIn = bytesIn.With()
+	m.bytesOut = bytesOut.With()
+
+	cs := &s.stats
+	open := metrics.NewGaugeFunc("lrpc_server_connections", "Number of open connections.", func() float64 {
+		return float64(atomic.LoadInt64(&cs.open))
+	})
+	accepted := metrics.NewCounterVec("lrpc_server_connections_accepted_total", "Total number of accepted connections.")
+	accepted.Func(func() float64 { return float64(atomic.LoadUint64(&cs.accepted)) })
+	closed := metrics.NewCounterVec("lrpc_server_connections_closed_total", "Total number of closed connections, by reason.", "reason")
+	for r := ClosePeer; r < closeReasonNum; r++ {
+		r := r
+		closed.Func(func() float64 { return float64(atomic.LoadUint64(&cs.closed[r])) }, r.String())
+	}
+
+	m.reg.MustRegister(m.requests, m.errors, m.latency, m.inflight, m.oneway, open, accepted, closed, bytesIn, bytesOut)
+	return m
+}
+
+// begin 请求开始处理, 返回的函数在处理结束时调用
+func (m *serverMetrics) begin(method string) func(code lcode.Code) {
+	start := time.Now()
+	g := m.inflight.With(method)
+	g.Inc()
+	return func(code lcode.Code) {
+		g.Dec()
+		m.requests.With(method).Inc()
+		m.latency.With(method).ObserveDuration(time.Since(start))
+		if code != lcode.CodeOK {
+			m.errors.With(method, code.String()).Inc()
+		}
+	}
+}
+
+// Metrics 返回服务端指标, 可以挂到任意 http 路由上
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics.reg
+}
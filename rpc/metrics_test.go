@@ -0,0 +1,124 @@
+package rpc_test
+
+import (
+	"bytes"
+	gctx "context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zulong210220/lrpc/auth"
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/consts"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+)
+
+func TestMetrics(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	_ = s.Register(&models.Gogo{})
+	s.SetAuthorizer(auth.NewPolicyAuthorizer(&auth.Policy{
+		Default: auth.EffectAllow,
+		Rules:   []*auth.Rule{{Effect: auth.EffectDeny, Service: "Gogo"}},
+	}))
+	err := s.AddListener(&rpc.ListenerConfig{Addr: "http@127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	ep := s.Endpoints()[0]
+
+	c, err := client.XDial(ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	ctx := context.NewContext(gctx.Background())
+	context.SetTraceId(ctx, "metrics")
+	var reply models.Reply
+	for i := 0; i < 2; i++ {
+		_ = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 1, Num2: 2}, &reply)
+	}
+	_ = c.Call(ctx, "Gogo.Demo", &models.GogoProtoColorGroup{}, &models.GogoProtoColorGroupRsp{})
+
+	resp, err := http.Get("http://" + strings.TrimPrefix(ep, "http@") + consts.DefaultMetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	for _, line := range []string{
+		`lrpc_server_requests_total{method="Foo.Sum"} 2`,
+		`lrpc_server_errors_total{method="Gogo.Demo",code="permission denied"} 1`,
+		`lrpc_server_request_duration_seconds_count{method="Foo.Sum"} 2`,
+		`lrpc_server_in_flight_requests{method="Foo.Sum"} 0`,
+		`lrpc_server_connections 1`,
+		`lrpc_server_connections_accepted_total 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatalf("server metrics missing %q:\n%s", line, body)
+		}
+	}
+	if !strings.Contains(string(body), "lrpc_server_received_bytes_total ") {
+		t.Fatal("server metrics missing bytes")
+	}
+	resp, err = http.Get("http://" + strings.TrimPrefix(ep, "http@") + consts.DebugMetricsPath)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("expect metrics under debug path, got", resp, err)
+	}
+	_ = resp.Body.Close()
+
+	var buf bytes.Buffer
+	_, _ = client.Metrics.WriteTo(&buf)
+	cep := "tcp@" + strings.TrimPrefix(ep, "http@")
+	for _, line := range []string{
+		`lrpc_client_requests_total{endpoint="` + cep + `",method="Foo.Sum"} 2`,
+		`lrpc_client_errors_total{endpoint="` + cep + `",method="Gogo.Demo",code="permission denied"} 1`,
+		`lrpc_client_in_flight_requests{endpoint="` + cep + `"} 0`,
+		`lrpc_client_connections{endpoint="` + cep + `"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("client metrics missing %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	// 应用自己占用 /metrics 时 HandleHTTP 不冲突
+	http.Handle(consts.DefaultMetricsPath, http.NotFoundHandler())
+	s := rpc.NewServer()
+	s.HandleHTTP()
+
+	hs := httptest.NewServer(http.DefaultServeMux)
+	defer hs.Close()
+	resp, err := http.Get(hs.URL + consts.DebugMetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "lrpc_server_connections ") {
+		t.Fatalf("expect metrics under debug path, got %d:\n%s", resp.StatusCode, body)
+	}
+
+	// HandleMetrics 需要显式调用才占用 /metrics
+	mux := http.DefaultServeMux
+	http.DefaultServeMux = http.NewServeMux()
+	defer func() { http.DefaultServeMux = mux }()
+	s.HandleMetrics()
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", consts.DefaultMetricsPath, nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "lrpc_server_connections ") {
+		t.Fatalf("expect metrics under %s, got %d", consts.DefaultMetricsPath, rec.Code)
+	}
+}
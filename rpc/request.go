@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	gctx "context"
 	"fmt"
 	"reflect"
 
@@ -27,9 +28,33 @@ var (
 
 type request struct {
 	h            *lcode.Header
-	argv, replyv reflect.Value
+	argv, replyv reflect.Value // 流式调用时 argv 为 *Stream, replyv 为空
 	mType        *methodType
 	svc          *service
+	ctx          gctx.Context // 为空时使用 Background
+	body         []byte       // 流式调用的帧, 未解码
+	batch        *batch       // 批量调用中的一条
+}
+
+// newRequest 查找普通方法并用 decode 解码参数, 解码失败为 CodeInvalidRequest
+func (s *Server) newRequest(h *lcode.Header, decode func(argv interface{}) error) (*request, error) {
+	svc, mType, err := s.findMethod(h.ServiceMethod, false)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &request{h: h, svc: svc, mType: mType}
+	req.argv = mType.newArgv()
+	req.replyv = mType.newReplyv()
+	argvi := req.argv.Interface()
+	if req.argv.Type().Kind() != reflect.Ptr {
+		argvi = req.argv.Addr().Interface()
+	}
+	err = decode(argvi)
+	if err != nil {
+		return nil, lcode.Errorf(lcode.CodeInvalidRequest, "decode args failed: %v", err)
+	}
+	return req, nil
 }
 
 func (r *request) Header() *lcode.Header {
@@ -37,6 +62,8 @@ func (r *request) Header() *lcode.Header {
 		ServiceMethod: r.h.ServiceMethod,
 		Seq:           r.h.Seq,
 		Error:         r.h.Error,
+		Code:          r.h.Code,
+		Traceparent:   r.h.Traceparent,
 	}
 	return h
 }
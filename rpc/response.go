@@ -3,6 +3,7 @@ package rpc
 import "github.com/zulong210220/lrpc/lcode"
 
 type response struct {
-	h    *lcode.Header
-	body interface{}
+	h     *lcode.Header
+	body  interface{}
+	batch *batch // 批量调用的合并响应, 在写协程中编码
 }
@@ -0,0 +1,157 @@
+package rpc
+
+/*
+ * 反向调用, 服务端通过已建立的原生连接调用客户端注册的方法
+ *   请求: FlagReverse + ServiceMethod, Seq 由服务端分配, 与客户端的 Seq 互不影响
+ *   响应: FlagReverse + 同一个 Seq, 带 Code/Error, 与普通调用相同
+ * 服务方法中通过 ConnFromContext 取得当前连接, 或通过 Server.Conns 取得所有连接
+ * */
+
+import (
+	gctx "context"
+	"time"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/tracing"
+)
+
+type reverseCall struct {
+	reply lcode.IMessage
+	err   error
+	done  chan struct{}
+}
+
+type connKey struct{}
+
+// ConnFromContext 原生连接上的服务方法可以取得当前连接, 其它传输方式返回 nil
+func ConnFromContext(ctx *context.Context) *Conn {
+	if ctx == nil {
+		return nil
+	}
+	c, _ := ctx.Value(connKey{}).(*Conn)
+	return c
+}
+
+// Conns 当前所有已完成握手的原生连接
+func (s *Server) Conns() []*Conn {
+	var cs []*Conn
+	s.conns.Range(func(k, _ interface{}) bool {
+		cs = append(cs, k.(*Conn))
+		return true
+	})
+	return cs
+}
+
+func (c *Conn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+// Call 调用客户端通过 client.Client.Register 注册的方法, ctx 结束时返回
+func (c *Conn) Call(ctx *context.Context, sm string, args, reply lcode.IMessage) (err error) {
+	fun := "Conn.Call"
+	traceId := context.GetTraceId(ctx)
+	if c.opt.Version < HandshakeVersion {
+		return lcode.Errorf(lcode.CodeInvalidRequest, "rpc server: %s does not support reverse calls", c.RemoteAddr())
+	}
+
+	span := tracing.StartClientSpan(ctx, sm)
+	span.SetAttr("peer", c.RemoteAddr())
+	span.SetAttr("transport", TransportReverse)
+	defer func() {
+		if err != nil {
+			span.SetStatus(lcode.ErrorCode(err).String(), lcode.ErrorDesc(err))
+		}
+		span.End()
+	}()
+
+	rc := &reverseCall{reply: reply, done: make(chan struct{})}
+	c.rmu.Lock()
+	c.rseq++
+	seq := c.rseq
+	c.rcalls[seq] = rc
+	c.rmu.Unlock()
+
+	err = c.push(&response{
+		h: &lcode.Header{
+			ServiceMethod: sm,
+			Seq:           seq,
+			TraceId:       traceId,
+			Traceparent:   span.Context().Traceparent(),
+			Meta:          context.Metadata(ctx),
+			Flag:          lcode.FlagReverse,
+		},
+		body: args,
+	})
+	if err != nil {
+		c.removeReverse(seq)
+		return lcode.NewError(lcode.CodeUnavailable, "rpc server: connection closed")
+	}
+
+	select {
+	case <-ctx.Done():
+		c.removeReverse(seq)
+		log.Errorf(traceId, "%s serviceMethod:%s canceled err:%v", fun, sm, ctx.Err())
+		if ctx.Err() == gctx.DeadlineExceeded {
+			return lcode.Errorf(lcode.CodeDeadlineExceeded, "rpc server: reverse call %s timeout", sm)
+		}
+		return lcode.Errorf(lcode.CodeCanceled, "rpc server: reverse call %s canceled", sm)
+	case <-rc.done:
+		return rc.err
+	}
+}
+
+func (c *Conn) removeReverse(seq uint64) *reverseCall {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	rc := c.rcalls[seq]
+	delete(c.rcalls, seq)
+	return rc
+}
+
+// handleReverse 在读 goroutine 中调用, body 在返回前解码
+func (c *Conn) handleReverse(h *lcode.Header, body []byte) {
+	rc := c.removeReverse(h.Seq)
+	if rc == nil {
+		// 已超时
+		return
+	}
+	rc.err = lcode.HeaderError(h)
+	if rc.err == nil && rc.reply != nil {
+		err := c.Decode(body, rc.reply)
+		if err != nil {
+			rc.err = lcode.Errorf(lcode.CodeInvalidRequest, "rpc server: decode reverse reply failed err:%v", err)
+		}
+	}
+	close(rc.done)
+}
+
+// failReverse 连接关闭时结束所有反向调用
+func (c *Conn) failReverse() {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for seq, rc := range c.rcalls {
+		delete(c.rcalls, seq)
+		rc.err = lcode.NewError(lcode.CodeUnavailable, "rpc server: connection closed")
+		close(rc.done)
+	}
+}
+
+// ServeCall 在没有 Conn 的场景处理一次普通调用, 如客户端处理反向调用
+// decode 把请求体解码到参数, 错误已经写入 info.Header 的 Code/Error
+func (s *Server) ServeCall(info *CallInfo, decode func(argv interface{}) error, timeout time.Duration) (interface{}, error) {
+	h := info.Header
+	req, err := s.newRequest(h, decode)
+	if err != nil {
+		h.Code = lcode.ErrorCode(err)
+		h.Error = lcode.ErrorDesc(err)
+		return nil, err
+	}
+
+	err = s.invoke(info, req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return req.replyv.Interface(), nil
+}
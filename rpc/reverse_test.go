@@ -0,0 +1,102 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+type Hub struct{}
+
+// Subscribe 在处理请求时回调客户端
+func (h *Hub) Subscribe(ctx *context.Context, args models.Args, reply *models.Reply) error {
+	var r models.Reply
+	err := rpc.ConnFromContext(ctx).Call(ctx, "Listener.Notify", &args, &r)
+	reply.Num = r.Num * 10
+	return err
+}
+
+type Listener struct {
+	notified chan int
+}
+
+func (l *Listener) Notify(args models.Args, reply *models.Reply) error {
+	reply.Num = args.Num1 + args.Num2
+	l.notified <- reply.Num
+	return nil
+}
+
+func (l *Listener) Fail(args models.Args, reply *models.Reply) error {
+	return lcode.NewError(lcode.CodePermissionDenied, "not allowed")
+}
+
+func (l *Listener) Slow(args models.Args, reply *models.Reply) error {
+	time.Sleep(200 * time.Millisecond)
+	return nil
+}
+
+func TestReverse(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	_ = s.Register(&Hub{})
+	ln, _ := transport.ListenMem("reverse")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	c, err := client.XDial("mem@reverse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	l := &Listener{notified: make(chan int, 4)}
+	_ = c.Register(l)
+	ctx := context.NewContext(gctx.Background())
+
+	// 处理请求时回调
+	var r models.Reply
+	err = c.Call(ctx, "Hub.Subscribe", &models.Args{Num1: 1, Num2: 2}, &r)
+	if err != nil || r.Num != 30 || <-l.notified != 3 {
+		t.Fatalf("expect 30, got %d err:%v", r.Num, err)
+	}
+
+	// 服务端主动推送
+	conns := s.Conns()
+	if len(conns) != 1 {
+		t.Fatalf("expect 1 conn, got %d", len(conns))
+	}
+	conn := conns[0]
+	err = conn.Call(ctx, "Listener.Notify", &models.Args{Num1: 4, Num2: 5}, &r)
+	if err != nil || r.Num != 9 || <-l.notified != 9 {
+		t.Fatalf("expect 9, got %d err:%v", r.Num, err)
+	}
+
+	// 错误码与正向调用相同
+	err = conn.Call(ctx, "Listener.Fail", &models.Args{}, &r)
+	if lcode.ErrorCode(err) != lcode.CodePermissionDenied {
+		t.Fatalf("expect permission denied, got %v", err)
+	}
+	err = conn.Call(ctx, "Listener.Missing", &models.Args{}, &r)
+	if lcode.ErrorCode(err) != lcode.CodeNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+	tctx, cancel := gctx.WithTimeout(gctx.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = conn.Call(context.NewContext(tctx), "Listener.Slow", &models.Args{}, &r)
+	if lcode.ErrorCode(err) != lcode.CodeDeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	// 连接仍然可用
+	err = c.Call(ctx, "Hub.Subscribe", &models.Args{Num1: 1, Num2: 1}, &r)
+	if err != nil || r.Num != 20 || <-l.notified != 2 {
+		t.Fatalf("expect 20, got %d err:%v", r.Num, err)
+	}
+}
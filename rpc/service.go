@@ -8,10 +8,13 @@ package rpc
  * */
 
 import (
+	gctx "context"
 	"go/ast"
 	"log"
 	"reflect"
 	"sync/atomic"
+
+	"github.com/zulong210220/lrpc/context"
 )
 
 type methodType struct {
@@ -19,12 +22,21 @@ type methodType struct {
 	ArgType   reflect.Type
 	ReplyType reflect.Type
 	numCalls  uint64
+	numOneway uint64
+	stats     methodStats
+	withCtx   bool // func (t *T) M(ctx *context.Context, args A, reply *R) error
+	stream    bool // func (t *T) M(st *Stream) error, ReplyType 为空
 }
 
 func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+// NumOneway 单向调用的次数, 已包含在 NumCalls 中
+func (m *methodType) NumOneway() uint64 {
+	return atomic.LoadUint64(&m.numOneway)
+}
+
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
 
@@ -63,13 +75,19 @@ func newService(rcvr interface{}) *service {
 	s.typ = reflect.TypeOf(rcvr)
 
 	if !ast.IsExported(s.name) {
-		log.Fatalf("", "%s rpc server : %s is not a valid service name", fun, s.name)
+		log.Fatal("", fun, " rpc server : ", s.name, " is not a valid service name")
 	}
 
 	s.registerMethods()
 	return s
 }
 
+var (
+	typeOfContext = reflect.TypeOf((*context.Context)(nil))
+	typeOfStream  = reflect.TypeOf((*Stream)(nil))
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
@@ -80,15 +98,30 @@ func (s *service) registerMethods() {
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		if mType.NumOut() != 1 {
+			continue
+		}
+
+		if mType.NumIn() == 2 && mType.In(1) == typeOfStream && mType.Out(0) == typeOfError {
+			s.method[method.Name] = &methodType{
+				method:  method,
+				ArgType: typeOfStream,
+				stream:  true,
+			}
 			continue
 		}
 
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		// 可选的第一个参数 *context.Context
+		withCtx := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+		if mType.NumIn() != 3 && !withCtx {
 			continue
 		}
 
-		argType, replyType := mType.In(1), mType.In(2)
+		if mType.Out(0) != typeOfError {
+			continue
+		}
+
+		argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
@@ -97,19 +130,30 @@ func (s *service) registerMethods() {
 			method:    method,
 			ArgType:   argType,
 			ReplyType: replyType,
+			withCtx:   withCtx,
 		}
 	}
 }
 
-// 通过反射调用rpc函数代码
 func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+	return s.callCtx(m, context.NewContext(gctx.Background()), argv, replyv)
+}
+
+// 通过反射调用rpc函数代码
+func (s *service) callCtx(m *methodType, ctx *context.Context, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 
 	f := m.method.Func
 
-	retVal := f.Call([]reflect.Value{
-		s.rcvr, argv, replyv,
-	})
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	switch {
+	case m.stream:
+		argv.Interface().(*Stream).ctx = ctx
+		in = []reflect.Value{s.rcvr, argv}
+	case m.withCtx:
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	retVal := f.Call(in)
 
 	// TODO check slice len
 	if errInter := retVal[0].Interface(); errInter != nil {
@@ -12,14 +12,15 @@ import (
 	"testing"
 
 	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/models"
 )
 
 func TestNS(t *testing.T) {
-	var f Foo
+	var f models.Foo
 	s := newService(&f)
 
-	if len(s.method) != 1 {
-		t.Fatalf("wrong service methhod expect 1, but got %d", len(s.method))
+	if len(s.method) != 2 {
+		t.Fatalf("wrong service methhod expect 2, but got %d", len(s.method))
 	}
 
 	mType := s.method["Sum"]
@@ -30,24 +31,24 @@ func TestNS(t *testing.T) {
 }
 
 func TestFoo(t *testing.T) {
-	var f Foo
+	var f models.Foo
 	s := newService(&f)
 	mType := s.method["Sum"]
 
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 
-	argv.Set(reflect.ValueOf(Args{Num1: 11, Num2: 22}))
+	argv.Set(reflect.ValueOf(models.Args{Num1: 11, Num2: 22}))
 	err := s.call(mType, argv, replyv)
 
-	if !(err == nil && *replyv.Interface().(*int) == 33 && mType.NumCalls() == 1) {
+	if !(err == nil && replyv.Interface().(*models.Reply).Num == 33 && mType.NumCalls() == 1) {
 		t.Fatalf("failed to call Foo.Sum")
 	}
 
-	argv.Set(reflect.ValueOf(Args{Num1: 11, Num2: 12}))
+	argv.Set(reflect.ValueOf(models.Args{Num1: 11, Num2: 12}))
 	err = s.call(mType, argv, replyv)
 
-	if !(err == nil && *replyv.Interface().(*int) == 23 && mType.NumCalls() == 2) {
+	if !(err == nil && replyv.Interface().(*models.Reply).Num == 23 && mType.NumCalls() == 2) {
 		t.Fatalf("failed to call Foo.Sum")
 	}
 }
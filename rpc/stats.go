@@ -0,0 +1,109 @@
+package rpc
+
+/*
+ * 每个方法最近的耗时和错误, 供调试页面计算分位数和排查问题
+ * 长期统计看 consts.DefaultMetricsPath
+ * */
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zulong210220/lrpc/lcode"
+)
+
+const (
+	latencySamples = 1024
+	recentErrors   = 16
+)
+
+type ErrorRecord struct {
+	Time    time.Time
+	TraceId string
+	Code    string
+	Error   string
+}
+
+type methodStats struct {
+	mu       sync.Mutex
+	errors   uint64
+	latency  [latencySamples]time.Duration
+	nLatency int
+	recent   [recentErrors]ErrorRecord
+	nRecent  int
+}
+
+func (ms *methodStats) observe(d time.Duration, code lcode.Code, h *lcode.Header) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.latency[ms.nLatency%latencySamples] = d
+	ms.nLatency++
+
+	if code == lcode.CodeOK {
+		return
+	}
+	ms.errors++
+	ms.recent[ms.nRecent%recentErrors] = ErrorRecord{
+		Time:    time.Now(),
+		TraceId: h.TraceId,
+		Code:    code.String(),
+		Error:   h.Error,
+	}
+	ms.nRecent++
+}
+
+// Latency 最近 latencySamples 次调用的耗时分位数
+type Latency struct {
+	Samples int
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	Max     time.Duration
+}
+
+func (ms *methodStats) snapshot() (uint64, Latency, []ErrorRecord) {
+	ms.mu.Lock()
+	n := ms.nLatency
+	if n > latencySamples {
+		n = latencySamples
+	}
+	ds := make([]time.Duration, n)
+	copy(ds, ms.latency[:n])
+
+	m := ms.nRecent
+	if m > recentErrors {
+		m = recentErrors
+	}
+	// 新的在前
+	errs := make([]ErrorRecord, 0, m)
+	for i := 0; i < m; i++ {
+		errs = append(errs, ms.recent[(ms.nRecent-1-i)%recentErrors])
+	}
+	total := ms.errors
+	ms.mu.Unlock()
+
+	lat := Latency{Samples: n}
+	if n == 0 {
+		return total, lat, errs
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	lat.P50 = percentile(ds, 0.50)
+	lat.P90 = percentile(ds, 0.90)
+	lat.P99 = percentile(ds, 0.99)
+	lat.Max = ds[n-1]
+	return total, lat, errs
+}
+
+// percentile ds 已升序
+func percentile(ds []time.Duration, p float64) time.Duration {
+	i := int(float64(len(ds))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(ds) {
+		i = len(ds) - 1
+	}
+	return ds[i]
+}
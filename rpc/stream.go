@@ -0,0 +1,330 @@
+package rpc
+
+/*
+ * 流式调用, 服务端流, 客户端流, 双向流都使用同一个方法签名
+ *   func (t *T) M(st *Stream) error
+ * 帧都带 lcode.FlagStream, Seq 为流 id
+ *   打开: 客户端发送带 ServiceMethod 的空帧
+ *   消息: 每帧一条, body 按连接协商的编解码
+ *   半关闭: FlagEOS; 服务端方法返回后发送带最终 Code/Error 的 EOS
+ *   流控: 按消息数计的窗口, 接收方每消费半个窗口用 FlagWindow 归还
+ *   中止: FlagReset, 服务端方法的 ctx 被取消
+ * */
+
+import (
+	gctx "context"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+)
+
+const (
+	// DefaultStreamWindow 每个方向初始可以发送的消息数
+	DefaultStreamWindow = 64
+
+	// MetaStreamWindow FlagWindow 帧中归还的消息数
+	MetaStreamWindow = "lrpc-window"
+)
+
+var ErrStreamClosed = errors.New("rpc: stream closed")
+
+// StreamWindow 发送窗口, 客户端和服务端共用
+type StreamWindow struct {
+	mu    sync.Mutex
+	avail int
+	ready chan struct{}
+}
+
+func NewStreamWindow(n int) *StreamWindow {
+	return &StreamWindow{avail: n, ready: make(chan struct{}, 1)}
+}
+
+// Acquire 窗口用完时阻塞, done 关闭后返回 ErrStreamClosed
+func (w *StreamWindow) Acquire(done <-chan struct{}) error {
+	for {
+		w.mu.Lock()
+		if w.avail > 0 {
+			w.avail--
+			more := w.avail > 0
+			w.mu.Unlock()
+			if more {
+				w.notify()
+			}
+			return nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.ready:
+		case <-done:
+			return ErrStreamClosed
+		}
+	}
+}
+
+func (w *StreamWindow) Add(n int) {
+	if n <= 0 {
+		return
+	}
+	w.mu.Lock()
+	w.avail += n
+	w.mu.Unlock()
+	w.notify()
+}
+
+func (w *StreamWindow) notify() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// StreamCredit 接收方已消费的消息数
+type StreamCredit struct {
+	mu sync.Mutex
+	n  int
+}
+
+// Consume 消费一条消息, 返回需要归还给对端的消息数, 0 表示暂不归还
+func (sc *StreamCredit) Consume() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.n++
+	if sc.n < DefaultStreamWindow/2 {
+		return 0
+	}
+	n := sc.n
+	sc.n = 0
+	return n
+}
+
+func StreamWindowMeta(n int) map[string]string {
+	return map[string]string{MetaStreamWindow: strconv.Itoa(n)}
+}
+
+func StreamWindowIncrement(h *lcode.Header) int {
+	n, _ := strconv.Atoi(h.Meta[MetaStreamWindow])
+	return n
+}
+
+// Stream 服务端的流, Send 和 Recv 可以在不同的 goroutine 中调用
+type Stream struct {
+	c   *Conn
+	h   *lcode.Header // 打开流的帧
+	ctx *context.Context
+
+	recv   chan []byte
+	win    *StreamWindow
+	credit StreamCredit
+
+	eos     chan struct{} // 客户端半关闭
+	eosOnce sync.Once
+
+	done      chan struct{} // 流结束, 不能再收发
+	closeOnce sync.Once
+	cancel    gctx.CancelFunc
+	err       error
+}
+
+func newStream(c *Conn, h *lcode.Header, cancel gctx.CancelFunc) *Stream {
+	return &Stream{
+		c:      c,
+		h:      h,
+		recv:   make(chan []byte, DefaultStreamWindow),
+		win:    NewStreamWindow(DefaultStreamWindow),
+		eos:    make(chan struct{}),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+}
+
+// Context 带 trace 和元数据, 客户端中止或连接关闭时取消
+func (st *Stream) Context() *context.Context {
+	return st.ctx
+}
+
+func (st *Stream) Method() string {
+	return st.h.ServiceMethod
+}
+
+// Send 窗口用完时阻塞直到客户端消费
+// msg 在写协程中编码, 发送后不能再修改
+func (st *Stream) Send(msg interface{}) error {
+	select {
+	case <-st.done:
+		return st.err
+	default:
+	}
+
+	err := st.win.Acquire(st.done)
+	if err != nil {
+		return st.err
+	}
+	return st.c.push(&response{
+		h:    &lcode.Header{Seq: st.h.Seq, TraceId: st.h.TraceId, Flag: lcode.FlagStream},
+		body: msg,
+	})
+}
+
+// Recv 客户端半关闭且消息读完后返回 io.EOF
+func (st *Stream) Recv(msg interface{}) error {
+	// 已中止的流丢弃未读的消息
+	select {
+	case <-st.done:
+		return st.err
+	default:
+	}
+
+	select {
+	case b := <-st.recv:
+		return st.decode(b, msg)
+	default:
+	}
+
+	select {
+	case b := <-st.recv:
+		return st.decode(b, msg)
+	case <-st.eos:
+		select {
+		case b := <-st.recv:
+			return st.decode(b, msg)
+		default:
+			return io.EOF
+		}
+	case <-st.done:
+		return st.err
+	}
+}
+
+func (st *Stream) decode(b []byte, msg interface{}) error {
+	if n := st.credit.Consume(); n > 0 {
+		_ = st.c.push(&response{h: &lcode.Header{
+			Seq:     st.h.Seq,
+			TraceId: st.h.TraceId,
+			Flag:    lcode.FlagStream | lcode.FlagWindow,
+			Meta:    StreamWindowMeta(n),
+		}})
+	}
+	return st.c.Decode(b, msg)
+}
+
+// abort 只有第一次生效
+func (st *Stream) abort(err error) {
+	st.closeOnce.Do(func() {
+		st.err = err
+		close(st.done)
+		st.cancel()
+	})
+}
+
+// push 交给写协程发送, 连接关闭后不再发送
+func (c *Conn) push(resp *response) error {
+	select {
+	case c.respChan <- resp:
+		return nil
+	case <-c.done:
+		return ErrStreamClosed
+	}
+}
+
+func (c *Conn) handleStream(h *lcode.Header, body []byte) {
+	c.smu.Lock()
+	st := c.streams[h.Seq]
+	c.smu.Unlock()
+
+	switch {
+	case st == nil:
+		if h.ServiceMethod != "" && !h.Is(lcode.FlagReset|lcode.FlagWindow|lcode.FlagEOS) {
+			c.openStream(h)
+		}
+		// 其余为已结束的流, 忽略
+	case h.Is(lcode.FlagReset):
+		st.abort(lcode.NewError(lcode.CodeCanceled, "rpc server: stream reset by client"))
+	case h.Is(lcode.FlagWindow):
+		st.win.Add(StreamWindowIncrement(h))
+	case h.Is(lcode.FlagEOS):
+		st.eosOnce.Do(func() { close(st.eos) })
+	default:
+		select {
+		case st.recv <- append([]byte(nil), body...):
+		default:
+			// 客户端没有遵守窗口
+			log.Warningf(h.TraceId, "Conn.handleStream seq:%d window exceeded", h.Seq)
+			st.abort(lcode.NewError(lcode.CodeResourceExhausted, "rpc server: stream window exceeded"))
+		}
+	}
+}
+
+func (c *Conn) openStream(h *lcode.Header) {
+	svc, mType, err := c.s.findMethod(h.ServiceMethod, true)
+	if err != nil {
+		log.Errorf(h.TraceId, "Conn.openStream findMethod failed serviceMethod:%s err:%v", h.ServiceMethod, err)
+		c.endStream(h, err)
+		return
+	}
+
+	ctx, cancel := gctx.WithCancel(gctx.Background())
+	st := newStream(c, h, cancel)
+	c.smu.Lock()
+	c.streams[h.Seq] = st
+	c.smu.Unlock()
+
+	atomic.AddInt32(&c.inflight, 1)
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+
+	req := &request{
+		h:     h,
+		svc:   svc,
+		mType: mType,
+		argv:  reflect.ValueOf(st),
+		ctx:   ctx,
+	}
+	info := &CallInfo{
+		Header:    h,
+		Peer:      c.conn.RemoteAddr().String(),
+		Principal: c.principal,
+		Transport: TransportLrpc,
+		conn:      c,
+	}
+	go func() {
+		// 流不受处理超时限制
+		err := c.s.invoke(info, req, 0)
+
+		c.smu.Lock()
+		delete(c.streams, h.Seq)
+		c.smu.Unlock()
+		st.abort(ErrStreamClosed)
+
+		c.endStream(h, err)
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+		atomic.AddInt32(&c.inflight, -1)
+	}()
+}
+
+// endStream 发送带最终状态的 EOS
+func (c *Conn) endStream(h *lcode.Header, err error) {
+	eos := &lcode.Header{Seq: h.Seq, TraceId: h.TraceId, Flag: lcode.FlagStream | lcode.FlagEOS}
+	if err != nil {
+		eos.Code = lcode.ErrorCode(err)
+		eos.Error = lcode.ErrorDesc(err)
+	}
+	_ = c.push(&response{h: eos})
+}
+
+// abortStreams 连接关闭时中止所有流
+func (c *Conn) abortStreams() {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	for seq, st := range c.streams {
+		delete(c.streams, seq)
+		st.abort(lcode.NewError(lcode.CodeUnavailable, "rpc server: connection closed"))
+	}
+}
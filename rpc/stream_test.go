@@ -0,0 +1,185 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+type Feed struct {
+	canceled chan error
+}
+
+// Count 服务端流, 发送 Num1 ~ Num2
+func (f *Feed) Count(st *rpc.Stream) error {
+	var args models.Args
+	err := st.Recv(&args)
+	if err != nil {
+		return err
+	}
+	for i := args.Num1; i <= args.Num2; i++ {
+		err = st.Send(&models.Reply{Num: i})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Total 客户端流, 结束后返回总和
+func (f *Feed) Total(st *rpc.Stream) error {
+	total := 0
+	for {
+		var args models.Args
+		err := st.Recv(&args)
+		if err == io.EOF {
+			return st.Send(&models.Reply{Num: total})
+		}
+		if err != nil {
+			return err
+		}
+		total += args.Num1
+	}
+}
+
+// Echo 双向流
+func (f *Feed) Echo(st *rpc.Stream) error {
+	for {
+		var args models.Args
+		err := st.Recv(&args)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = st.Send(&models.Reply{Num: args.Num1 * 2})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Feed) Fail(st *rpc.Stream) error {
+	_ = st.Send(&models.Reply{Num: 1})
+	return lcode.NewError(lcode.CodeResourceExhausted, "quota")
+}
+
+func (f *Feed) Block(st *rpc.Stream) error {
+	<-st.Context().Done()
+	f.canceled <- st.Context().Err()
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var foo models.Foo
+	_ = s.Register(&foo)
+	feed := &Feed{canceled: make(chan error, 1)}
+	_ = s.Register(feed)
+	ln, _ := transport.ListenMem("stream")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	c, err := client.XDial("mem@stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	ctx := context.NewContext(gctx.Background())
+
+	// 服务端流, 超过窗口的消息需要客户端归还窗口
+	n := rpc.DefaultStreamWindow*3 + 1
+	st, err := c.NewStream(ctx, "Feed.Count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = st.Send(&models.Args{Num1: 1, Num2: n})
+	_ = st.CloseSend()
+	for i := 1; i <= n; i++ {
+		var r models.Reply
+		err = st.Recv(&r)
+		if err != nil || r.Num != i {
+			t.Fatalf("expect %d, got %d err:%v", i, r.Num, err)
+		}
+	}
+	var r models.Reply
+	if err = st.Recv(&r); err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+
+	// 客户端流
+	st, _ = c.NewStream(ctx, "Feed.Total")
+	for i := 1; i <= n; i++ {
+		err = st.Send(&models.Args{Num1: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = st.CloseSend()
+	if err = st.Recv(&r); err != nil || r.Num != n*(n+1)/2 {
+		t.Fatalf("expect %d, got %d err:%v", n*(n+1)/2, r.Num, err)
+	}
+	if err = st.Recv(&r); err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+
+	// 双向流
+	st, _ = c.NewStream(ctx, "Feed.Echo")
+	for i := 1; i <= 3; i++ {
+		_ = st.Send(&models.Args{Num1: i})
+		if err = st.Recv(&r); err != nil || r.Num != i*2 {
+			t.Fatalf("expect %d, got %d err:%v", i*2, r.Num, err)
+		}
+	}
+	_ = st.CloseSend()
+	if err = st.Recv(&r); err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+
+	// 结束状态带错误码, 之前的消息仍可读到
+	st, _ = c.NewStream(ctx, "Feed.Fail")
+	if err = st.Recv(&r); err != nil || r.Num != 1 {
+		t.Fatalf("expect 1, got %d err:%v", r.Num, err)
+	}
+	if err = st.Recv(&r); lcode.ErrorCode(err) != lcode.CodeResourceExhausted {
+		t.Fatalf("expect resource exhausted, got %v", err)
+	}
+
+	// 普通方法不能作为流调用, 反之亦然
+	st, _ = c.NewStream(ctx, "Foo.Sum")
+	if err = st.Recv(&r); lcode.ErrorCode(err) != lcode.CodeInvalidRequest {
+		t.Fatalf("expect invalid request, got %v", err)
+	}
+
+	// 客户端中止, 服务端的 ctx 被取消
+	st, _ = c.NewStream(ctx, "Feed.Block")
+	_ = st.Close()
+	select {
+	case err = <-feed.canceled:
+		if err != gctx.Canceled {
+			t.Fatalf("expect canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect server stream canceled")
+	}
+	if lcode.ErrorCode(st.Err()) != lcode.CodeCanceled {
+		t.Fatalf("expect canceled, got %v", st.Err())
+	}
+
+	// 连接仍然可用
+	err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 1, Num2: 2}, &r)
+	if err != nil || r.Num != 3 {
+		t.Fatalf("expect 3, got %d err:%v", r.Num, err)
+	}
+}
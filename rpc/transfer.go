@@ -0,0 +1,176 @@
+package rpc
+
+/*
+ * 大对象分块传输, 基于流式调用, 每块不超过 DefaultChunkSize
+ *   上传: 客户端发送 TransferHeader, 服务端回复已保存的长度, 客户端从该位置开始发送 Chunk
+ *   下载: 客户端发送带 Offset 的 TransferHeader, 服务端回复总大小后从 Offset 发送 Chunk
+ *   每块带偏移和 crc32, 接收方校验后直接写入 io.Writer
+ *   上传时服务端定期回复 TransferAck, 中断后从最后确认的位置续传
+ * 服务端方法:
+ *   func (s *Store) Put(st *rpc.Stream) error { return rpc.ReceiveObject(st, s.create) }
+ *   func (s *Store) Get(st *rpc.Stream) error { return rpc.SendObject(st, s.open) }
+ * */
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/zulong210220/lrpc/lcode"
+)
+
+const (
+	DefaultChunkSize = 256 << 10
+
+	transferAckEvery = 8 // 上传时每收到多少块确认一次
+)
+
+type TransferHeader struct {
+	Name   string
+	Size   int64 // 上传时的总大小, -1 表示未知
+	Offset int64 // 下载时开始的位置
+}
+
+type TransferAck struct {
+	Offset int64 // 接收方已经写入的长度
+	Size   int64 // 对象总大小, -1 表示未知
+}
+
+type Chunk struct {
+	Offset int64
+	Data   []byte
+	Crc32  uint32 // IEEE
+}
+
+func NewChunk(offset int64, data []byte) *Chunk {
+	return &Chunk{Offset: offset, Data: data, Crc32: crc32.ChecksumIEEE(data)}
+}
+
+// Verify offset 为接收方期望的位置
+func (c *Chunk) Verify(offset int64) error {
+	if c.Offset != offset {
+		return lcode.Errorf(lcode.CodeInvalidRequest, "chunk offset %d, expect %d", c.Offset, offset)
+	}
+	if crc32.ChecksumIEEE(c.Data) != c.Crc32 {
+		return lcode.Errorf(lcode.CodeInvalidRequest, "chunk at %d checksum mismatch", c.Offset)
+	}
+	return nil
+}
+
+func (h *TransferHeader) Reset()         { *h = TransferHeader{} }
+func (h *TransferHeader) String() string { return fmt.Sprintf("%+v", *h) }
+func (h *TransferHeader) ProtoMessage()  {}
+
+func (a *TransferAck) Reset()         { *a = TransferAck{} }
+func (a *TransferAck) String() string { return fmt.Sprintf("%+v", *a) }
+func (a *TransferAck) ProtoMessage()  {}
+
+func (c *Chunk) Reset() { *c = Chunk{} }
+func (c *Chunk) String() string {
+	return fmt.Sprintf("offset:%d len:%d crc32:%08x", c.Offset, len(c.Data), c.Crc32)
+}
+func (c *Chunk) ProtoMessage() {}
+
+func recvTransferHeader(st *Stream) (*TransferHeader, error) {
+	h := &TransferHeader{}
+	err := st.Recv(h)
+	if err == io.EOF {
+		return nil, lcode.NewError(lcode.CodeInvalidRequest, "missing transfer header")
+	}
+	return h, err
+}
+
+// ReceiveObject 处理上传
+// open 返回写入位置和已经保存的长度, 客户端从该长度续传; w 实现 io.Closer 时结束后关闭
+func ReceiveObject(st *Stream, open func(h *TransferHeader) (io.Writer, int64, error)) error {
+	h, err := recvTransferHeader(st)
+	if err != nil {
+		return err
+	}
+	w, offset, err := open(h)
+	if err != nil {
+		return err
+	}
+	if c, ok := w.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	err = st.Send(&TransferAck{Offset: offset, Size: h.Size})
+	if err != nil {
+		return err
+	}
+
+	for n := 1; ; n++ {
+		c := &Chunk{}
+		err = st.Recv(c)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = c.Verify(offset)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(c.Data)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(c.Data))
+
+		if n%transferAckEvery == 0 {
+			err = st.Send(&TransferAck{Offset: offset, Size: h.Size})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if h.Size >= 0 && offset != h.Size {
+		return lcode.Errorf(lcode.CodeInvalidRequest, "object %s size %d, expect %d", h.Name, offset, h.Size)
+	}
+	return st.Send(&TransferAck{Offset: offset, Size: h.Size})
+}
+
+// SendObject 处理下载, open 返回对象内容和总大小; r 实现 io.Closer 时结束后关闭
+func SendObject(st *Stream, open func(h *TransferHeader) (io.ReaderAt, int64, error)) error {
+	h, err := recvTransferHeader(st)
+	if err != nil {
+		return err
+	}
+	r, size, err := open(h)
+	if err != nil {
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	if h.Offset < 0 || h.Offset > size {
+		return lcode.Errorf(lcode.CodeInvalidRequest, "offset %d out of range, size %d", h.Offset, size)
+	}
+
+	err = st.Send(&TransferAck{Offset: h.Offset, Size: size})
+	if err != nil {
+		return err
+	}
+
+	for offset := h.Offset; offset < size; {
+		n := int64(DefaultChunkSize)
+		if size-offset < n {
+			n = size - offset
+		}
+		// Send 异步编码, 每块使用新的缓冲区
+		buf := make([]byte, n)
+		m, err := r.ReadAt(buf, offset)
+		if m == 0 && err != nil {
+			return err
+		}
+		err = st.Send(NewChunk(offset, buf[:m]))
+		if err != nil {
+			return err
+		}
+		offset += int64(m)
+	}
+	return nil
+}
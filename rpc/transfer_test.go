@@ -0,0 +1,151 @@
+package rpc_test
+
+import (
+	"bytes"
+	gctx "context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+type Store struct {
+	mu      sync.Mutex // 同一时间只处理一个上传
+	objects map[string]*bytes.Buffer
+	resumed int64 // 最近一次上传续传的位置
+}
+
+func (s *Store) Put(st *rpc.Stream) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return rpc.ReceiveObject(st, func(h *rpc.TransferHeader) (io.Writer, int64, error) {
+		buf := s.objects[h.Name]
+		if buf == nil {
+			buf = &bytes.Buffer{}
+			s.objects[h.Name] = buf
+		}
+		s.resumed = int64(buf.Len())
+		return buf, s.resumed, nil
+	})
+}
+
+func (s *Store) Get(st *rpc.Stream) error {
+	return rpc.SendObject(st, func(h *rpc.TransferHeader) (io.ReaderAt, int64, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		buf := s.objects[h.Name]
+		if buf == nil {
+			return nil, 0, lcode.Errorf(lcode.CodeNotFound, "object %s not found", h.Name)
+		}
+		return bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil
+	})
+}
+
+// Corrupt 发送校验和错误的块
+func (s *Store) Corrupt(st *rpc.Stream) error {
+	var h rpc.TransferHeader
+	_ = st.Recv(&h)
+	_ = st.Send(&rpc.TransferAck{Size: 3})
+	c := rpc.NewChunk(0, []byte("abc"))
+	c.Crc32++
+	return st.Send(c)
+}
+
+// failReader 读到 failAt 后出错, 模拟传输中断
+type failReader struct {
+	r      *bytes.Reader
+	failAt int64
+}
+
+func (f *failReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.failAt {
+		return 0, errors.New("read interrupted")
+	}
+	if off+int64(len(p)) > f.failAt {
+		p = p[:f.failAt-off]
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func TestTransfer(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	store := &Store{objects: make(map[string]*bytes.Buffer)}
+	_ = s.Register(store)
+	ln, _ := transport.ListenMem("transfer")
+	go s.Accept(ln)
+	defer s.Shutdown()
+
+	c, err := client.XDial("mem@transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	ctx := context.NewContext(gctx.Background())
+
+	data := make([]byte, 4*rpc.DefaultChunkSize+12345)
+	_, _ = rand.Read(data)
+	size := int64(len(data))
+
+	// 中断后续传
+	failAt := int64(2*rpc.DefaultChunkSize + 100)
+	_, err = c.Upload(ctx, "Store.Put", "obj", &failReader{r: bytes.NewReader(data), failAt: failAt}, size)
+	if err == nil {
+		t.Fatal("expect upload interrupted")
+	}
+	n, err := c.Upload(ctx, "Store.Put", "obj", bytes.NewReader(data), size)
+	if err != nil || n != size {
+		t.Fatalf("expect %d acked, got %d err:%v", size, n, err)
+	}
+	store.mu.Lock()
+	resumed, stored := store.resumed, store.objects["obj"].Bytes()
+	store.mu.Unlock()
+	// 中止时服务端未读的块被丢弃
+	if resumed < 0 || resumed > failAt {
+		t.Fatalf("expect resume from [0, %d], got %d", failAt, resumed)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Fatal("stored object mismatch")
+	}
+
+	// 服务端已有部分内容, 只发送剩余的部分
+	store.mu.Lock()
+	store.objects["part"] = bytes.NewBuffer(append([]byte(nil), data[:failAt]...))
+	store.mu.Unlock()
+	n, err = c.Upload(ctx, "Store.Put", "part", bytes.NewReader(data), size)
+	store.mu.Lock()
+	resumed, stored = store.resumed, store.objects["part"].Bytes()
+	store.mu.Unlock()
+	if err != nil || n != size || resumed != failAt || !bytes.Equal(stored, data) {
+		t.Fatalf("expect resume from %d, got %d acked:%d err:%v", failAt, resumed, n, err)
+	}
+
+	// 下载, 从中间位置续传
+	var w bytes.Buffer
+	n, err = c.Download(ctx, "Store.Get", "obj", 0, &w)
+	if err != nil || n != size || !bytes.Equal(w.Bytes(), data) {
+		t.Fatalf("expect %d bytes, got %d err:%v", size, n, err)
+	}
+	w.Reset()
+	n, err = c.Download(ctx, "Store.Get", "obj", failAt, &w)
+	if err != nil || n != size-failAt || !bytes.Equal(w.Bytes(), data[failAt:]) {
+		t.Fatalf("expect %d bytes, got %d err:%v", size-failAt, n, err)
+	}
+
+	_, err = c.Download(ctx, "Store.Get", "missing", 0, &w)
+	if lcode.ErrorCode(err) != lcode.CodeNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+	_, err = c.Download(ctx, "Store.Corrupt", "obj", 0, &w)
+	if lcode.ErrorCode(err) != lcode.CodeInvalidRequest {
+		t.Fatalf("expect checksum mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package rpc
+
+/*
+ * WebSocket 接入, 和 CONNECT 一样挂载在 http 上
+ *   子协议 lrpc: 二进制消息承载原生帧(含握手), 与 tcp 连接完全一致, 服务端可以随时发送帧
+ *   子协议 lrpc.json: 每个文本消息是一个 JSON-RPC 2.0 请求或批量请求
+ *   未协商子协议时为 lrpc
+ * */
+
+import (
+	"net/http"
+
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+const (
+	WSProtocolBinary = "lrpc"
+	WSProtocolJSON   = "lrpc.json"
+)
+
+type wsHandler struct {
+	s *Server
+	l *listener
+}
+
+// WebSocket 使用 Server 级别的设置, HandleHTTP 会挂载在 consts.DefaultWebSocketPath 上
+func (s *Server) WebSocket() http.Handler {
+	return &wsHandler{s: s, l: &listener{cfg: &ListenerConfig{}}}
+}
+
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wc, err := transport.UpgradeWS(w, r, WSProtocolBinary, WSProtocolJSON)
+	if err != nil {
+		log.Warningf("", "wsHandler.ServeHTTP remote:%s upgrade failed err:%v", r.RemoteAddr, err)
+		return
+	}
+	limits := h.l.cfg.Limits
+	if limits == nil {
+		limits = &h.s.limits
+	}
+	wc.SetMaxMessage(limits.MaxWSMessage)
+	h.s.serveConn(h.l, wc)
+}
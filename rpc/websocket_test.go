@@ -0,0 +1,86 @@
+package rpc_test
+
+import (
+	gctx "context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/consts"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+func TestWebSocket(t *testing.T) {
+	lcode.Init()
+
+	s := rpc.NewServer()
+	var f models.Foo
+	_ = s.Register(&f)
+	// 服务端主动发送的 ping 经过 websocket 到达客户端
+	err := s.AddListener(&rpc.ListenerConfig{
+		Addr:   "http@127.0.0.1:0",
+		Limits: &rpc.Limits{PingInterval: 30 * time.Millisecond, PingTimeout: 60 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	addr := strings.TrimPrefix(s.Endpoints()[0], "http@")
+
+	c, err := client.XDial("ws@" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	ctx := context.NewContext(gctx.Background())
+	var reply models.Reply
+	err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 2, Num2: 3}, &reply)
+	if err != nil || reply.Num != 5 {
+		t.Fatalf("expect 5, got %d err:%v", reply.Num, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	err = c.Call(ctx, "Foo.Sum", &models.Args{Num1: 3, Num2: 3}, &reply)
+	if err != nil || reply.Num != 6 {
+		t.Fatalf("expect connection kept alive, got %d err:%v", reply.Num, err)
+	}
+
+	// JSON 文本模式
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc, err := transport.NewWSClientConn(conn, addr, consts.DefaultWebSocketPath, rpc.WSProtocolJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = wc.Close() }()
+	if wc.Protocol() != rpc.WSProtocolJSON {
+		t.Fatalf("expect protocol %s, got %q", rpc.WSProtocolJSON, wc.Protocol())
+	}
+	err = wc.WriteMessage(transport.WSText, []byte(`{"jsonrpc":"2.0","method":"Foo.Sum","params":{"Num1":4,"Num2":4},"id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = wc.SetReadDeadline(time.Now().Add(time.Second))
+	op, data, err := wc.ReadMessage()
+	if err != nil || op != transport.WSText || string(data) != `{"jsonrpc":"2.0","result":{"Num":8},"id":1}` {
+		t.Fatalf("unexpected %d %s err:%v", op, data, err)
+	}
+
+	resp, err := http.Get("http://" + addr + consts.DefaultWebSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect 400 without upgrade, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,39 @@
+package tracing
+
+import (
+	"github.com/zulong210220/lrpc/context"
+)
+
+type spanKey struct{}
+
+func ContextWithSpan(ctx *context.Context, s *Span) *context.Context {
+	ctx.SetValue(spanKey{}, s)
+	return ctx
+}
+
+func SpanFromContext(ctx *context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// StartClientSpan 父 span 取自 ctx; 没有时如果 ctx 的 traceId 是合法的 trace-id 则沿用
+func StartClientSpan(ctx *context.Context, name string) *Span {
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.Context()
+	} else if ctx != nil {
+		if tid, err := ParseTraceID(context.GetTraceId(ctx)); err == nil {
+			parent = SpanContext{TraceID: tid, Flags: FlagSampled}
+		}
+	}
+	return StartSpan(parent, name, KindClient)
+}
+
+// StartServerSpan traceparent 无效时开始新的 trace
+func StartServerSpan(traceparent, name string) *Span {
+	parent, _ := ParseTraceparent(traceparent)
+	return StartSpan(parent, name, KindServer)
+}
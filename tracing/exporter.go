@@ -0,0 +1,124 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/zulong210220/lrpc/log"
+)
+
+// Exporter span 结束时同步调用, 实现需要自己处理缓冲
+type Exporter interface {
+	Export(d *SpanData) error
+	Close() error
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter 为空时不导出, span 仍然会传播
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	exporter = e
+	exporterMu.Unlock()
+}
+
+func export(d *SpanData) {
+	exporterMu.RLock()
+	e := exporter
+	exporterMu.RUnlock()
+	if e == nil {
+		return
+	}
+	err := e.Export(d)
+	if err != nil {
+		log.Errorf(d.TraceID, "tracing.export span:%s failed err:%v", d.SpanID, err)
+	}
+}
+
+// FileExporter 每个 span 一行 JSON, 追加写入文件
+type FileExporter struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (fe *FileExporter) Export(d *SpanData) error {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	return fe.enc.Encode(d)
+}
+
+func (fe *FileExporter) Close() error {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	return fe.f.Close()
+}
+
+// ReadSpans 读取 FileExporter 写入的文件
+func ReadSpans(r io.Reader) ([]*SpanData, error) {
+	var spans []*SpanData
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		d := &SpanData{}
+		err := json.Unmarshal(sc.Bytes(), d)
+		if err != nil {
+			return spans, err
+		}
+		spans = append(spans, d)
+	}
+	return spans, sc.Err()
+}
+
+type Node struct {
+	Span     *SpanData
+	Children []*Node
+}
+
+// BuildTrees 按 trace 还原调用树, 父 span 缺失的作为根
+func BuildTrees(spans []*SpanData) map[string][]*Node {
+	nodes := make(map[string]*Node, len(spans))
+	for _, d := range spans {
+		nodes[d.TraceID+"/"+d.SpanID] = &Node{Span: d}
+	}
+
+	trees := make(map[string][]*Node)
+	for _, d := range spans {
+		n := nodes[d.TraceID+"/"+d.SpanID]
+		if p, ok := nodes[d.TraceID+"/"+d.ParentID]; ok && d.ParentID != "" {
+			p.Children = append(p.Children, n)
+			continue
+		}
+		trees[d.TraceID] = append(trees[d.TraceID], n)
+	}
+
+	for _, n := range nodes {
+		sortNodes(n.Children)
+	}
+	for _, roots := range trees {
+		sortNodes(roots)
+	}
+	return trees
+}
+
+func sortNodes(ns []*Node) {
+	sort.Slice(ns, func(i, j int) bool { return ns[i].Span.Start.Before(ns[j].Span.Start) })
+}
@@ -0,0 +1,229 @@
+package tracing
+
+/*
+ * 兼容 W3C Trace Context 的 span 传播
+ *   traceparent: 00-<trace-id 32 hex>-<parent-id 16 hex>-<flags 2 hex>
+ * 通过 lcode.Header.Traceparent 在客户端和服务端之间传递
+ * */
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KindClient = "client"
+	KindServer = "server"
+
+	FlagSampled byte = 0x01
+
+	traceparentVersion = "00"
+)
+
+var ErrInvalidTraceparent = errors.New("tracing: invalid traceparent")
+
+type TraceID [16]byte
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+type SpanID [8]byte
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func NewTraceID() TraceID {
+	var t TraceID
+	for !t.IsValid() {
+		_, _ = rand.Read(t[:])
+	}
+	return t
+}
+
+func NewSpanID() SpanID {
+	var s SpanID
+	for !s.IsValid() {
+		_, _ = rand.Read(s[:])
+	}
+	return s
+}
+
+// ParseTraceID 32位小写十六进制, 全0无效
+func ParseTraceID(s string) (TraceID, error) {
+	var t TraceID
+	if len(s) != 32 || strings.ToLower(s) != s {
+		return t, ErrInvalidTraceparent
+	}
+	_, err := hex.Decode(t[:], []byte(s))
+	if err != nil || !t.IsValid() {
+		return t, ErrInvalidTraceparent
+	}
+	return t, nil
+}
+
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%s-%02x", traceparentVersion, sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, ErrInvalidTraceparent
+	}
+	// 00 版本必须正好4段, 更高版本允许追加字段
+	if parts[0] == traceparentVersion && len(parts) != 4 {
+		return sc, ErrInvalidTraceparent
+	}
+
+	var err error
+	sc.TraceID, err = ParseTraceID(parts[1])
+	if err != nil {
+		return sc, err
+	}
+	if len(parts[2]) != 16 || strings.ToLower(parts[2]) != parts[2] {
+		return sc, ErrInvalidTraceparent
+	}
+	_, err = hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	if err != nil || !sc.SpanID.IsValid() {
+		return sc, ErrInvalidTraceparent
+	}
+	var flags [1]byte
+	if len(parts[3]) != 2 {
+		return sc, ErrInvalidTraceparent
+	}
+	_, err = hex.Decode(flags[:], []byte(parts[3]))
+	if err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	sc.Flags = flags[0]
+	return sc, nil
+}
+
+// SpanData 导出的 span, 通过 TraceID/ParentID 可以还原调用树
+type SpanData struct {
+	TraceID  string            `json:"trace_id"`
+	SpanID   string            `json:"span_id"`
+	ParentID string            `json:"parent_id,omitempty"`
+	Name     string            `json:"name"`
+	Kind     string            `json:"kind"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Code     string            `json:"code,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+}
+
+func (d *SpanData) Duration() time.Duration {
+	return d.End.Sub(d.Start)
+}
+
+type Span struct {
+	mu     sync.Mutex
+	sc     SpanContext
+	parent SpanID
+	name   string
+	kind   string
+	start  time.Time
+	code   string
+	err    string
+	attrs  map[string]string
+	ended  bool
+}
+
+// StartSpan parent 无效时开始一条新的 trace
+func StartSpan(parent SpanContext, name, kind string) *Span {
+	s := &Span{
+		name:  name,
+		kind:  kind,
+		start: time.Now(),
+	}
+	if parent.TraceID.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Flags = parent.Flags
+		s.parent = parent.SpanID
+	} else {
+		s.sc.TraceID = NewTraceID()
+		s.sc.Flags = FlagSampled
+	}
+	s.sc.SpanID = NewSpanID()
+	return s
+}
+
+func (s *Span) Context() SpanContext {
+	return s.sc
+}
+
+func (s *Span) SetAttr(k, v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[k] = v
+}
+
+// SetStatus code 为空或 "ok" 表示成功
+func (s *Span) SetStatus(code, err string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.code = code
+	s.err = err
+}
+
+// End 只有第一次调用有效, 结束后交给 exporter
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	d := &SpanData{
+		TraceID: s.sc.TraceID.String(),
+		SpanID:  s.sc.SpanID.String(),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   s.start,
+		End:     time.Now(),
+		Code:    s.code,
+		Error:   s.err,
+		Attrs:   s.attrs,
+	}
+	if s.parent.IsValid() {
+		d.ParentID = s.parent.String()
+	}
+	s.mu.Unlock()
+
+	if s.sc.Flags&FlagSampled != 0 {
+		export(d)
+	}
+}
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	sc := StartSpan(SpanContext{}, "root", KindClient).Context()
+	tp := sc.Traceparent()
+	got, err := ParseTraceparent(tp)
+	if err != nil || got != sc {
+		t.Fatalf("round trip %s got %+v err:%v", tp, got, err)
+	}
+
+	got, err = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil || got.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		got.SpanID.String() != "00f067aa0ba902b7" || got.Flags != FlagSampled {
+		t.Fatalf("unexpected %+v err:%v", got, err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Fatal("expect invalid", bad)
+		}
+	}
+
+	// 更高版本允许追加字段
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lrpc-tracing")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+
+	fe, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetExporter(fe)
+	defer SetExporter(nil)
+
+	root := StartSpan(SpanContext{}, "Foo.Sum", KindClient)
+	server := StartServerSpan(root.Context().Traceparent(), "Foo.Sum")
+	child := StartSpan(server.Context(), "Bar.Get", KindClient)
+	child.SetStatus("unknown", "boom")
+	child.End()
+	server.End()
+	root.End()
+	root.End()
+	_ = fe.Close()
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	spans, err := ReadSpans(f)
+	if err != nil || len(spans) != 3 {
+		t.Fatalf("expect 3 spans, got %d err:%v", len(spans), err)
+	}
+
+	trees := BuildTrees(spans)
+	roots := trees[root.Context().TraceID.String()]
+	if len(trees) != 1 || len(roots) != 1 || roots[0].Span.Kind != KindClient {
+		t.Fatalf("unexpected trees %+v", trees)
+	}
+	sn := roots[0].Children
+	if len(sn) != 1 || sn[0].Span.Kind != KindServer || len(sn[0].Children) != 1 {
+		t.Fatalf("unexpected server node %+v", sn)
+	}
+	leaf := sn[0].Children[0].Span
+	if leaf.Name != "Bar.Get" || leaf.Code != "unknown" || leaf.Error != "boom" {
+		t.Fatalf("unexpected leaf %+v", leaf)
+	}
+}
@@ -0,0 +1,226 @@
+package transport
+
+/*
+ * 所有 Transport 实现共用的一致性测试
+ * */
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type transportFactory struct {
+	name string
+	new  func(t *testing.T) Transport
+	dial func(addr net.Addr) (net.Conn, error)
+}
+
+func tcpDial(addr net.Addr) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr.String(), time.Second)
+}
+
+var factories = []transportFactory{
+	{
+		name: "std",
+		new: func(t *testing.T) Transport {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Skip("tcp unavailable", err)
+			}
+			return NewStdTransport(ln)
+		},
+		dial: tcpDial,
+	},
+	{
+		name: "std-mem",
+		new: func(t *testing.T) Transport {
+			ln, err := ListenMem("conformance")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return NewStdTransport(ln)
+		},
+		dial: func(addr net.Addr) (net.Conn, error) {
+			return DialMem(addr.String())
+		},
+	},
+	{
+		name: "gnet",
+		new: func(t *testing.T) Transport {
+			tr, err := ListenGnet("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Skip("gnet unavailable", err)
+			}
+			return tr
+		},
+		dial: tcpDial,
+	},
+}
+
+// startEcho 返回的channel在Serve退出时关闭
+func startEcho(tr Transport) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		_ = tr.Serve(func(c net.Conn) {
+			defer c.Close()
+			_, _ = io.Copy(c, c)
+		})
+		close(done)
+	}()
+	return done
+}
+
+func TestConformance(t *testing.T) {
+	for _, f := range factories {
+		f := f
+		t.Run(f.name+"/echo", func(t *testing.T) {
+			tr := f.new(t)
+			defer tr.Close()
+			startEcho(tr)
+
+			c, err := f.dial(tr.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			for _, msg := range []string{"a", "hello", "lrpc"} {
+				_, _ = c.Write([]byte(msg))
+				buf := make([]byte, len(msg))
+				if _, err = io.ReadFull(c, buf); err != nil || string(buf) != msg {
+					t.Fatalf("expect %q, got %q err:%v", msg, buf, err)
+				}
+			}
+		})
+
+		t.Run(f.name+"/large", func(t *testing.T) {
+			tr := f.new(t)
+			defer tr.Close()
+			startEcho(tr)
+
+			c, err := f.dial(tr.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			data := make([]byte, 4<<20)
+			_, _ = rand.Read(data)
+			go func() { _, _ = c.Write(data) }()
+
+			buf := make([]byte, len(data))
+			if _, err = io.ReadFull(c, buf); err != nil || !bytes.Equal(buf, data) {
+				t.Fatalf("large payload mismatch err:%v", err)
+			}
+		})
+
+		t.Run(f.name+"/concurrent", func(t *testing.T) {
+			tr := f.new(t)
+			defer tr.Close()
+			startEcho(tr)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 32)
+			for i := 0; i < 32; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					c, err := f.dial(tr.Addr())
+					if err != nil {
+						errs <- err
+						return
+					}
+					defer c.Close()
+
+					msg := []byte{byte(i), 'x', byte(i)}
+					_, _ = c.Write(msg)
+					buf := make([]byte, len(msg))
+					if _, err = io.ReadFull(c, buf); err != nil || !bytes.Equal(buf, msg) {
+						errs <- io.ErrUnexpectedEOF
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+		})
+
+		t.Run(f.name+"/peer-close", func(t *testing.T) {
+			tr := f.new(t)
+			defer tr.Close()
+
+			got := make(chan error, 1)
+			go func() {
+				_ = tr.Serve(func(c net.Conn) {
+					buf := make([]byte, 1)
+					_, err := io.ReadFull(c, buf)
+					got <- err
+				})
+			}()
+
+			c, err := f.dial(tr.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = c.Close()
+
+			select {
+			case err = <-got:
+				if err == nil {
+					t.Fatal("expect read error after peer close")
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("read not unblocked by peer close")
+			}
+		})
+
+		t.Run(f.name+"/read-deadline", func(t *testing.T) {
+			tr := f.new(t)
+			defer tr.Close()
+
+			got := make(chan error, 1)
+			go func() {
+				_ = tr.Serve(func(c net.Conn) {
+					defer c.Close()
+					_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+					_, err := c.Read(make([]byte, 1))
+					got <- err
+				})
+			}()
+
+			c, err := f.dial(tr.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			select {
+			case err = <-got:
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					t.Fatal("expect timeout error, got", err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("read deadline not honored")
+			}
+		})
+
+		t.Run(f.name+"/close", func(t *testing.T) {
+			tr := f.new(t)
+			done := startEcho(tr)
+			_ = tr.Close()
+
+			select {
+			case <-done:
+			case <-time.After(3 * time.Second):
+				t.Fatal("Serve not returned after Close")
+			}
+		})
+	}
+}
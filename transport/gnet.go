@@ -0,0 +1,402 @@
+package transport
+
+/*
+ * 基于 gnet 事件循环的传输层, 适合大量连接
+ * 收到的数据在事件循环中拷贝进连接缓冲区, 写入的数据由 Wake 交给事件循环在 React 中发送
+ * 对上层仍暴露 net.Conn, rpc.Conn 不需要区分实现, 每个连接仍有一个读取的 goroutine
+ * 事件循环从不阻塞, gnet 不能暂停单个连接的读取: 读缓冲超过 gnetMaxBuffered 时关闭该连接,
+ * 读取返回 ErrBufferFull; 写缓冲超过 gnetMaxPending 时 Write 等待事件循环取走, 受写超时限制
+ * gnet 写 socket 不完整时自己缓冲剩余数据, 这部分不计入写缓冲, 也不受写超时限制
+ * */
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet"
+)
+
+const (
+	gnetMaxBuffered = 16 << 20        // 单个连接读缓冲的最大字节数, 需大于最大帧
+	gnetMaxPending  = 1 << 20         // 单个连接写缓冲的最大字节数
+	gnetStopTimeout = 5 * time.Second // Close 等待事件循环退出
+)
+
+var (
+	ErrConnClosed = errors.New("transport: connection closed")
+	ErrBufferFull = errors.New("transport: read buffer full")
+
+	errDeadline = &timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "transport: i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+type GnetTransport struct {
+	*gnet.EventServer
+
+	protoAddr string
+	opts      []gnet.Option
+	addr      net.Addr
+	closed    int32
+	conns     sync.Map // *gnetConn
+
+	ready   chan error
+	done    chan error
+	stopped chan struct{} // gnet.Serve 返回后关闭
+	handler chan func(net.Conn)
+	h       func(net.Conn)
+}
+
+var (
+	_ Transport = (*GnetTransport)(nil)
+)
+
+// ListenGnet 启动事件循环, 返回时已完成监听
+// network 支持 tcp/unix, opts 透传给 gnet (如 gnet.WithMulticore)
+func ListenGnet(network, addr string, opts ...gnet.Option) (*GnetTransport, error) {
+	addr, err := fixedAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &GnetTransport{
+		EventServer: &gnet.EventServer{},
+		protoAddr:   network + "://" + addr,
+		opts:        opts,
+		ready:       make(chan error, 1),
+		done:        make(chan error, 1),
+		stopped:     make(chan struct{}),
+		handler:     make(chan func(net.Conn)),
+	}
+
+	go func() {
+		err := gnet.Serve(t, t.protoAddr, t.opts...)
+		select {
+		case t.ready <- err:
+		default:
+		}
+		t.done <- err
+		close(t.stopped)
+	}()
+
+	err = <-t.ready
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// fixedAddr gnet.Stop 按监听地址查找, 端口为 0 时先选定端口避免多个实例冲突
+func fixedAddr(network, addr string) (string, error) {
+	if network == "unix" {
+		return addr, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port != "0" {
+		return addr, err
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return "", err
+	}
+	addr = ln.Addr().String()
+	_ = ln.Close()
+	return addr, nil
+}
+
+func (t *GnetTransport) OnInitComplete(srv gnet.Server) gnet.Action {
+	t.addr = resolveAddr(srv)
+	t.ready <- nil
+	return gnet.None
+}
+
+// resolveAddr gnet 不会回填 :0 分配到的端口, 从fd取实际地址
+func resolveAddr(srv gnet.Server) net.Addr {
+	fd, err := srv.DupFd()
+	if err != nil {
+		return srv.Addr
+	}
+	f := os.NewFile(uintptr(fd), "")
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return srv.Addr
+	}
+	defer ln.Close()
+	return ln.Addr()
+}
+
+func (t *GnetTransport) Addr() net.Addr {
+	return t.addr
+}
+
+func (t *GnetTransport) Serve(h func(net.Conn)) error {
+	t.h = h
+	close(t.handler)
+	return <-t.done
+}
+
+// Close 停止事件循环, 已建立的连接随之关闭
+func (t *GnetTransport) Close() error {
+	if !atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+		return nil
+	}
+
+	// gnet.Stop 按固定间隔检查是否已退出, 直接等待 Serve 返回
+	ctx, cancel := context.WithTimeout(context.Background(), gnetStopTimeout)
+	defer cancel()
+	go func() {
+		_ = gnet.Stop(ctx, t.protoAddr)
+	}()
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *GnetTransport) OnOpened(c gnet.Conn) ([]byte, gnet.Action) {
+	gc := newGnetConn(c)
+	c.SetContext(gc)
+	t.conns.Store(gc, struct{}{})
+
+	go func() {
+		// Serve 之前到达的连接等待handler就绪
+		<-t.handler
+		t.h(gc)
+	}()
+	return nil, gnet.None
+}
+
+func (t *GnetTransport) OnClosed(c gnet.Conn, err error) gnet.Action {
+	if gc, ok := c.Context().(*gnetConn); ok {
+		gc.closeRead(err)
+		t.conns.Delete(gc)
+	}
+	return gnet.None
+}
+
+// React 收到数据或 Write 调用 Wake 时触发, 返回待写的数据
+func (t *GnetTransport) React(frame []byte, c gnet.Conn) ([]byte, gnet.Action) {
+	gc, ok := c.Context().(*gnetConn)
+	if !ok {
+		return nil, gnet.None
+	}
+	if len(frame) > 0 && !gc.push(frame) {
+		return nil, gnet.Close
+	}
+	return gc.takeOut(), gnet.None
+}
+
+type gnetConn struct {
+	c      gnet.Conn
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	out    bytes.Buffer // 等待事件循环发送
+	err    error
+	notify chan struct{} // 有新数据
+	space  chan struct{} // 写缓冲被事件循环取走
+	wmu    sync.Mutex    // 保证多个写入方的数据不交错
+	closed int32
+
+	// gnet 关闭连接后会清空地址, 提前保存
+	laddr net.Addr
+	raddr net.Addr
+
+	readDeadline  atomic.Value // time.Time
+	writeDeadline atomic.Value // time.Time
+}
+
+func newGnetConn(c gnet.Conn) *gnetConn {
+	gc := &gnetConn{
+		c:      c,
+		notify: make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		laddr:  c.LocalAddr(),
+		raddr:  c.RemoteAddr(),
+	}
+	gc.readDeadline.Store(time.Time{})
+	gc.writeDeadline.Store(time.Time{})
+	return gc
+}
+
+// push 在事件循环中调用, frame 会被复用必须拷贝
+// 上层读得太慢时返回 false, 由事件循环关闭该连接, 不影响同一循环上的其它连接
+func (gc *gnetConn) push(frame []byte) bool {
+	gc.mu.Lock()
+	if gc.err != nil {
+		gc.mu.Unlock()
+		return true
+	}
+	if gc.buf.Len()+len(frame) > gnetMaxBuffered {
+		gc.err = ErrBufferFull
+		gc.mu.Unlock()
+		gc.wake()
+		return false
+	}
+	_, _ = gc.buf.Write(frame)
+	gc.mu.Unlock()
+	gc.wake()
+	return true
+}
+
+// takeOut 在事件循环中调用, 取走写缓冲
+func (gc *gnetConn) takeOut() []byte {
+	gc.mu.Lock()
+	if gc.out.Len() == 0 {
+		gc.mu.Unlock()
+		return nil
+	}
+	out := append([]byte(nil), gc.out.Bytes()...)
+	gc.out.Reset()
+	gc.mu.Unlock()
+	signal(gc.space)
+	return out
+}
+
+func (gc *gnetConn) closeRead(err error) {
+	gc.mu.Lock()
+	if err == nil {
+		err = io.EOF
+	}
+	if gc.err == nil {
+		gc.err = err
+	}
+	gc.mu.Unlock()
+	atomic.StoreInt32(&gc.closed, 1)
+	gc.wake()
+	signal(gc.space)
+}
+
+func (gc *gnetConn) wake() {
+	signal(gc.notify)
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (gc *gnetConn) Read(p []byte) (int, error) {
+	for {
+		gc.mu.Lock()
+		if gc.buf.Len() > 0 {
+			n, _ := gc.buf.Read(p)
+			gc.mu.Unlock()
+			signal(gc.space)
+			return n, nil
+		}
+		err := gc.err
+		gc.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		dl := gc.readDeadline.Load().(time.Time)
+		if dl.IsZero() {
+			<-gc.notify
+			continue
+		}
+
+		d := time.Until(dl)
+		if d <= 0 {
+			return 0, errDeadline
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-gc.notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Write 写缓冲未满时直接返回, 否则等待事件循环取走, 超过写超时返回超时错误
+func (gc *gnetConn) Write(p []byte) (int, error) {
+	gc.wmu.Lock()
+	defer gc.wmu.Unlock()
+
+	for {
+		if atomic.LoadInt32(&gc.closed) == 1 {
+			return 0, ErrConnClosed
+		}
+		dl := gc.writeDeadline.Load().(time.Time)
+		if !dl.IsZero() && !time.Now().Before(dl) {
+			return 0, errDeadline
+		}
+
+		gc.mu.Lock()
+		pending := gc.out.Len()
+		if pending == 0 || pending+len(p) <= gnetMaxPending {
+			_, _ = gc.out.Write(p)
+			gc.mu.Unlock()
+			if pending == 0 {
+				// 已有数据时唤醒还没处理, 不需要重复唤醒
+				if err := gc.c.Wake(); err != nil {
+					return 0, err
+				}
+			}
+			return len(p), nil
+		}
+		gc.mu.Unlock()
+
+		if dl.IsZero() {
+			<-gc.space
+			continue
+		}
+		timer := time.NewTimer(time.Until(dl))
+		select {
+		case <-gc.space:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (gc *gnetConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&gc.closed, 0, 1) {
+		return nil
+	}
+	gc.closeRead(ErrConnClosed)
+	return gc.c.Close()
+}
+
+func (gc *gnetConn) LocalAddr() net.Addr {
+	return gc.laddr
+}
+
+func (gc *gnetConn) RemoteAddr() net.Addr {
+	return gc.raddr
+}
+
+func (gc *gnetConn) SetDeadline(t time.Time) error {
+	_ = gc.SetWriteDeadline(t)
+	return gc.SetReadDeadline(t)
+}
+
+func (gc *gnetConn) SetReadDeadline(t time.Time) error {
+	gc.readDeadline.Store(t)
+	gc.wake()
+	return nil
+}
+
+// SetWriteDeadline 限制 Write 等待事件循环取走写缓冲的时间
+func (gc *gnetConn) SetWriteDeadline(t time.Time) error {
+	gc.writeDeadline.Store(t)
+	signal(gc.space)
+	return nil
+}
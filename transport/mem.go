@@ -0,0 +1,140 @@
+package transport
+
+/*
+ * 进程内的 listener/dialer, 类似 grpc bufconn
+ * 同进程的单测或 sidecar 不需要占用端口和网卡
+ * */
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrListenerClosed = errors.New("transport: listener closed")
+	ErrMemAddrInUse   = errors.New("transport: mem address already in use")
+	ErrMemNoListener  = errors.New("transport: no mem listener")
+)
+
+type memAddr string
+
+func (a memAddr) Network() string {
+	return NetworkMem
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+type memConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type MemListener struct {
+	name string
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+var (
+	memMu        sync.Mutex
+	memListeners = make(map[string]*MemListener)
+)
+
+// ListenMem 同一个name同时只能有一个listener
+func ListenMem(name string) (*MemListener, error) {
+	memMu.Lock()
+	defer memMu.Unlock()
+
+	if memListeners[name] != nil {
+		return nil, ErrMemAddrInUse
+	}
+
+	ml := &MemListener{
+		name: name,
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+	memListeners[name] = ml
+	return ml, nil
+}
+
+func (ml *MemListener) Accept() (net.Conn, error) {
+	select {
+	case <-ml.done:
+		return nil, ErrListenerClosed
+	case c := <-ml.ch:
+		return c, nil
+	}
+}
+
+func (ml *MemListener) Close() error {
+	ml.once.Do(func() {
+		memMu.Lock()
+		if memListeners[ml.name] == ml {
+			delete(memListeners, ml.name)
+		}
+		memMu.Unlock()
+		close(ml.done)
+	})
+	return nil
+}
+
+func (ml *MemListener) Addr() net.Addr {
+	return memAddr(ml.name)
+}
+
+// Dial 建立一条到该listener的内存连接, 阻塞直到对方 Accept
+func (ml *MemListener) Dial() (net.Conn, error) {
+	return ml.DialTimeout(0)
+}
+
+// DialTimeout timeout 内对方没有 Accept 时返回超时错误, 0 不限制
+func (ml *MemListener) DialTimeout(timeout time.Duration) (net.Conn, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	s, c := net.Pipe()
+	addr := memAddr(ml.name)
+	peer := memAddr(ml.name + "#client")
+
+	select {
+	case <-ml.done:
+		return nil, ErrListenerClosed
+	case <-expired:
+		return nil, errDeadline
+	case ml.ch <- &memConn{Conn: s, local: addr, remote: peer}:
+		return &memConn{Conn: c, local: peer, remote: addr}, nil
+	}
+}
+
+func DialMem(name string) (net.Conn, error) {
+	return DialMemTimeout(name, 0)
+}
+
+func DialMemTimeout(name string, timeout time.Duration) (net.Conn, error) {
+	memMu.Lock()
+	ml := memListeners[name]
+	memMu.Unlock()
+
+	if ml == nil {
+		return nil, ErrMemNoListener
+	}
+	return ml.DialTimeout(timeout)
+}
@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"net"
+)
+
+// StdTransport 标准库 net.Listener, 每个连接一个goroutine
+type StdTransport struct {
+	ln net.Listener
+}
+
+var (
+	_ Transport = (*StdTransport)(nil)
+)
+
+func NewStdTransport(ln net.Listener) *StdTransport {
+	return &StdTransport{ln: ln}
+}
+
+func (t *StdTransport) Addr() net.Addr {
+	return t.ln.Addr()
+}
+
+func (t *StdTransport) Serve(h func(net.Conn)) error {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			return err
+		}
+		go h(conn)
+	}
+}
+
+func (t *StdTransport) Close() error {
+	return t.ln.Close()
+}
@@ -0,0 +1,88 @@
+package transport
+
+/*
+ * 地址格式 protocol@addr
+ *   tcp@127.0.0.1:8080
+ *   unix@/tmp/lrpc.sock
+ *   mem@name
+ * */
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zulong210220/lrpc/utils"
+)
+
+const (
+	NetworkTCP  = "tcp"
+	NetworkUnix = "unix"
+	NetworkMem  = "mem"
+)
+
+// Transport 服务端传输层, 只负责接入连接和收发字节
+// 帧的编解码仍由 rpc.Conn 完成, 所有实现都需要通过 conformance_test
+type Transport interface {
+	Addr() net.Addr
+	// Serve 阻塞直到Close, 每个新连接在独立的goroutine中调用h
+	Serve(h func(net.Conn)) error
+	Close() error
+}
+
+// ParseAddr 没有protocol时默认tcp
+func ParseAddr(rpcAddr string) (network, addr string, err error) {
+	parts := strings.SplitN(rpcAddr, "@", 2)
+	if len(parts) == 1 {
+		return NetworkTCP, parts[0], nil
+	}
+	if parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("transport: invalid address '%s', expect protocol@addr", rpcAddr)
+	}
+	return parts[0], parts[1], nil
+}
+
+func Listen(network, addr string) (net.Listener, error) {
+	switch network {
+	case NetworkMem:
+		return ListenMem(addr)
+	case NetworkUnix:
+		// 清理上次进程遗留的socket文件
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(addr)
+		}
+		return net.Listen(network, addr)
+	default:
+		return net.Listen(network, addr)
+	}
+}
+
+func Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	switch network {
+	case NetworkMem:
+		return DialMemTimeout(addr, timeout)
+	default:
+		return net.DialTimeout(network, addr, timeout)
+	}
+}
+
+// Endpoint 返回监听地址对外的形式, tcp保持 ip:port 的旧格式
+// 监听0.0.0.0时优先使用网卡地址, 没有非回环网卡时退回127.0.0.1
+func Endpoint(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip := a.IP
+		if ip == nil || ip.IsUnspecified() {
+			ip, _ = utils.ExternalIP()
+		}
+		if ip == nil {
+			ip = net.IPv4(127, 0, 0, 1)
+		}
+		return net.JoinHostPort(ip.String(), strconv.Itoa(a.Port))
+	default:
+		return a.Network() + "@" + a.String()
+	}
+}
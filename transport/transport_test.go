@@ -0,0 +1,283 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAddr(t *testing.T) {
+	cases := []struct {
+		in, network, addr string
+	}{
+		{"127.0.0.1:80", NetworkTCP, "127.0.0.1:80"},
+		{"unix@/tmp/a.sock", NetworkUnix, "/tmp/a.sock"},
+		{"mem@x", NetworkMem, "x"},
+	}
+	for _, c := range cases {
+		network, addr, err := ParseAddr(c.in)
+		if err != nil || network != c.network || addr != c.addr {
+			t.Fatalf("%s expect %s %s, got %s %s err:%v", c.in, c.network, c.addr, network, addr, err)
+		}
+	}
+	if _, _, err := ParseAddr("@x"); err == nil {
+		t.Fatal("expect invalid address")
+	}
+}
+
+func TestMem(t *testing.T) {
+	ln, err := Listen(NetworkMem, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ListenMem("t"); err != ErrMemAddrInUse {
+		t.Fatal("expect address in use, got", err)
+	}
+	if Endpoint(ln.Addr()) != "mem@t" {
+		t.Fatal("unexpected endpoint", Endpoint(ln.Addr()))
+	}
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+	}()
+
+	c, err := Dial(NetworkMem, "t", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expect ping, got %q err:%v", buf, err)
+	}
+
+	// 对方不 Accept 时按超时返回
+	idle, err := ListenMem("t-idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	_, err = Dial(NetworkMem, "t-idle", 50*time.Millisecond)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("expect dial timeout, got", err)
+	}
+
+	_ = ln.Close()
+	if _, err = Dial(NetworkMem, "t", 0); err != ErrMemNoListener {
+		t.Fatal("expect no listener, got", err)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("tcp unavailable", err)
+	}
+	defer ln.Close()
+	if Endpoint(ln.Addr()) != ln.Addr().String() {
+		t.Fatalf("expect %s, got %s", ln.Addr(), Endpoint(ln.Addr()))
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wc, err := UpgradeWS(w, r, "echo")
+		if err != nil {
+			return
+		}
+		defer wc.Close()
+		for {
+			op, data, err := wc.ReadMessage()
+			if err != nil {
+				return
+			}
+			_ = wc.WriteMessage(op, data)
+		}
+	}))
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc, err := NewWSClientConn(conn, addr, "/", "other", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wc.Close()
+	if wc.Protocol() != "echo" {
+		t.Fatalf("expect protocol echo, got %q", wc.Protocol())
+	}
+
+	// 覆盖三种长度编码
+	for _, n := range []int{5, 300, 70000} {
+		msg := bytes.Repeat([]byte{'a'}, n)
+		err = wc.WriteMessage(WSText, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		op, data, err := wc.ReadMessage()
+		if err != nil || op != WSText || !bytes.Equal(data, msg) {
+			t.Fatalf("echo %d bytes failed op:%d len:%d err:%v", n, op, len(data), err)
+		}
+	}
+
+	// net.Conn 方式按字节流读写
+	_, err = wc.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(wc, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("expect hello, got %q err:%v", buf, err)
+	}
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect 400 without upgrade, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebSocketMaxMessage(t *testing.T) {
+	// 客户端的帧, 掩码为 0 时数据不变
+	frame := func(fin bool, op int, n uint64) []byte {
+		b := []byte{byte(op), 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+		if fin {
+			b[0] |= 0x80
+		}
+		binary.BigEndian.PutUint64(b[2:], n)
+		b = append(b, 0, 0, 0, 0)
+		return append(b, bytes.Repeat([]byte{'a'}, int(n))...)
+	}
+	read := func(frames ...[]byte) ([]byte, error) {
+		sc, cc := net.Pipe()
+		defer sc.Close()
+		defer cc.Close()
+		go func() {
+			for _, f := range frames {
+				if _, err := cc.Write(f); err != nil {
+					return
+				}
+			}
+		}()
+		// 读掉回复的 pong
+		go func() { _, _ = io.Copy(ioutil.Discard, cc) }()
+		wc := &WSConn{Conn: sc, br: bufio.NewReader(sc)}
+		wc.SetMaxMessage(1024)
+		_, data, err := wc.ReadMessage()
+		return data, err
+	}
+
+	// 只声明长度, 不分配
+	huge := frame(true, WSBinary, 0)
+	binary.BigEndian.PutUint64(huge[2:], 1<<40)
+	if _, err := read(huge); err != ErrWSTooLarge {
+		t.Fatal("expect declared length rejected, got", err)
+	}
+	if _, err := read(frame(false, WSBinary, 600), frame(true, wsContinuation, 600)); err != ErrWSTooLarge {
+		t.Fatal("expect fragments over limit rejected, got", err)
+	}
+	// 分片之间的控制帧不计入
+	data, err := read(frame(false, WSBinary, 1000), frame(true, wsPing, 100), frame(true, wsContinuation, 24))
+	if err != nil || len(data) != 1024 {
+		t.Fatalf("expect 1024 bytes, got %d err:%v", len(data), err)
+	}
+}
+
+func TestGnetBackpressure(t *testing.T) {
+	tr, err := ListenGnet("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("gnet unavailable", err)
+	}
+	conns := make(chan net.Conn, 2)
+	go func() { _ = tr.Serve(func(c net.Conn) { conns <- c }) }()
+
+	slow, err := net.Dial("tcp", tr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	ssc := <-conns
+
+	fast, err := net.Dial("tcp", tr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	fsc := <-conns
+
+	// 上层不读取时只关闭这个连接, 事件循环不阻塞
+	total := 4 * gnetMaxBuffered
+	go func() {
+		_, _ = slow.Write(bytes.Repeat([]byte{'x'}, total))
+	}()
+
+	_, err = fast.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = fsc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(fsc, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Fatalf("expect other conn served, got %q err:%v", buf, err)
+	}
+
+	gc := ssc.(*gnetConn)
+	full := func() bool {
+		gc.mu.Lock()
+		defer gc.mu.Unlock()
+		return gc.err == ErrBufferFull
+	}
+	for i := 0; i < 100 && !full(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	_, err = io.Copy(ioutil.Discard, ssc)
+	if err != ErrBufferFull {
+		t.Fatal("expect buffer full, got", err)
+	}
+
+	// 写超时已过期时 Write 返回超时错误
+	_ = fsc.SetWriteDeadline(time.Now().Add(-time.Second))
+	_, err = fsc.Write([]byte("late"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("expect write timeout, got", err)
+	}
+	_ = fsc.SetWriteDeadline(time.Time{})
+	_, err = fsc.Write([]byte("pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = fast.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(fast, buf)
+	if err != nil || string(buf) != "pong" {
+		t.Fatalf("expect pong, got %q err:%v", buf, err)
+	}
+
+	// Close 直接停止事件循环
+	begin := time.Now()
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(begin); d > 300*time.Millisecond {
+		t.Fatalf("expect close without waiting, took %s", d)
+	}
+}
@@ -0,0 +1,360 @@
+package transport
+
+/*
+ * WebSocket (RFC 6455) 的最小实现, 不支持扩展(压缩等)
+ *   WSConn 实现 net.Conn, Read/Write 收发二进制消息的数据, 用于承载原生帧
+ *   ReadMessage/WriteMessage 按消息收发, 用于 JSON 文本模式
+ *   收到 ping 自动回复 pong, 收到 close 回复后返回 io.EOF
+ *   写操作加锁, 服务端可以随时主动发送消息
+ *   消息(含所有分片)超过上限时在分配之前返回 ErrWSTooLarge, 见 SetMaxMessage
+ * */
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 消息类型, 即帧的 opcode
+const (
+	WSText   = 1
+	WSBinary = 2
+
+	wsContinuation = 0
+	wsClose        = 8
+	wsPing         = 9
+	wsPong         = 10
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// DefaultWSMaxMessage 服务端单个消息的默认上限, 握手和鉴权之前就按声明的长度读取, 不能太大
+	DefaultWSMaxMessage = 4 << 20
+	// 客户端只读取已连接的服务端发送的消息
+	wsClientMaxMessage = 64 << 20
+)
+
+var (
+	ErrWSHandshake = errors.New("websocket: bad handshake")
+	ErrWSProtocol  = errors.New("websocket: protocol error")
+	ErrWSTooLarge  = errors.New("websocket: message too large")
+	ErrWSClosed    = errors.New("websocket: closed")
+)
+
+type WSConn struct {
+	net.Conn
+	br       *bufio.Reader
+	client   bool // 客户端发送的帧需要掩码
+	protocol string
+	maxMsg   int // 单个消息的最大字节数, 包括所有分片
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+	closed    bool // 已发送 close 帧, wmu 保护
+
+	buf []byte // Read 未读完的消息
+}
+
+// SetMaxMessage 设置单个消息的最大字节数, 超过时 ReadMessage 返回 ErrWSTooLarge
+// n <= 0 使用 DefaultWSMaxMessage; 需要在读取消息之前调用
+func (c *WSConn) SetMaxMessage(n int) {
+	if n <= 0 {
+		n = DefaultWSMaxMessage
+	}
+	c.maxMsg = n
+}
+
+// Protocol 握手协商的子协议, 没有时为空
+func (c *WSConn) Protocol() string {
+	return c.protocol
+}
+
+func (c *WSConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.buf = data
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write 每次调用发送一个二进制消息
+func (c *WSConn) Write(p []byte) (int, error) {
+	err := c.WriteMessage(WSBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadMessage 返回一个完整的数据消息, 控制帧在内部处理
+func (c *WSConn) ReadMessage() (int, []byte, error) {
+	var (
+		op   int
+		data []byte
+	)
+	for {
+		fin, fop, payload, err := c.readFrame(c.maxMsg - len(data))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch fop {
+		case wsPing:
+			err = c.writeFrame(wsPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			_ = c.writeFrame(wsClose, payload)
+			return 0, nil, io.EOF
+		case wsContinuation:
+			if op == 0 {
+				return 0, nil, ErrWSProtocol
+			}
+		case WSText, WSBinary:
+			if op != 0 {
+				return 0, nil, ErrWSProtocol
+			}
+			op = fop
+		default:
+			return 0, nil, ErrWSProtocol
+		}
+
+		data = append(data, payload...)
+		if fin {
+			return op, data, nil
+		}
+	}
+}
+
+// | fin rsv op | mask len | ext len | mask key | payload |
+// 数据帧的长度超过 limit 时在分配之前返回 ErrWSTooLarge
+func (c *WSConn) readFrame(limit int) (bool, int, []byte, error) {
+	var hdr [2]byte
+	_, err := io.ReadFull(c.br, hdr[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin := hdr[0]&0x80 != 0
+	op := int(hdr[0] & 0x0f)
+	masked := hdr[1]&0x80 != 0
+	if hdr[0]&0x70 != 0 || masked == c.client {
+		// 不支持扩展; 客户端的帧必须掩码, 服务端的帧不能掩码
+		return false, 0, nil, ErrWSProtocol
+	}
+
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var l uint16
+		err = binary.Read(c.br, binary.BigEndian, &l)
+		n = uint64(l)
+	case 127:
+		err = binary.Read(c.br, binary.BigEndian, &n)
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if op >= wsClose && (n > 125 || !fin) {
+		return false, 0, nil, ErrWSProtocol
+	}
+	if op < wsClose && n > uint64(limit) {
+		return false, 0, nil, ErrWSTooLarge
+	}
+
+	var key [4]byte
+	if masked {
+		_, err = io.ReadFull(c.br, key[:])
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	_, err = io.ReadFull(c.br, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(key, payload)
+	}
+	return fin, op, payload, nil
+}
+
+func (c *WSConn) WriteMessage(op int, data []byte) error {
+	if op != WSText && op != WSBinary {
+		return ErrWSProtocol
+	}
+	return c.writeFrame(op, data)
+}
+
+func (c *WSConn) writeFrame(op int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return ErrWSClosed
+	}
+	if op == wsClose {
+		c.closed = true
+	}
+
+	buf := make([]byte, 0, 14+len(data))
+	buf = append(buf, 0x80|byte(op))
+	var mb byte
+	if c.client {
+		mb = 0x80
+	}
+	n := len(data)
+	switch {
+	case n <= 125:
+		buf = append(buf, mb|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, mb|126, byte(n>>8), byte(n))
+	default:
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(n))
+		buf = append(buf, mb|127)
+		buf = append(buf, l[:]...)
+	}
+
+	if !c.client {
+		buf = append(buf, data...)
+	} else {
+		var key [4]byte
+		_, _ = rand.Read(key[:])
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, data...)
+		maskBytes(key, buf[start:])
+	}
+
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// Close 发送 close 帧后关闭连接
+func (c *WSConn) Close() error {
+	c.closeOnce.Do(func() {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = c.writeFrame(wsClose, []byte{0x03, 0xe8}) // 1000 正常关闭
+	})
+	return c.Conn.Close()
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	_, _ = io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpgradeWS 服务端握手, 按客户端给出的顺序选择 protocols 中支持的子协议
+// 失败时已经写回 http 错误
+func UpgradeWS(w http.ResponseWriter, r *http.Request, protocols ...string) (*WSConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket handshake required", http.StatusBadRequest)
+		return nil, ErrWSHandshake
+	}
+
+	var protocol string
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			for _, p := range protocols {
+				if protocol == "" && s == p {
+					protocol = p
+				}
+			}
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, ErrWSHandshake
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// http.Server 可能已经设置了超时
+	_ = conn.SetDeadline(time.Time{})
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+	if protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	_, err = io.WriteString(conn, resp+"\r\n")
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &WSConn{Conn: conn, br: brw.Reader, protocol: protocol, maxMsg: DefaultWSMaxMessage}, nil
+}
+
+// NewWSClientConn 在已建立的连接上完成客户端握手
+func NewWSClientConn(conn net.Conn, host, path string, protocols ...string) (*WSConn, error) {
+	var nonce [16]byte
+	_, _ = rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n", path, host, key)
+	if len(protocols) > 0 {
+		req += "Sec-WebSocket-Protocol: " + strings.Join(protocols, ", ") + "\r\n"
+	}
+	_, err := io.WriteString(conn, req+"\r\n")
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, fmt.Errorf("%w: status %s", ErrWSHandshake, resp.Status)
+	}
+	return &WSConn{Conn: conn, br: br, client: true, protocol: resp.Header.Get("Sec-WebSocket-Protocol"), maxMsg: wsClientMaxMessage}, nil
+}
@@ -0,0 +1,369 @@
+package xclient
+
+/*
+ * 按服务地址熔断
+ *   关闭: 正常调用, 滑动窗口内错误率超过 ErrorRate 或连续失败 ConsecutiveFailures 次后打开
+ *   打开: 直接返回 ErrCircuitOpen, Discovery 选择时跳过, OpenTimeout 后进入半开
+ *   半开: 最多放行 HalfOpenRequests 个探测, 全部成功后关闭, 任一失败重新打开
+ *         调用方取消的探测归还, ProbeTimeout 内没有结果的探测作废, 重新放行
+ * 只有连接类和服务端不可用的错误计为失败, 参数错误等业务错误不计
+ * 熔断时可以按方法配置降级处理, 见 SetFallback
+ * */
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/metrics"
+)
+
+type BreakerState int32
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+var breakerStateNames = [...]string{
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half_open",
+}
+
+func (s BreakerState) String() string {
+	if s < 0 || int(s) >= len(breakerStateNames) {
+		return "unknown"
+	}
+	return breakerStateNames[s]
+}
+
+var ErrCircuitOpen = lcode.NewError(lcode.CodeUnavailable, "rpc xclient: circuit breaker open")
+
+var (
+	mBreakerState       = metrics.NewGaugeVec("lrpc_xclient_breaker_state", "Circuit breaker state by endpoint (0 closed, 1 open, 2 half-open).", "endpoint")
+	mBreakerTransitions = metrics.NewCounterVec("lrpc_xclient_breaker_transitions_total", "Total number of circuit breaker state changes, by endpoint and new state.", "endpoint", "state")
+	mBreakerRejected    = metrics.NewCounterVec("lrpc_xclient_breaker_rejected_total", "Total number of calls rejected by an open circuit breaker.", "endpoint")
+)
+
+func init() {
+	client.Metrics.MustRegister(mBreakerState, mBreakerTransitions, mBreakerRejected)
+}
+
+// BreakerConfig 零值字段使用 DefaultBreakerConfig 中的值
+type BreakerConfig struct {
+	Window              time.Duration // 统计错误率的滑动窗口
+	Buckets             int           // 窗口分成的桶数
+	MinRequests         int           // 窗口内请求数不少于该值时才按错误率打开
+	ErrorRate           float64       // 窗口内失败的比例
+	ConsecutiveFailures int           // 连续失败的次数
+	OpenTimeout         time.Duration // 打开后多久进入半开
+	HalfOpenRequests    int           // 半开时放行的探测数
+	ProbeTimeout        time.Duration // 探测多久没有结果后作废
+}
+
+var DefaultBreakerConfig = BreakerConfig{
+	Window:              10 * time.Second,
+	Buckets:             10,
+	MinRequests:         20,
+	ErrorRate:           0.5,
+	ConsecutiveFailures: 5,
+	OpenTimeout:         5 * time.Second,
+	HalfOpenRequests:    1,
+	ProbeTimeout:        10 * time.Second,
+}
+
+func (cfg BreakerConfig) withDefault() BreakerConfig {
+	d := DefaultBreakerConfig
+	if cfg.Window <= 0 {
+		cfg.Window = d.Window
+	}
+	if cfg.Buckets <= 0 {
+		cfg.Buckets = d.Buckets
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = d.MinRequests
+	}
+	if cfg.ErrorRate <= 0 || cfg.ErrorRate > 1 {
+		cfg.ErrorRate = d.ErrorRate
+	}
+	if cfg.ConsecutiveFailures <= 0 {
+		cfg.ConsecutiveFailures = d.ConsecutiveFailures
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = d.OpenTimeout
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = d.HalfOpenRequests
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = d.ProbeTimeout
+	}
+	return cfg
+}
+
+// Fallback 熔断时代替调用, err 为 ErrCircuitOpen
+type Fallback func(ctx *context.Context, sm string, args, reply lcode.IMessage, err error) error
+
+type breakerBucket struct {
+	start  int64 // unix nano, 0 表示未使用
+	total  int
+	failed int
+}
+
+type breaker struct {
+	rpcAddr string
+	cfg     BreakerConfig
+
+	mu          sync.Mutex
+	state       BreakerState
+	buckets     []breakerBucket
+	consecutive int
+	openedAt    time.Time
+	probes      int       // 半开时已放行的探测
+	probeAt     time.Time // 最近一次放行探测的时间
+	successes   int       // 半开时成功的探测
+}
+
+func newBreaker(rpcAddr string, cfg BreakerConfig) *breaker {
+	mBreakerState.With(rpcAddr).Set(int64(BreakerClosed))
+	return &breaker{
+		rpcAddr: rpcAddr,
+		cfg:     cfg,
+		buckets: make([]breakerBucket, cfg.Buckets),
+	}
+}
+
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// ready 选择服务地址时使用, 不改变状态
+func (b *breaker) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.cfg.OpenTimeout
+	case BreakerHalfOpen:
+		b.expireProbesLocked()
+		return b.probes < b.cfg.HalfOpenRequests
+	}
+	return true
+}
+
+// allow 放行时半开状态计一个探测
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.cfg.OpenTimeout {
+			return false
+		}
+		b.setStateLocked(BreakerHalfOpen)
+	}
+	if b.state == BreakerHalfOpen {
+		b.expireProbesLocked()
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return false
+		}
+		b.probes++
+		b.probeAt = time.Now()
+	}
+	return true
+}
+
+// release 调用方取消时归还 allow 放行的探测, 不计结果
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// expireProbesLocked 探测都没有结果且超过 ProbeTimeout 时作废, 避免一直半开
+func (b *breaker) expireProbesLocked() {
+	if b.probes > b.successes && time.Since(b.probeAt) >= b.cfg.ProbeTimeout {
+		log.Warningf("", "XClient breaker rpcAddr:%s %d probes timeout", b.rpcAddr, b.probes-b.successes)
+		b.probes = b.successes
+	}
+}
+
+func (b *breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		if failed {
+			b.setStateLocked(BreakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setStateLocked(BreakerClosed)
+		}
+		return
+	}
+	if b.state == BreakerOpen {
+		return
+	}
+
+	bk := b.bucketLocked(time.Now().UnixNano())
+	bk.total++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	bk.failed++
+	b.consecutive++
+
+	if b.consecutive >= b.cfg.ConsecutiveFailures {
+		b.setStateLocked(BreakerOpen)
+		return
+	}
+	total, fails := b.countLocked(time.Now().UnixNano())
+	if total >= b.cfg.MinRequests && float64(fails) >= b.cfg.ErrorRate*float64(total) {
+		b.setStateLocked(BreakerOpen)
+	}
+}
+
+// bucketLocked now 所在的桶, 过期的桶清零后复用
+func (b *breaker) bucketLocked(now int64) *breakerBucket {
+	width := int64(b.cfg.Window) / int64(b.cfg.Buckets)
+	start := now - now%width
+	bk := &b.buckets[(now/width)%int64(len(b.buckets))]
+	if bk.start != start {
+		*bk = breakerBucket{start: start}
+	}
+	return bk
+}
+
+func (b *breaker) countLocked(now int64) (total, failed int) {
+	for _, bk := range b.buckets {
+		if bk.start != 0 && now-bk.start < int64(b.cfg.Window) {
+			total += bk.total
+			failed += bk.failed
+		}
+	}
+	return
+}
+
+func (b *breaker) setStateLocked(s BreakerState) {
+	if b.state == s {
+		return
+	}
+	log.Warningf("", "XClient breaker rpcAddr:%s %s -> %s", b.rpcAddr, b.state, s)
+	b.state = s
+	switch s {
+	case BreakerOpen:
+		b.openedAt = time.Now()
+	case BreakerClosed:
+		b.consecutive = 0
+		for i := range b.buckets {
+			b.buckets[i] = breakerBucket{}
+		}
+	}
+	b.probes, b.successes = 0, 0
+	mBreakerState.With(b.rpcAddr).Set(int64(s))
+	mBreakerTransitions.With(b.rpcAddr, s.String()).Inc()
+}
+
+// breakerFailure 连接类错误没有错误码, 计为失败
+func breakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var e *lcode.Error
+	if !errors.As(err, &e) {
+		return true
+	}
+	switch e.Code {
+	case lcode.CodeUnavailable, lcode.CodeDeadlineExceeded, lcode.CodeResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// EnableBreaker 为每个服务地址启用熔断, Discovery 实现 FilterSetter 时选择会跳过打开的地址
+func (xc *XClient) EnableBreaker(cfg *BreakerConfig) {
+	c := DefaultBreakerConfig
+	if cfg != nil {
+		c = cfg.withDefault()
+	}
+
+	xc.mu.Lock()
+	xc.breakerCfg = &c
+	xc.breakers = make(map[string]*breaker)
+	xc.mu.Unlock()
+
+	if fs, ok := xc.d.(FilterSetter); ok {
+		fs.SetFilter(xc.breakerReady)
+	}
+}
+
+// BreakerState 未启用熔断时总是 BreakerClosed
+func (xc *XClient) BreakerState(rpcAddr string) BreakerState {
+	b := xc.breaker(normalizeAddr(rpcAddr))
+	if b == nil {
+		return BreakerClosed
+	}
+	return b.State()
+}
+
+func (xc *XClient) breaker(rpcAddr string) *breaker {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.breakerCfg == nil {
+		return nil
+	}
+	b := xc.breakers[rpcAddr]
+	if b == nil {
+		b = newBreaker(rpcAddr, *xc.breakerCfg)
+		xc.breakers[rpcAddr] = b
+	}
+	return b
+}
+
+// deleteBreakerMetrics 删除已经从 Discovery 下线的服务地址的熔断指标
+func deleteBreakerMetrics(rpcAddr string) {
+	mBreakerState.Delete(rpcAddr)
+	mBreakerRejected.Delete(rpcAddr)
+	for s := range breakerStateNames {
+		mBreakerTransitions.Delete(rpcAddr, BreakerState(s).String())
+	}
+}
+
+func (xc *XClient) breakerReady(rpcAddr string) bool {
+	b := xc.breaker(normalizeAddr(rpcAddr))
+	return b == nil || b.ready()
+}
+
+// SetFallback key 同 SetRetryPolicy, f 为 nil 时删除
+func (xc *XClient) SetFallback(key string, f Fallback) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if f == nil {
+		delete(xc.fallbacks, key)
+		return
+	}
+	xc.fallbacks[key] = f
+}
+
+func (xc *XClient) fallback(sm string) Fallback {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for _, k := range policyKeys(sm) {
+		if f, ok := xc.fallbacks[k]; ok {
+			return f
+		}
+	}
+	return nil
+}
@@ -33,11 +33,37 @@ type Discovery interface {
 	Observe(rpaAddr string, dur int64)
 }
 
+// Filter 返回 false 的服务地址在 Get 时跳过
+type Filter func(rpcAddr string) bool
+
+// FilterSetter Discovery 可选实现, XClient 用来跳过熔断的服务地址
+type FilterSetter interface {
+	SetFilter(f Filter)
+}
+
+// filterServers 全部被跳过时返回 ErrCircuitOpen, XClient 据此使用降级处理
+func filterServers(ss []string, f Filter) ([]string, error) {
+	if f == nil {
+		return ss, nil
+	}
+	var res []string
+	for _, s := range ss {
+		if f(s) {
+			res = append(res, s)
+		}
+	}
+	if len(res) == 0 {
+		return nil, ErrCircuitOpen
+	}
+	return res, nil
+}
+
 type MultiServersDiscovery struct {
 	r       *rand.Rand
 	mu      sync.RWMutex
 	servers []string
 	index   int
+	filter  Filter
 }
 
 func NewMultiServerDiscovery(ss []string) *MultiServersDiscovery {
@@ -50,9 +76,16 @@ func NewMultiServerDiscovery(ss []string) *MultiServersDiscovery {
 }
 
 var (
-	_ Discovery = (*MultiServersDiscovery)(nil)
+	_ Discovery    = (*MultiServersDiscovery)(nil)
+	_ FilterSetter = (*MultiServersDiscovery)(nil)
 )
 
+func (d *MultiServersDiscovery) SetFilter(f Filter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.filter = f
+}
+
 func (md *MultiServersDiscovery) Observe(rpcAddr string, dur int64) {
 
 }
@@ -76,12 +109,17 @@ func (d *MultiServersDiscovery) Get(sn string, mode SelectMode) (string, error)
 	if n == 0 {
 		return "", errors.New("rpc discovery: no avaialable servers")
 	}
+	servers, err := filterServers(d.servers, d.filter)
+	if err != nil {
+		return "", err
+	}
+	n = len(servers)
 
 	switch mode {
 	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
+		return servers[d.r.Intn(n)], nil
 	case RoundRobinSelect:
-		s := d.servers[d.index%n]
+		s := servers[d.index%n]
 		d.index = (d.index + 1) % n
 		return s, nil
 	default:
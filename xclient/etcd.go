@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +24,20 @@ type EtcdDiscovery struct {
 	index    int
 	p2cs     map[string][]*peakEwmaNode
 	edp2c    map[string]*peakEwma // ip:port=>latency
+
+	protocols map[string]bool // 只使用这些协议的endpoint
+	filter    Filter
+}
+
+var (
+	_ Discovery    = (*EtcdDiscovery)(nil)
+	_ FilterSetter = (*EtcdDiscovery)(nil)
+)
+
+func (ed *EtcdDiscovery) SetFilter(f Filter) {
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+	ed.filter = f
 }
 
 func NewEtcdDiscovery(ea []string, et int, ss []string) *EtcdDiscovery {
@@ -30,6 +45,8 @@ func NewEtcdDiscovery(ea []string, et int, ss []string) *EtcdDiscovery {
 		services: make(map[string][]string),
 		r:        rand.New(rand.NewSource(time.Now().UnixNano())),
 		p2cs:     make(map[string][]*peakEwmaNode),
+
+		protocols: map[string]bool{consts.ProtocolTCP: true},
 	}
 
 	config := clientv3.Config{
@@ -39,7 +56,7 @@ func NewEtcdDiscovery(ea []string, et int, ss []string) *EtcdDiscovery {
 	var err error
 	ed.client, err = clientv3.New(config)
 	if err != nil {
-		log.Errorf("", "NewEtcdDiscovery err:", err)
+		log.Errorf("", "NewEtcdDiscovery err:%v", err)
 		return ed
 	}
 
@@ -48,6 +65,30 @@ func NewEtcdDiscovery(ea []string, et int, ss []string) *EtcdDiscovery {
 	return ed
 }
 
+// SetProtocols 服务端可能同时注册多个协议的endpoint, 默认只使用tcp
+// 需要在 NewEtcdDiscovery 之后立即设置
+func (ed *EtcdDiscovery) SetProtocols(ps ...string) {
+	protocols := make(map[string]bool)
+	for _, p := range ps {
+		protocols[p] = true
+	}
+	ed.mu.Lock()
+	ed.protocols = protocols
+	ed.mu.Unlock()
+}
+
+// accept 调用方需持有锁
+func (ed *EtcdDiscovery) accept(endpoint string) bool {
+	if endpoint == "" {
+		return false
+	}
+	protocol := consts.ProtocolTCP
+	if i := strings.Index(endpoint, "@"); i >= 0 {
+		protocol = endpoint[:i]
+	}
+	return ed.protocols[protocol]
+}
+
 func (ed *EtcdDiscovery) WatchServices(ss []string) error {
 	for _, s := range ss {
 		ed.watchService(s)
@@ -73,7 +114,10 @@ func (ed *EtcdDiscovery) watchService(s string) {
 
 	//遍历获取到的key和value
 	for _, ev := range resp.Kvs {
-		ed.services[s] = append(ed.services[s], getEndpointFromKey(string(ev.Key)))
+		ep := getEndpointFromKey(string(ev.Key))
+		if ed.accept(ep) {
+			ed.services[s] = append(ed.services[s], ep)
+		}
 	}
 
 	//监视前缀，修改变更的server
@@ -114,7 +158,12 @@ func getEndpointFromKey(key string) string {
 	if len(ss) < 2 {
 		return ""
 	}
-	return ss[len(ss)-1]
+	// server 注册时对 endpoint 做了转义
+	ep, err := url.PathUnescape(ss[len(ss)-1])
+	if err != nil {
+		return ss[len(ss)-1]
+	}
+	return ep
 }
 
 func (ed *EtcdDiscovery) SetServices(path, endpoint string) {
@@ -123,6 +172,10 @@ func (ed *EtcdDiscovery) SetServices(path, endpoint string) {
 	ed.mu.Lock()
 	defer ed.mu.Unlock()
 
+	if !ed.accept(endpoint) {
+		return
+	}
+
 	if ed.services[s] == nil {
 		ed.services[s] = []string{endpoint}
 		return
@@ -186,6 +239,11 @@ func (ed *EtcdDiscovery) Get(sn string, sm SelectMode) (string, error) {
 		ed.services[sn] = res
 		services = res
 	}
+	services, err := filterServers(services, ed.filter)
+	if err != nil {
+		return "", err
+	}
+	n = len(services)
 
 	switch sm {
 	case RandomSelect:
@@ -210,6 +268,7 @@ func (ed *EtcdDiscovery) GetAll(sn string) ([]string, error) {
 	return ss, nil
 }
 
+// GetService 从etcd拉取服务的endpoint, 调用方需持有锁
 func (ed *EtcdDiscovery) GetService(sn string) ([]string, error) {
 	fun := "EtcdDiscovery.GetService"
 	ctx := context.Background()
@@ -226,7 +285,10 @@ func (ed *EtcdDiscovery) GetService(sn string) ([]string, error) {
 		return res, err
 	}
 	for _, kv := range resp.Kvs {
-		res = append(res, getEndpointFromKey(string(kv.Key)))
+		ep := getEndpointFromKey(string(kv.Key))
+		if ed.accept(ep) {
+			res = append(res, ep)
+		}
 	}
 
 	return res, err
@@ -255,6 +317,10 @@ func (ed *EtcdDiscovery) p2cNext(sn string) (string, error) {
 		ed.p2cs[sn] = sss
 		ss = sss
 	}
+	ss, err := filterNodes(ss, ed.filter)
+	if err != nil {
+		return "", err
+	}
 
 	n = len(ss)
 	if n == 1 {
@@ -285,13 +351,13 @@ func (ed *EtcdDiscovery) Observe(rpcAddr string, dur int64) {
 	if rpcAddr == "" {
 		return
 	}
-	ss := strings.Split(rpcAddr, "@")
-	n := len(ss)
-	endpoint := ""
-	if n == 1 {
-		endpoint = ss[0]
+	// 新注册的endpoint带协议前缀, 旧格式只有 ip:port
+	if pe := ed.edp2c[rpcAddr]; pe != nil {
+		pe.Observe(dur)
+		return
 	}
-	endpoint = ss[1]
+	ss := strings.Split(rpcAddr, "@")
+	endpoint := ss[len(ss)-1]
 
 	ed.edp2c[endpoint].Observe(dur)
 }
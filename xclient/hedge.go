@@ -0,0 +1,288 @@
+package xclient
+
+/*
+ * 对冲请求, 用于读多的方法降低长尾延迟
+ *   第一个请求在 Delay (或观察到的延迟分位数) 内没有响应时, 向另一个服务地址再发一个
+ *   没有还未尝试的服务地址时不发送
+ *   使用最先成功的响应, 其余请求取消
+ *   每个普通请求积累 BudgetRatio 个令牌, 每个对冲请求消耗一个, 避免过载时放大请求量
+ * 策略按 "Service.Method", "Service", "" 的顺序查找, 配置了对冲的方法不再按 RetryPolicy 重试
+ * */
+
+import (
+	gctx "context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+	"github.com/zulong210220/lrpc/metrics"
+)
+
+const (
+	hedgeLatencySamples    = 128 // 计算分位数保留的最近延迟数
+	hedgeMinLatencySamples = 16  // 样本不足时使用 Delay
+)
+
+var (
+	mHedges = metrics.NewCounterVec("lrpc_xclient_hedged_requests_total", "Total number of hedged requests, by method and result (sent, won, throttled, skipped).", "method", "result")
+)
+
+var (
+	errNoHedgeEndpoint = errors.New("rpc xclient: no untried endpoint to hedge")
+	errHedgeThrottled  = errors.New("rpc xclient: hedge throttled")
+)
+
+func init() {
+	client.Metrics.MustRegister(mHedges)
+}
+
+// HedgePolicy 零值字段使用 DefaultHedgePolicy 中的值
+type HedgePolicy struct {
+	Delay       time.Duration // 多久没有响应后发送对冲请求
+	Percentile  float64       // 大于 0 时使用该方法最近延迟的分位数(如 0.95)代替 Delay
+	MaxHedges   int           // 每次调用最多额外发送的请求数
+	BudgetRatio float64       // 每个普通请求积累的令牌数
+	MaxTokens   float64       // 令牌上限, 也是初始值
+}
+
+var DefaultHedgePolicy = HedgePolicy{
+	Delay:       50 * time.Millisecond,
+	MaxHedges:   1,
+	BudgetRatio: 0.1,
+	MaxTokens:   10,
+}
+
+// HedgeStats 按策略的 key 统计
+type HedgeStats struct {
+	Requests  int64 // 使用对冲策略的调用数
+	Hedges    int64 // 发出的对冲请求数
+	Wins      int64 // 对冲请求先于第一个请求成功的次数
+	Throttled int64 // 令牌不足没有发出的对冲请求数
+}
+
+type hedger struct {
+	p HedgePolicy
+
+	mu        sync.Mutex
+	tokens    float64
+	latencies []time.Duration // 环形缓冲
+	next      int
+
+	stats HedgeStats
+}
+
+func newHedger(p HedgePolicy) *hedger {
+	d := DefaultHedgePolicy
+	if p.Delay <= 0 && p.Percentile <= 0 {
+		p.Delay = d.Delay
+	}
+	if p.MaxHedges <= 0 {
+		p.MaxHedges = d.MaxHedges
+	}
+	if p.BudgetRatio <= 0 {
+		p.BudgetRatio = d.BudgetRatio
+	}
+	if p.MaxTokens <= 0 {
+		p.MaxTokens = d.MaxTokens
+	}
+	return &hedger{p: p, tokens: p.MaxTokens}
+}
+
+func (h *hedger) request() {
+	atomic.AddInt64(&h.stats.Requests, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens += h.p.BudgetRatio
+	if h.tokens > h.p.MaxTokens {
+		h.tokens = h.p.MaxTokens
+	}
+}
+
+// allow 消耗一个令牌
+func (h *hedger) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+func (h *hedger) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.latencies) < hedgeLatencySamples {
+		h.latencies = append(h.latencies, d)
+		return
+	}
+	h.latencies[h.next] = d
+	h.next = (h.next + 1) % hedgeLatencySamples
+}
+
+func (h *hedger) delay() time.Duration {
+	if h.p.Percentile <= 0 {
+		return h.p.Delay
+	}
+
+	h.mu.Lock()
+	if len(h.latencies) < hedgeMinLatencySamples {
+		h.mu.Unlock()
+		return h.p.Delay
+	}
+	ls := append([]time.Duration(nil), h.latencies...)
+	h.mu.Unlock()
+
+	sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+	i := int(h.p.Percentile * float64(len(ls)))
+	if i >= len(ls) {
+		i = len(ls) - 1
+	}
+	return ls[i]
+}
+
+// SetHedgePolicy key 同 SetRetryPolicy, p 为 nil 时删除
+// 配置了对冲的方法不再使用 SetRetryPolicy 的重试策略
+func (xc *XClient) SetHedgePolicy(key string, p *HedgePolicy) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if p == nil {
+		delete(xc.hedges, key)
+		return
+	}
+	xc.hedges[key] = newHedger(*p)
+}
+
+// HedgeStats key 为 SetHedgePolicy 使用的 key
+func (xc *XClient) HedgeStats(key string) HedgeStats {
+	xc.mu.Lock()
+	h := xc.hedges[key]
+	xc.mu.Unlock()
+	if h == nil {
+		return HedgeStats{}
+	}
+	return HedgeStats{
+		Requests:  atomic.LoadInt64(&h.stats.Requests),
+		Hedges:    atomic.LoadInt64(&h.stats.Hedges),
+		Wins:      atomic.LoadInt64(&h.stats.Wins),
+		Throttled: atomic.LoadInt64(&h.stats.Throttled),
+	}
+}
+
+func (xc *XClient) hedger(sm string) *hedger {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for _, k := range policyKeys(sm) {
+		if h, ok := xc.hedges[k]; ok {
+			return h
+		}
+	}
+	return nil
+}
+
+type hedgeResult struct {
+	reply lcode.IMessage
+	err   error
+	hedge bool
+}
+
+func (xc *XClient) callHedged(h *hedger, ctx *context.Context, sn, sm string, args, reply lcode.IMessage) error {
+	fun := "XClient.callHedged"
+	cctx, cancel := gctx.WithCancel(ctx)
+	defer cancel()
+	actx := context.NewContext(cctx)
+	traceId := context.GetTraceId(actx)
+
+	h.request()
+	results := make(chan hedgeResult, 1+h.p.MaxHedges)
+	tried := make(map[string]bool)
+	launch := func(hedge bool) error {
+		rpcAddr, err := xc.pickExcept(sn, tried)
+		if err != nil {
+			return err
+		}
+		// 对冲请求不发给已经在处理的服务地址
+		if hedge && tried[rpcAddr] {
+			return errNoHedgeEndpoint
+		}
+		if hedge && !h.allow() {
+			return errHedgeThrottled
+		}
+		tried[rpcAddr] = true
+
+		var r lcode.IMessage
+		if reply != nil {
+			r = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface().(lcode.IMessage)
+		}
+		go func() {
+			begin := time.Now()
+			err := xc.call(rpcAddr, actx, sm, args, r)
+			if err == nil {
+				h.observe(time.Since(begin))
+			}
+			results <- hedgeResult{reply: r, err: err, hedge: hedge}
+		}()
+		return nil
+	}
+
+	err := launch(false)
+	if err != nil {
+		log.Errorf(traceId, "%s Get service:%s mode:%d method:%s failed err:%v", fun, sn, xc.mode, sm, err)
+		return err
+	}
+	inflight, hedges := 1, 0
+
+	timer := time.NewTimer(h.delay())
+	defer timer.Stop()
+	for {
+		select {
+		case res := <-results:
+			inflight--
+			if res.err == nil {
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(res.reply).Elem())
+				}
+				if res.hedge {
+					atomic.AddInt64(&h.stats.Wins, 1)
+					mHedges.With(sm, "won").Inc()
+				}
+				return nil
+			}
+			if inflight == 0 {
+				return res.err
+			}
+		case <-timer.C:
+			if hedges >= h.p.MaxHedges || ctx.Err() != nil {
+				continue
+			}
+			err := launch(true)
+			switch err {
+			case nil:
+			case errNoHedgeEndpoint:
+				mHedges.With(sm, "skipped").Inc()
+				continue
+			case errHedgeThrottled:
+				atomic.AddInt64(&h.stats.Throttled, 1)
+				mHedges.With(sm, "throttled").Inc()
+				continue
+			default:
+				log.Warningf(traceId, "%s method:%s hedge pick failed err:%v", fun, sm, err)
+				continue
+			}
+			inflight++
+			hedges++
+			atomic.AddInt64(&h.stats.Hedges, 1)
+			mHedges.With(sm, "sent").Inc()
+			if hedges < h.p.MaxHedges {
+				timer.Reset(h.delay())
+			}
+		}
+	}
+}
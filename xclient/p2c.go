@@ -60,6 +60,23 @@ type peakEwmaNode struct {
 	weight  float64
 }
 
+// filterNodes 同 filterServers
+func filterNodes(ns []*peakEwmaNode, f Filter) ([]*peakEwmaNode, error) {
+	if f == nil {
+		return ns, nil
+	}
+	var res []*peakEwmaNode
+	for _, n := range ns {
+		if f(n.item) {
+			res = append(res, n)
+		}
+	}
+	if len(res) == 0 {
+		return nil, ErrCircuitOpen
+	}
+	return res, nil
+}
+
 type pewma struct {
 	items []*peakEwmaNode
 	mu    sync.Mutex
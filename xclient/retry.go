@@ -0,0 +1,188 @@
+package xclient
+
+/*
+ * XClient.Call 的重试策略, 按 "Service.Method", "Service" 的顺序查找, "" 为默认策略
+ *   请求一定没有发出时(建立连接失败, 连接不可用)总是可以重试
+ *   请求可能已经送达时, 只有 Idempotent 的方法且错误码可重试时才重试
+ *   每次重试优先选择还没有尝试过的服务地址, 等待按指数退避加随机抖动
+ * */
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+)
+
+// RetryPolicy 零值字段使用 DefaultRetryPolicy 中的值
+type RetryPolicy struct {
+	MaxAttempts int           // 包括第一次
+	BaseDelay   time.Duration // 第一次重试前的等待
+	MaxDelay    time.Duration // 等待的上限
+	Multiplier  float64       // 每次重试后等待乘以该值
+	Jitter      float64       // 等待随机浮动的比例
+	Codes       []lcode.Code  // 请求可能已送达时可以重试的错误码
+	Budget      time.Duration // 从第一次尝试开始, 超过该时间后不再重试, 0 不限制
+	Idempotent  bool          // 请求可能已送达后是否还可以重试
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    time.Second,
+	Multiplier:  2,
+	Jitter:      0.2,
+	Codes:       []lcode.Code{lcode.CodeUnavailable},
+}
+
+func (p RetryPolicy) withDefault() *RetryPolicy {
+	d := DefaultRetryPolicy
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = d.MaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = d.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = d.MaxDelay
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = d.Multiplier
+	}
+	if p.Jitter <= 0 || p.Jitter > 1 {
+		p.Jitter = d.Jitter
+	}
+	if len(p.Codes) == 0 {
+		p.Codes = d.Codes
+	}
+	return &p
+}
+
+// backoff 第 n 次重试前的等待
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := float64(p.BaseDelay) * math.Pow(p.Multiplier, float64(n-1))
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// retryable 连接层的错误没有错误码, 按 Unavailable 处理
+func (p *RetryPolicy) retryable(err error) bool {
+	code := lcode.CodeUnavailable
+	var e *lcode.Error
+	if errors.As(err, &e) {
+		code = e.Code
+	}
+	for _, c := range p.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRetryPolicy key 为 "Service.Method", "Service" 或 "" (默认), p 为 nil 时删除
+func (xc *XClient) SetRetryPolicy(key string, p *RetryPolicy) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if p == nil {
+		delete(xc.retries, key)
+		return
+	}
+	xc.retries[key] = p.withDefault()
+}
+
+// policyKeys 查找策略的顺序: 方法, 服务, 默认
+func policyKeys(sm string) []string {
+	keys := []string{sm}
+	if i := strings.LastIndex(sm, "."); i > 0 {
+		keys = append(keys, sm[:i])
+	}
+	return append(keys, "")
+}
+
+func (xc *XClient) retryPolicy(sm string) *RetryPolicy {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for _, k := range policyKeys(sm) {
+		if p, ok := xc.retries[k]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// pickExcept 优先选择 tried 之外的服务地址, 都尝试过时按选择模式选择
+func (xc *XClient) pickExcept(sn string, tried map[string]bool) (string, error) {
+	rpcAddr, err := xc.pick(sn)
+	if err != nil || !tried[rpcAddr] {
+		return rpcAddr, err
+	}
+
+	ss, err := xc.d.GetAll(sn)
+	if err != nil {
+		return rpcAddr, nil
+	}
+	var left []string
+	for _, s := range ss {
+		s = normalizeAddr(s)
+		if !tried[s] && xc.breakerReady(s) {
+			left = append(left, s)
+		}
+	}
+	if len(left) == 0 {
+		return rpcAddr, nil
+	}
+	return left[rand.Intn(len(left))], nil
+}
+
+func (xc *XClient) callRetry(p *RetryPolicy, ctx *context.Context, sn, sm string, args, reply lcode.IMessage) error {
+	fun := "XClient.callRetry"
+	traceId := context.GetTraceId(ctx)
+
+	var deadline time.Time
+	if p.Budget > 0 {
+		deadline = time.Now().Add(p.Budget)
+	}
+	tried := make(map[string]bool)
+
+	var err error
+	for n := 1; ; n++ {
+		var rpcAddr string
+		rpcAddr, err = xc.pickExcept(sn, tried)
+		if err != nil {
+			log.Errorf(traceId, "%s Get service:%s mode:%d method:%s failed err:%v", fun, sn, xc.mode, sm, err)
+			return err
+		}
+		tried[rpcAddr] = true
+
+		var sent bool
+		sent, err = xc.tryCall(rpcAddr, ctx, sm, args, reply)
+		if err == nil || ctx.Err() != nil || n >= p.MaxAttempts {
+			return err
+		}
+		if sent && !(p.Idempotent && p.retryable(err)) {
+			return err
+		}
+
+		delay := p.backoff(n)
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			log.Warningf(traceId, "%s method:%s retry budget %s exhausted after %d attempts", fun, sm, p.Budget, n)
+			return err
+		}
+		log.Warningf(traceId, "%s rpcAddr:%s method:%s attempt:%d sent:%v retry in %s err:%v", fun, rpcAddr, sm, n, sent, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
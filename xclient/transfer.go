@@ -0,0 +1,86 @@
+package xclient
+
+import (
+	"io"
+	"time"
+
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/log"
+)
+
+// DefaultTransferAttempts 传输中断后最多尝试的次数, 每次重新选择服务地址并续传
+const DefaultTransferAttempts = 3
+
+// transferRetryable 连接类错误可以续传, 服务端明确拒绝的不重试
+func transferRetryable(err error) bool {
+	switch lcode.ErrorCode(err) {
+	case lcode.CodeUnknown, lcode.CodeUnavailable:
+		return true
+	}
+	return false
+}
+
+// Upload 见 client.Client.Upload, 中断后从服务端确认的位置续传
+func (xc *XClient) Upload(ctx *context.Context, sn, sm, name string, r io.ReaderAt, size int64) (int64, error) {
+	var (
+		n   int64
+		err error
+	)
+	for i := 0; i < DefaultTransferAttempts; i++ {
+		var rpcAddr string
+		rpcAddr, err = xc.pick(sn)
+		if err != nil {
+			log.Errorf("", "XClient.Upload Get service:%s mode:%d method:%s failed err:%v", sn, xc.mode, sm, err)
+			return n, err
+		}
+
+		begin := time.Now().UnixNano()
+		cli, derr := xc.dial(rpcAddr)
+		if derr != nil {
+			err = derr
+		} else {
+			n, err = cli.Upload(ctx, sm, name, r, size)
+		}
+		xc.Observe(rpcAddr, time.Now().UnixNano()-begin)
+
+		if err == nil || !transferRetryable(err) || ctx.Err() != nil {
+			return n, err
+		}
+		log.Warningf(context.GetTraceId(ctx), "XClient.Upload rpcAddr:%s name:%s acked:%d attempt:%d err:%v", rpcAddr, name, n, i+1, err)
+	}
+	return n, err
+}
+
+// Download 见 client.Client.Download, 中断后从已写入的位置续传
+func (xc *XClient) Download(ctx *context.Context, sn, sm, name string, offset int64, w io.Writer) (int64, error) {
+	var (
+		total int64
+		err   error
+	)
+	for i := 0; i < DefaultTransferAttempts; i++ {
+		var rpcAddr string
+		rpcAddr, err = xc.pick(sn)
+		if err != nil {
+			log.Errorf("", "XClient.Download Get service:%s mode:%d method:%s failed err:%v", sn, xc.mode, sm, err)
+			return total, err
+		}
+
+		var n int64
+		begin := time.Now().UnixNano()
+		cli, derr := xc.dial(rpcAddr)
+		if derr != nil {
+			err = derr
+		} else {
+			n, err = cli.Download(ctx, sm, name, offset+total, w)
+		}
+		xc.Observe(rpcAddr, time.Now().UnixNano()-begin)
+		total += n
+
+		if err == nil || !transferRetryable(err) || ctx.Err() != nil {
+			return total, err
+		}
+		log.Warningf(context.GetTraceId(ctx), "XClient.Download rpcAddr:%s name:%s written:%d attempt:%d err:%v", rpcAddr, name, total, i+1, err)
+	}
+	return total, err
+}
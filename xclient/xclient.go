@@ -10,6 +10,7 @@ package xclient
 import (
 	"io"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,12 +23,25 @@ import (
 	"github.com/zulong210220/lrpc/rpc"
 )
 
+// poolSweepInterval 多久检查一次服务地址是否还在 Discovery 中
+const poolSweepInterval = 10 * time.Second
+
 type XClient struct {
 	d       Discovery
 	mode    SelectMode
 	opt     *rpc.Option
+	pool    client.PoolConfig
 	mu      sync.Mutex
-	clients map[string]*client.Client
+	clients map[string]*client.Pool
+	names   map[string]bool // 调用过的服务名, 用来回收已下线地址的连接池
+	done    chan struct{}
+	retries map[string]*RetryPolicy // 按方法或服务配置, 见 retry.go
+	hedges  map[string]*hedger      // 同上, 见 hedge.go
+
+	// 熔断, 见 breaker.go
+	breakerCfg *BreakerConfig
+	breakers   map[string]*breaker
+	fallbacks  map[string]Fallback
 }
 
 var (
@@ -35,55 +49,152 @@ var (
 )
 
 func NewXClient(d Discovery, mode SelectMode, opt *rpc.Option) *XClient {
-	return &XClient{
+	xc := &XClient{
 		d:       d,
 		mode:    mode,
 		opt:     opt,
-		clients: make(map[string]*client.Client),
+		pool:    client.DefaultPoolConfig,
+		clients: make(map[string]*client.Pool),
+		names:   make(map[string]bool),
+		done:    make(chan struct{}),
+		retries: make(map[string]*RetryPolicy),
+		hedges:  make(map[string]*hedger),
+
+		fallbacks: make(map[string]Fallback),
 	}
+	go xc.sweepLoop()
+	return xc
+}
+
+// SetPoolConfig 每个服务地址的连接池配置, 只对之后新建的连接池生效
+func (xc *XClient) SetPoolConfig(cfg client.PoolConfig) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.pool = cfg
 }
 
 func (xc *XClient) Close() error {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
 
-	for key, client := range xc.clients {
-		_ = client.Close()
+	select {
+	case <-xc.done:
+	default:
+		close(xc.done)
+	}
+
+	for key, pool := range xc.clients {
+		_ = pool.Close()
 		delete(xc.clients, key)
 	}
 	return nil
 }
 
-func (xc *XClient) dial(rpcAddr string) (*client.Client, error) {
-	xc.mu.Lock()
-	defer xc.mu.Unlock()
+func (xc *XClient) sweepLoop() {
+	ticker := time.NewTicker(poolSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-xc.done:
+			return
+		case <-ticker.C:
+			xc.sweep()
+		}
+	}
+}
 
-	cli, ok := xc.clients[rpcAddr]
+// sweep 关闭不再由 Discovery 返回的服务地址的连接池, 同时删除其熔断器
+func (xc *XClient) sweep() {
+	fun := "XClient.sweep"
+	xc.mu.Lock()
+	names := make([]string, 0, len(xc.names))
+	for sn := range xc.names {
+		names = append(names, sn)
+	}
+	xc.mu.Unlock()
 
-	if cli == nil {
-		var err error
-		cli, err = client.XDial(rpcAddr, xc.opt)
+	live := make(map[string]bool)
+	for _, sn := range names {
+		ss, err := xc.d.GetAll(sn)
 		if err != nil {
-			return nil, err
+			// 无法确认时保留
+			log.Warningf("", "%s GetAll service:%s failed err:%v", fun, sn, err)
+			return
+		}
+		for _, s := range ss {
+			live[normalizeAddr(s)] = true
 		}
-		xc.clients[rpcAddr] = cli
 	}
 
-	if ok && !cli.IsAvailable() {
-		_ = cli.Close()
-		delete(xc.clients, rpcAddr)
-		cli = nil
+	var stale []*client.Pool
+	xc.mu.Lock()
+	for rpcAddr, pool := range xc.clients {
+		if !live[rpcAddr] {
+			log.Infof("", "%s rpcAddr:%s removed from discovery, close pool", fun, rpcAddr)
+			stale = append(stale, pool)
+			delete(xc.clients, rpcAddr)
+		}
+	}
+	for rpcAddr := range xc.breakers {
+		if !live[rpcAddr] {
+			delete(xc.breakers, rpcAddr)
+			deleteBreakerMetrics(rpcAddr)
+		}
 	}
+	xc.mu.Unlock()
 
-	return cli, nil
+	for _, pool := range stale {
+		_ = pool.Close()
+	}
+}
 
+// dial 从服务地址的连接池中取一个连接
+func (xc *XClient) dial(rpcAddr string) (*client.Client, error) {
+	xc.mu.Lock()
+	pool := xc.clients[rpcAddr]
+	if pool == nil {
+		var err error
+		pool, err = client.NewPool(rpcAddr, xc.opt, &xc.pool)
+		if err != nil {
+			xc.mu.Unlock()
+			return nil, err
+		}
+		xc.clients[rpcAddr] = pool
+	}
+	xc.mu.Unlock()
+
+	return pool.Get()
 }
 
 func (xc *XClient) call(rpcAddr string, ctx *context.Context, sm string, args, reply lcode.IMessage) error {
+	_, err := xc.tryCall(rpcAddr, ctx, sm, args, reply)
+	return err
+}
+
+// tryCall sent 为 false 表示请求一定没有发出, 可以安全地重试
+func (xc *XClient) tryCall(rpcAddr string, ctx *context.Context, sm string, args, reply lcode.IMessage) (sent bool, err error) {
+	if b := xc.breaker(rpcAddr); b != nil {
+		if !b.allow() {
+			mBreakerRejected.With(rpcAddr).Inc()
+			return false, ErrCircuitOpen
+		}
+		defer func() {
+			// 调用方取消的不计, 归还探测
+			if ctx.Err() != nil {
+				b.release()
+				return
+			}
+			b.record(breakerFailure(err))
+		}()
+	}
+
 	cli, err := xc.dial(rpcAddr)
 	if err != nil {
 		log.Errorf("xc call", "XClient.call rpcAddr:%s failed err:%v", rpcAddr, err)
-		return err
+		return false, err
+	}
+	if st := cli.State(); st != client.StateReady {
+		return false, lcode.Errorf(lcode.CodeUnavailable, "rpc xclient: %s connection %s", rpcAddr, st)
 	}
 
 	begin := time.Now().UnixNano()
@@ -91,27 +202,75 @@ func (xc *XClient) call(rpcAddr string, ctx *context.Context, sm string, args, r
 	end := time.Now().UnixNano()
 
 	xc.Observe(rpcAddr, end-begin)
-	return err
+	return !client.IsNotSent(err), err
 }
 
 func (xc *XClient) Observe(rpcAddr string, dur int64) {
 	xc.d.Observe(rpcAddr, dur)
 }
 
-// TODO server close retry
-func (xc *XClient) Call(ctx *context.Context, sn, sm string, args, reply lcode.IMessage) error {
+// pick 按选择模式取一个服务地址
+func (xc *XClient) pick(sn string) (string, error) {
+	xc.addName(sn)
 	rpcAddr, err := xc.d.Get(sn, xc.mode)
 	if err != nil {
-		log.Errorf("", "XClient.Call Get service:%s mode:%d method:%s failed err:%v", sn, xc.mode, sm, err)
-		return err
+		return "", err
+	}
+	return normalizeAddr(rpcAddr), nil
+}
+
+func (xc *XClient) addName(sn string) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.names[sn] = true
+}
+
+// normalizeAddr 旧格式 ip:port 默认tcp
+func normalizeAddr(rpcAddr string) string {
+	if !strings.Contains(rpcAddr, "@") {
+		return "tcp@" + rpcAddr
+	}
+	return rpcAddr
+}
+
+// Call 按 SetRetryPolicy 配置的策略重试, 每次重试选择不同的服务地址
+// 配置了 SetHedgePolicy 的方法发送对冲请求, 不再重试
+// 熔断导致失败时使用 SetFallback 配置的降级处理
+func (xc *XClient) Call(ctx *context.Context, sn, sm string, args, reply lcode.IMessage) error {
+	err := xc.doCall(ctx, sn, sm, args, reply)
+	if err == ErrCircuitOpen {
+		if f := xc.fallback(sm); f != nil {
+			return f(ctx, sm, args, reply, err)
+		}
 	}
+	return err
+}
 
-	rpcAddr = "tcp@" + rpcAddr
+// Go 异步的 Call, 见 client.Future
+func (xc *XClient) Go(ctx *context.Context, sn, sm string, args, reply lcode.IMessage) *client.Future {
+	return client.NewFuture(ctx, reply, func(ctx *context.Context) error {
+		return xc.Call(ctx, sn, sm, args, reply)
+	})
+}
 
-	return xc.call(rpcAddr, ctx, sm, args, reply)
+func (xc *XClient) doCall(ctx *context.Context, sn, sm string, args, reply lcode.IMessage) error {
+	if h := xc.hedger(sm); h != nil {
+		return xc.callHedged(h, ctx, sn, sm, args, reply)
+	}
+	p := xc.retryPolicy(sm)
+	if p == nil {
+		rpcAddr, err := xc.pick(sn)
+		if err != nil {
+			log.Errorf("", "XClient.Call Get service:%s mode:%d method:%s failed err:%v", sn, xc.mode, sm, err)
+			return err
+		}
+		return xc.call(rpcAddr, ctx, sm, args, reply)
+	}
+	return xc.callRetry(p, ctx, sn, sm, args, reply)
 }
 
 func (xc *XClient) Broadcast(ctx *context.Context, sn, sm string, args, reply lcode.IMessage) error {
+	xc.addName(sn)
 	ss, err := xc.d.GetAll(sn)
 	if err != nil {
 		return err
@@ -148,7 +307,7 @@ func (xc *XClient) Broadcast(ctx *context.Context, sn, sm string, args, reply lc
 				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
 				replyDone = true
 			}
-		}(rpcAddr)
+		}(normalizeAddr(rpcAddr))
 	}
 	wg.Wait()
 	return e
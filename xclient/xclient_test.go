@@ -0,0 +1,472 @@
+package xclient
+
+import (
+	"bytes"
+	gctx "context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zulong210220/lrpc/client"
+	"github.com/zulong210220/lrpc/context"
+	"github.com/zulong210220/lrpc/lcode"
+	"github.com/zulong210220/lrpc/models"
+	"github.com/zulong210220/lrpc/rpc"
+	"github.com/zulong210220/lrpc/transport"
+)
+
+// Node 按 id 区分服务地址, 可以配置延迟和返回的错误
+type Node struct {
+	id    int
+	calls int64
+
+	mu    sync.Mutex
+	delay time.Duration
+	err   error
+}
+
+func (n *Node) set(delay time.Duration, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.delay, n.err = delay, err
+}
+
+func (n *Node) Calls() int64 {
+	return atomic.LoadInt64(&n.calls)
+}
+
+// Who 返回 id
+func (n *Node) Who(args models.Args, reply *models.Reply) error {
+	atomic.AddInt64(&n.calls, 1)
+	n.mu.Lock()
+	delay, err := n.delay, n.err
+	n.mu.Unlock()
+
+	time.Sleep(delay)
+	if err != nil {
+		return err
+	}
+	reply.Num = n.id
+	return nil
+}
+
+// startNodes 在内存连接上启动 n 个服务, 返回的地址与 Node 一一对应
+func startNodes(t *testing.T, name string, n int) ([]string, []*Node, func()) {
+	lcode.Init()
+
+	var (
+		addrs []string
+		nodes []*Node
+		ss    []*rpc.Server
+	)
+	for i := 0; i < n; i++ {
+		addr := name + string(rune('a'+i))
+		ln, err := transport.ListenMem(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := &Node{id: i + 1}
+		s := rpc.NewServer()
+		_ = s.Register(node)
+		go s.Accept(ln)
+
+		addrs = append(addrs, "mem@"+addr)
+		nodes = append(nodes, node)
+		ss = append(ss, s)
+	}
+	return addrs, nodes, func() {
+		for _, s := range ss {
+			_ = s.Shutdown()
+		}
+	}
+}
+
+func newContext() *context.Context {
+	return context.NewContext(gctx.Background())
+}
+
+func waitFor(d time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestSweep(t *testing.T) {
+	addrs, _, stop := startNodes(t, "sweep", 2)
+	defer stop()
+
+	d := NewMultiServerDiscovery(addrs)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	ctx := newContext()
+
+	for i := 0; i < 2; i++ {
+		var r models.Reply
+		if err := xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(xc.clients); n != 2 {
+		t.Fatalf("expect 2 pools, got %d", n)
+	}
+
+	// 下线的服务地址的连接池被关闭
+	_ = d.Update("", addrs[:1])
+	xc.sweep()
+	xc.mu.Lock()
+	_, ok := xc.clients[addrs[1]]
+	n := len(xc.clients)
+	xc.mu.Unlock()
+	if ok || n != 1 {
+		t.Fatalf("expect pool of %s closed, got %d pools", addrs[1], n)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	addrs, nodes, stop := startNodes(t, "retry", 3)
+	defer stop()
+
+	xc := NewXClient(NewMultiServerDiscovery(addrs), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	ctx := newContext()
+	calls := func() (total int64, each []int64) {
+		for _, n := range nodes {
+			c := atomic.SwapInt64(&n.calls, 0)
+			total += c
+			each = append(each, c)
+		}
+		return
+	}
+	unavailable := lcode.NewError(lcode.CodeUnavailable, "unavailable")
+	for _, n := range nodes {
+		n.set(0, unavailable)
+	}
+
+	// 最多 MaxAttempts 次, 每次选择不同的服务地址
+	xc.SetRetryPolicy("Node", &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Idempotent: true})
+	var r models.Reply
+	err := xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r)
+	if lcode.ErrorCode(err) != lcode.CodeUnavailable {
+		t.Fatalf("expect unavailable, got %v", err)
+	}
+	if total, each := calls(); total != 3 || each[0] != 1 || each[1] != 1 || each[2] != 1 {
+		t.Fatalf("expect each endpoint tried once, got %v", each)
+	}
+
+	// 成功后不再重试
+	nodes[0].set(0, nil)
+	nodes[1].set(0, nil)
+	if err = xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if total, _ := calls(); total > 2 {
+		t.Fatalf("expect at most 2 attempts, got %d", total)
+	}
+	nodes[0].set(0, unavailable)
+	nodes[1].set(0, unavailable)
+
+	// 不可重试的错误码
+	for _, n := range nodes {
+		n.set(0, lcode.NewError(lcode.CodeInvalidRequest, "bad args"))
+	}
+	err = xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r)
+	if lcode.ErrorCode(err) != lcode.CodeInvalidRequest {
+		t.Fatalf("expect invalid request, got %v", err)
+	}
+	if total, _ := calls(); total != 1 {
+		t.Fatalf("expect no retry for invalid request, got %d attempts", total)
+	}
+	for _, n := range nodes {
+		n.set(0, unavailable)
+	}
+
+	// 方法的策略优先于服务的策略; 非幂等的方法请求发出后不重试
+	xc.SetRetryPolicy("Node.Who", &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	_ = xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r)
+	if total, _ := calls(); total != 1 {
+		t.Fatalf("expect no retry after send, got %d attempts", total)
+	}
+	xc.SetRetryPolicy("Node.Who", nil)
+
+	// 超过 Budget 后不再重试
+	xc.SetRetryPolicy("Node", &RetryPolicy{MaxAttempts: 3, BaseDelay: 200 * time.Millisecond, Budget: 50 * time.Millisecond, Idempotent: true})
+	begin := time.Now()
+	_ = xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r)
+	if total, _ := calls(); total != 1 || time.Since(begin) > 100*time.Millisecond {
+		t.Fatalf("expect budget exhausted after 1 attempt, got %d in %s", total, time.Since(begin))
+	}
+}
+
+func TestRetryNotSent(t *testing.T) {
+	addrs, _, stop := startNodes(t, "notsent", 1)
+	defer stop()
+
+	// 没有发出的请求总是可以重试, 即使方法不是幂等的
+	xc := NewXClient(NewMultiServerDiscovery(append(addrs, "mem@notsent-missing")), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetryPolicy("", &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond})
+	ctx := newContext()
+	for i := 0; i < 4; i++ {
+		var r models.Reply
+		if err := xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r); err != nil || r.Num != 1 {
+			t.Fatalf("expect retried on live endpoint, got %d err:%v", r.Num, err)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond, Multiplier: 2, Jitter: 0.1}.withDefault()
+	for n, max := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 10: 40 * time.Millisecond} {
+		d := p.backoff(n)
+		if d < max*9/10 || d > max*11/10 {
+			t.Fatalf("backoff(%d) expect about %s, got %s", n, max, d)
+		}
+	}
+}
+
+// orderedDiscovery Get 总是返回第一个地址
+type orderedDiscovery struct {
+	ss []string
+}
+
+func (d *orderedDiscovery) Get(sn string, mode SelectMode) (string, error) {
+	return d.ss[0], nil
+}
+
+func (d *orderedDiscovery) GetAll(sn string) ([]string, error) {
+	return d.ss, nil
+}
+
+func (d *orderedDiscovery) Observe(rpcAddr string, dur int64) {}
+
+func TestHedge(t *testing.T) {
+	addrs, nodes, stop := startNodes(t, "hedge", 2)
+	defer stop()
+
+	xc := NewXClient(&orderedDiscovery{ss: addrs}, RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	ctx := newContext()
+
+	// 第一个请求超过 Delay 后向另一个地址对冲, 使用先成功的响应
+	nodes[0].set(300*time.Millisecond, nil)
+	xc.SetHedgePolicy("Node", &HedgePolicy{Delay: 30 * time.Millisecond, MaxTokens: 1, BudgetRatio: 0.01})
+	var r models.Reply
+	begin := time.Now()
+	if err := xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Num != 2 || time.Since(begin) > 200*time.Millisecond {
+		t.Fatalf("expect hedge won, got %d in %s", r.Num, time.Since(begin))
+	}
+	if st := xc.HedgeStats("Node"); st.Requests != 1 || st.Hedges != 1 || st.Wins != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	// 落后的请求被取消
+	xc.mu.Lock()
+	pool := xc.clients[addrs[0]]
+	xc.mu.Unlock()
+	slow, _ := pool.Get()
+	if !waitFor(time.Second, func() bool { return slow.Pending() == 0 }) {
+		t.Fatal("expect losing request canceled")
+	}
+
+	// 令牌不足时不对冲
+	r = models.Reply{}
+	if err := xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r); err != nil || r.Num != 1 {
+		t.Fatalf("expect first endpoint reply, got %d err:%v", r.Num, err)
+	}
+	if st := xc.HedgeStats("Node"); st.Hedges != 1 || st.Throttled != 1 {
+		t.Fatalf("expect throttled, got %+v", st)
+	}
+
+	// 没有其它地址时不对冲
+	one := NewXClient(&orderedDiscovery{ss: addrs[:1]}, RandomSelect, nil)
+	defer func() { _ = one.Close() }()
+	one.SetHedgePolicy("", &HedgePolicy{Delay: 10 * time.Millisecond})
+	atomic.StoreInt64(&nodes[0].calls, 0)
+	nodes[0].set(100*time.Millisecond, nil)
+	if err := one.Call(ctx, "Node", "Node.Who", &models.Args{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if n := nodes[0].Calls(); n != 1 {
+		t.Fatalf("expect no hedge to the same endpoint, got %d calls", n)
+	}
+	if st := one.HedgeStats(""); st.Hedges != 0 {
+		t.Fatalf("expect no hedge, got %+v", st)
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	h := newHedger(HedgePolicy{Delay: time.Second, Percentile: 0.9})
+	// 样本不足时使用 Delay
+	h.observe(time.Millisecond)
+	if d := h.delay(); d != time.Second {
+		t.Fatalf("expect fixed delay, got %s", d)
+	}
+	for i := 2; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := h.delay(); d != 91*time.Millisecond {
+		t.Fatalf("expect p90 91ms, got %s", d)
+	}
+	// 只保留最近的样本
+	for i := 0; i < hedgeLatencySamples; i++ {
+		h.observe(5 * time.Millisecond)
+	}
+	if d := h.delay(); d != 5*time.Millisecond {
+		t.Fatalf("expect recent samples only, got %s", d)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	cfg := BreakerConfig{
+		ConsecutiveFailures: 3,
+		MinRequests:         10,
+		ErrorRate:           0.5,
+		OpenTimeout:         20 * time.Millisecond,
+		HalfOpenRequests:    2,
+		ProbeTimeout:        50 * time.Millisecond,
+	}.withDefault()
+
+	// 连续失败后打开
+	b := newBreaker("consecutive", cfg)
+	for i := 0; i < 3; i++ {
+		b.record(true)
+	}
+	if st := b.State(); st != BreakerOpen || b.allow() || b.ready() {
+		t.Fatalf("expect open, got %s", st)
+	}
+
+	// 错误率超过 ErrorRate 后打开
+	b = newBreaker("rate", cfg)
+	for i := 0; i < 10; i++ {
+		b.record(i%2 == 1)
+		if i < 9 && b.State() != BreakerClosed {
+			t.Fatalf("expect closed before MinRequests, got %s at %d", b.State(), i)
+		}
+	}
+	if st := b.State(); st != BreakerOpen {
+		t.Fatalf("expect open by error rate, got %s", st)
+	}
+
+	// OpenTimeout 后半开, 探测全部成功后关闭
+	time.Sleep(cfg.OpenTimeout)
+	if !b.allow() || b.State() != BreakerHalfOpen {
+		t.Fatalf("expect half open, got %s", b.State())
+	}
+	if !b.allow() || b.allow() {
+		t.Fatal("expect HalfOpenRequests probes")
+	}
+	b.record(false)
+	if st := b.State(); st != BreakerHalfOpen {
+		t.Fatalf("expect half open until all probes succeed, got %s", st)
+	}
+	b.record(false)
+	if st := b.State(); st != BreakerClosed {
+		t.Fatalf("expect closed, got %s", st)
+	}
+
+	// 探测失败重新打开
+	for i := 0; i < 3; i++ {
+		b.record(true)
+	}
+	time.Sleep(cfg.OpenTimeout)
+	b.allow()
+	b.record(true)
+	if st := b.State(); st != BreakerOpen {
+		t.Fatalf("expect reopened, got %s", st)
+	}
+
+	// 取消的探测归还, 没有结果的探测超时后作废
+	time.Sleep(cfg.OpenTimeout)
+	b.allow()
+	b.allow()
+	if b.ready() {
+		t.Fatal("expect no probe left")
+	}
+	b.release()
+	if !b.ready() || !b.allow() || b.ready() {
+		t.Fatal("expect canceled probe released")
+	}
+	time.Sleep(cfg.ProbeTimeout)
+	if !b.ready() || b.State() != BreakerHalfOpen {
+		t.Fatalf("expect stale probes expired, got %s", b.State())
+	}
+}
+
+func TestBreakerDiscovery(t *testing.T) {
+	addrs, nodes, stop := startNodes(t, "breaker", 2)
+	defer stop()
+
+	d := NewMultiServerDiscovery(addrs)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.EnableBreaker(&BreakerConfig{ConsecutiveFailures: 2, OpenTimeout: time.Minute})
+	ctx := newContext()
+
+	unavailable := lcode.NewError(lcode.CodeUnavailable, "unavailable")
+	nodes[0].set(0, unavailable)
+	for i := 0; i < 4; i++ {
+		var r models.Reply
+		_ = xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r)
+	}
+	if st := xc.BreakerState(addrs[0]); st != BreakerOpen {
+		t.Fatalf("expect %s open, got %s", addrs[0], st)
+	}
+
+	// 选择时跳过打开的地址
+	for i := 0; i < 4; i++ {
+		var r models.Reply
+		if err := xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r); err != nil || r.Num != 2 {
+			t.Fatalf("expect open endpoint skipped, got %d err:%v", r.Num, err)
+		}
+	}
+
+	// 全部打开时使用降级处理
+	nodes[1].set(0, unavailable)
+	for i := 0; i < 2; i++ {
+		var r models.Reply
+		_ = xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r)
+	}
+	if _, err := xc.d.Get("Node", RoundRobinSelect); err != ErrCircuitOpen {
+		t.Fatalf("expect selection rejected, got %v", err)
+	}
+	var r models.Reply
+	if err := xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r); err != ErrCircuitOpen {
+		t.Fatalf("expect circuit open, got %v", err)
+	}
+	xc.SetFallback("Node", func(ctx *context.Context, sm string, args, reply lcode.IMessage, err error) error {
+		reply.(*models.Reply).Num = 42
+		return nil
+	})
+	if err := xc.Call(ctx, "Node", "Node.Who", &models.Args{}, &r); err != nil || r.Num != 42 {
+		t.Fatalf("expect fallback reply, got %d err:%v", r.Num, err)
+	}
+
+	// 下线的服务地址的熔断器和指标一起删除
+	_ = d.Update("", addrs[1:])
+	xc.sweep()
+	xc.mu.Lock()
+	_, ok := xc.breakers[normalizeAddr(addrs[0])]
+	xc.mu.Unlock()
+	var buf bytes.Buffer
+	_, _ = client.Metrics.WriteTo(&buf)
+	for _, name := range []string{"state", "transitions_total", "rejected_total"} {
+		if strings.Contains(buf.String(), "lrpc_xclient_breaker_"+name+`{endpoint="`+normalizeAddr(addrs[0])+`"`) {
+			t.Fatalf("expect %s breaker metrics removed, got:\n%s", addrs[0], buf.String())
+		}
+	}
+	if ok {
+		t.Fatalf("expect breaker of %s removed", addrs[0])
+	}
+	if !strings.Contains(buf.String(), `lrpc_xclient_breaker_state{endpoint="`+normalizeAddr(addrs[1])+`"} 1`) {
+		t.Fatalf("expect breaker of %s kept, got:\n%s", addrs[1], buf.String())
+	}
+}